@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/postgres"
@@ -34,17 +36,37 @@ func main() {
 	}
 
 	// this is the definition on an endpoint. Whenever we receive a request with
-	// GET html verb on the path http://localhost:8080/ping
-	r.GET("/ping", func(c *gin.Context) {
-		// we try to access the database in order to
-		// see if the connection is ok
-		tx := db.Begin()
-		// do nothing
-		tx.Commit()
+	// GET html verb on the path http://localhost:8080/healthz we answer that
+	// the application is alive: if it does not answer it has to be restarted.
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "up"})
+	})
+
+	// http://localhost:8080/readyz tells if the application can serve the
+	// requests, that is if the database answers. We don't wait for it more
+	// than 2 seconds.
+	r.GET("/readyz", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+		defer cancel()
+
+		database := gin.H{"status": "up"}
+		sqlDB, err := db.DB()
+		if err == nil {
+			err = sqlDB.PingContext(ctx)
+		}
+		if err != nil {
+			database = gin.H{"status": "down", "error": err.Error()}
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":     "unavailable",
+				"components": gin.H{"database": database},
+			})
+			return
+		}
 
 		// then return a result using JSON
 		c.JSON(http.StatusOK, gin.H{
-			"message": "pong",
+			"status":     "ready",
+			"components": gin.H{"database": database},
 		})
 	})
 
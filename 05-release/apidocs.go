@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"example/contact-manager/docs"
+
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+)
+
+// The API is documented by the swag annotations of the handlers, 'swag init'
+// generates the spec in the docs package. The spec is served at
+// /openapi.json and the Swagger UI, embedded in the executable, reads it at
+// /docs. The @host of the annotations in main.go is the default, the host is
+// replaced at runtime by setupAPIDocs.
+
+// setupAPIDocs replaces the host of the @host annotation with the public URL
+// of the configuration or, without it, with the address the server listens
+// on.
+func setupAPIDocs(cfg Config) {
+	if cfg.PublicURL != "" {
+		if u, err := url.Parse(cfg.PublicURL); err == nil && u.Host != "" {
+			docs.SwaggerInfo.Host = u.Host
+			docs.SwaggerInfo.Schemes = []string{u.Scheme}
+			docs.SwaggerInfo.BasePath = strings.TrimSuffix(u.Path, "/")
+			return
+		}
+	}
+	host, port, err := net.SplitHostPort(cfg.ServerAddr)
+	if err != nil {
+		return
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	docs.SwaggerInfo.Host = net.JoinHostPort(host, port)
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// serveOpenAPI returns the spec of the API.
+func serveOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(docs.SwaggerInfo.ReadDoc()))
+}
+
+// serveAPIDocs serves the Swagger UI, that reads the spec at /openapi.json.
+// The URL of the spec is relative, the UI works behind a proxy that serves
+// the API under a path.
+func serveAPIDocs() gin.HandlerFunc {
+	return ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.URL("../openapi.json"))
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// AuditEntry records a request of the API or an operation of a background
+// job: who did what, on which contacts, from where and with which result. The
+// entries are never changed. Each one carries the hash of the previous entry
+// of the tenant, so removing or changing an entry breaks the chain and
+// verifyAuditLog finds it.
+type AuditEntry struct {
+	ID       uint   `gorm:"primaryKey"`
+	TenantID string `gorm:"uniqueIndex:idx_audit_seq" json:"-"`
+	// Seq numbers the entries of the tenant from 1, without gaps.
+	Seq       uint64    `gorm:"uniqueIndex:idx_audit_seq"`
+	CreatedAt time.Time `gorm:"index"`
+	// Actor is the subject of the caller, or the job.
+	Actor      string `gorm:"index"`
+	AuthMethod string
+	IP         string
+	// Action is "read", "export", "create", "update", "delete" or the
+	// operation of a job.
+	Action string `gorm:"index"`
+	// Route is the route called, e.g. "GET /contacts/:id", and Path the
+	// path with the values.
+	Route      string
+	Path       string
+	ContactIDs []uint `gorm:"-"`
+	Status     int
+	// Result is "success", "denied", "failed" or "error".
+	Result   string `gorm:"index"`
+	Detail   string
+	PrevHash string
+	Hash     string
+}
+
+// AuditContact links an entry to the contacts it concerns, for the queries
+// by contact.
+type AuditContact struct {
+	AuditEntryID uint   `gorm:"primaryKey"`
+	ContactID    uint   `gorm:"primaryKey;index"`
+	TenantID     string `gorm:"index" json:"-"`
+}
+
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditFailed  = "failed"
+	AuditError   = "error"
+)
+
+const (
+	auditContactsKey = "auditContacts"
+	auditDetailKey   = "auditDetail"
+)
+
+// AuditFilter selects the entries of the audit log.
+type AuditFilter struct {
+	Actor     string
+	Action    string
+	Result    string
+	IP        string
+	ContactID uint
+	From      time.Time
+	To        time.Time
+	// Before returns the entries with a lower Seq, for the next page.
+	Before uint64
+	Limit  int
+}
+
+// auditActions are the routes that do not have the action of their method.
+var auditActions = map[string]string{
+	"POST /privacy/subjects/:id/erase": "erase",
+}
+
+// auditAction is the action of a route for the audit log.
+func auditAction(method string, path string) string {
+	if action, ok := auditActions[method+" "+path]; ok {
+		return action
+	}
+	switch {
+	case routeBudget(method, path) == budgetExport:
+		return "export"
+	case method == http.MethodGet || method == http.MethodHead:
+		return "read"
+	case method == http.MethodPost:
+		return "create"
+	case method == http.MethodDelete:
+		return "delete"
+	}
+	return "update"
+}
+
+func auditResult(status int) string {
+	switch {
+	case status < 400:
+		return AuditSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return AuditDenied
+	case status < 500:
+		return AuditFailed
+	}
+	return AuditError
+}
+
+// auditContacts adds contacts to the audit entry of the request, the
+// handlers call it for the contacts that are not in the path.
+func auditContacts(c *gin.Context, ids ...uint) {
+	current, _ := c.Get(auditContactsKey)
+	list, _ := current.([]uint)
+	c.Set(auditContactsKey, append(list, ids...))
+}
+
+// personalParameters are the query parameters that search by the personal
+// data, their values are not written in the audit log: it keeps its entries
+// forever, where neither the erasure nor the encryption reach them.
+var personalParameters = map[string]bool{"name": true, "email": true, "phone": true, "q": true}
+
+// auditBulkRead describes the bulk read of the request in its audit entry: the
+// parameters of the query and the number of contacts returned, instead of a
+// link to each one of them. The entry of an export of thousands of contacts
+// stays small, the contacts read can be found again running the query, but
+// for the values of the personal parameters, that are redacted.
+func auditBulkRead(c *gin.Context, count int) {
+	values := c.Request.URL.Query()
+	for name := range values {
+		if personalParameters[name] {
+			values[name] = []string{"redacted"}
+		}
+	}
+	query := values.Encode()
+	if query == "" {
+		query = "all"
+	}
+	auditDetail(c, fmt.Sprintf("query %s: %d contacts", query, count))
+}
+
+// auditDetail adds a note to the audit entry of the request.
+func auditDetail(c *gin.Context, detail string) {
+	c.Set(auditDetailKey, detail)
+}
+
+// audit writes an entry in the audit log for every request, after the
+// handler. The entry is written even when the client has gone away.
+func audit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		principal := currentPrincipal(c)
+		route := c.Request.Method + " " + c.FullPath()
+		entry := AuditEntry{
+			TenantID:   currentTenant(c),
+			CreatedAt:  time.Now(),
+			Actor:      principal.Subject,
+			AuthMethod: principal.Method,
+			IP:         c.ClientIP(),
+			Action:     auditAction(c.Request.Method, c.FullPath()),
+			Route:      route,
+			Path:       c.Request.URL.Path,
+			Status:     c.Writer.Status(),
+			Result:     auditResult(c.Writer.Status()),
+			Detail:     c.GetString(auditDetailKey),
+		}
+		if strings.HasPrefix(c.FullPath(), "/contacts/:id") {
+			if id, err := strconv.ParseUint(c.Param("id"), 10, 64); err == nil {
+				entry.ContactIDs = append(entry.ContactIDs, uint(id))
+			}
+		}
+		if ids, ok := c.Get(auditContactsKey); ok {
+			entry.ContactIDs = append(entry.ContactIDs, ids.([]uint)...)
+		}
+		ctx := withRequestID(withTenant(context.Background(), entry.TenantID), requestIDFromContext(c.Request.Context()))
+		if err := appendAuditEntry(tenantDB(c).WithContext(ctx), &entry); err != nil {
+			slog.ErrorContext(ctx, "cannot write the audit entry", "route", route, "path", entry.Path, "actor", entry.Actor, "error", err)
+		}
+	}
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// ListAuditEntries godoc.
+// @Summary      Get the audit log.
+// @Description  Returns the entries of the audit log, the newest first. The next page
+// @Description  is read passing the Seq of the last entry as before.
+// @tags         Audit
+// @Produce      json
+// @Param        actor    query  string  false  "Only the entries of this caller"
+// @Param        action   query  string  false  "read, export, create, update or delete"
+// @Param        result   query  string  false  "success, denied, failed or error"
+// @Param        ip       query  string  false  "Only the entries from this address"
+// @Param        contact  query  int     false  "Only the entries about this contact"
+// @Param        from     query  string  false  "Only the entries after this time (RFC 3339)"
+// @Param        to       query  string  false  "Only the entries before this time (RFC 3339)"
+// @Param        before   query  int     false  "Only the entries with a lower Seq"
+// @Param        limit    query  int     false  "Number of entries, 100 by default and 1000 at most"
+// @Success      200  {object}  []AuditEntry
+// @Router       /audit [get]
+func listAuditEntries(c *gin.Context) {
+	db := tenantDB(c)
+	filter, err := auditFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entries, err := readAuditEntries(db, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// ExportAuditLog godoc.
+// @Summary      Export the audit log.
+// @Description  Returns the entries of the audit log in JSON Lines, the oldest first.
+// @Description  It accepts the filters of the list, except before and limit.
+// @tags         Audit
+// @Produce      application/x-ndjson
+// @Param        actor    query  string  false  "Only the entries of this caller"
+// @Param        action   query  string  false  "read, export, create, update or delete"
+// @Param        result   query  string  false  "success, denied, failed or error"
+// @Param        contact  query  int     false  "Only the entries about this contact"
+// @Param        from     query  string  false  "Only the entries after this time (RFC 3339)"
+// @Param        to       query  string  false  "Only the entries before this time (RFC 3339)"
+// @Success      200  {string}  string
+// @Router       /audit/export.jsonl [get]
+func exportAuditLog(c *gin.Context) {
+	db := tenantDB(c)
+	filter, err := auditFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	err = readAuditEntriesInBatches(db, filter, func(entries []AuditEntry) error {
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		// the headers are already sent, we can only stop the file.
+		c.Error(err)
+	}
+}
+
+// AuditVerification is the result of the check of the hash chain.
+type AuditVerification struct {
+	Valid   bool
+	Entries int
+	// BrokenAt is the Seq of the first entry that does not match.
+	BrokenAt uint64 `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// VerifyAuditLog godoc.
+// @Summary      Verify the audit log.
+// @Description  Checks the hash chain of the audit log of the tenant and returns the first
+// @Description  entry that was changed or removed.
+// @tags         Audit
+// @Produce      json
+// @Success      200  {object}  AuditVerification
+// @Router       /audit/verify [get]
+func getAuditVerification(c *gin.Context) {
+	db := tenantDB(c)
+	verification, err := verifyAuditLog(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, verification)
+}
+
+func auditFilter(c *gin.Context) (AuditFilter, error) {
+	filter := AuditFilter{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Result: c.Query("result"),
+		IP:     c.Query("ip"),
+		Limit:  100,
+	}
+	if value := c.Query("contact"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid contact '%s'", value)
+		}
+		filter.ContactID = uint(id)
+	}
+	for param, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s '%s', use RFC 3339", param, value)
+			}
+			*target = t
+		}
+	}
+	if value := c.Query("before"); value != "" {
+		before, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid before '%s'", value)
+		}
+		filter.Before = before
+	}
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			return filter, fmt.Errorf("invalid limit '%s', use a number from 1 to 1000", value)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// auditLockClass is the first key of the Postgres advisory locks of the
+// chains, the second one is the hash of the tenant.
+const auditLockClass = 0x617564
+
+// appendAuditEntry adds the entry at the end of the chain of its tenant. The
+// background jobs call it with the plain database and the TenantID set. On
+// Postgres the transaction holds an advisory lock on the chain of the tenant,
+// the writes of all the instances wait for each other; on the other
+// databases the unique Seq refuses the concurrent writes, that are retried.
+func appendAuditEntry(db *gorm.DB, entry *AuditEntry) error {
+	// the database keeps microseconds, the hash must be the same when the
+	// entry is read back
+	entry.CreatedAt = entry.CreatedAt.UTC().Truncate(time.Microsecond)
+	entry.ContactIDs = dedupeIds(entry.ContactIDs)
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if tx.Dialector.Name() == "postgres" {
+				result := tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", auditLockClass, entry.TenantID)
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+			var last AuditEntry
+			result := tx.Where("tenant_id = ?", entry.TenantID).Order("seq DESC").Limit(1).Find(&last)
+			if result.Error != nil {
+				return result.Error
+			}
+			entry.ID = 0
+			entry.Seq = last.Seq + 1
+			entry.PrevHash = last.Hash
+			entry.Hash = auditHash(entry)
+			if result := tx.Create(entry); result.Error != nil {
+				return result.Error
+			}
+			if len(entry.ContactIDs) == 0 {
+				return nil
+			}
+			links := make([]AuditContact, len(entry.ContactIDs))
+			for i, id := range entry.ContactIDs {
+				links[i] = AuditContact{AuditEntryID: entry.ID, ContactID: id, TenantID: entry.TenantID}
+			}
+			return tx.CreateInBatches(links, contactsBatchSize).Error
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot write the audit entry: %w", err)
+}
+
+// auditHash is the hash of the entry and of the previous one.
+func auditHash(entry *AuditEntry) string {
+	data, _ := json.Marshal([]interface{}{
+		entry.TenantID, entry.Seq, entry.CreatedAt.UTC().Format(time.RFC3339Nano), entry.Actor, entry.AuthMethod,
+		entry.IP, entry.Action, entry.Route, entry.Path, entry.ContactIDs, entry.Status, entry.Result,
+		entry.Detail, entry.PrevHash,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func auditQuery(db *gorm.DB, filter AuditFilter) *gorm.DB {
+	query := db.Model(AuditEntry{})
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Result != "" {
+		query = query.Where("result = ?", filter.Result)
+	}
+	if filter.IP != "" {
+		query = query.Where("ip = ?", filter.IP)
+	}
+	if filter.ContactID != 0 {
+		query = query.Where("id IN (?)", db.Model(AuditContact{}).Select("audit_entry_id").Where("contact_id = ?", filter.ContactID))
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+	return query
+}
+
+func readAuditEntries(db *gorm.DB, filter AuditFilter) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	query := auditQuery(db, filter)
+	if filter.Before != 0 {
+		query = query.Where("seq < ?", filter.Before)
+	}
+	if result := query.Order("seq DESC").Limit(filter.Limit).Find(&entries); result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot list the audit entries")
+	}
+	if err := readAuditContacts(db, entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readAuditEntriesInBatches reads the entries from the oldest, in the order of
+// their id, a batch at a time, so the export does not hold the whole log in memory.
+func readAuditEntriesInBatches(db *gorm.DB, filter AuditFilter, fn func([]AuditEntry) error) error {
+	var entries []AuditEntry
+	var err error
+	result := auditQuery(db, filter).FindInBatches(&entries, contactsBatchSize, func(tx *gorm.DB, batch int) error {
+		if err = readAuditContacts(db, entries); err != nil {
+			return err
+		}
+		if err = fn(entries); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot read the audit entries")
+	}
+	return nil
+}
+
+// readAuditContacts fills the ContactIDs of the entries.
+func readAuditContacts(db *gorm.DB, entries []AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(entries))
+	index := make(map[uint]int, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+		index[entry.ID] = i
+	}
+	var links []AuditContact
+	if result := db.Where("audit_entry_id IN ?", ids).Order("audit_entry_id, contact_id").Find(&links); result.Error != nil {
+		return wrapDBError(result.Error, "cannot read the contacts of the audit entries")
+	}
+	for _, link := range links {
+		entry := &entries[index[link.AuditEntryID]]
+		entry.ContactIDs = append(entry.ContactIDs, link.ContactID)
+	}
+	return nil
+}
+
+// verifyAuditLog checks the hash chain of the tenant of the database.
+func verifyAuditLog(db *gorm.DB) (*AuditVerification, error) {
+	verification := &AuditVerification{Valid: true}
+	previous := AuditEntry{}
+	err := readAuditEntriesInBatches(db, AuditFilter{}, func(entries []AuditEntry) error {
+		for i := range entries {
+			entry := &entries[i]
+			switch {
+			case entry.Seq != previous.Seq+1:
+				verification.Error = fmt.Sprintf("entry %d is missing", previous.Seq+1)
+			case entry.PrevHash != previous.Hash:
+				verification.Error = fmt.Sprintf("entry %d is not linked to the previous one", entry.Seq)
+			case entry.Hash != auditHash(entry):
+				verification.Error = fmt.Sprintf("entry %d was changed", entry.Seq)
+			}
+			if verification.Error != "" {
+				verification.Valid = false
+				verification.BrokenAt = entry.Seq
+				return errChainBroken
+			}
+			verification.Entries++
+			previous = *entry
+		}
+		return nil
+	})
+	if err != nil && err != errChainBroken {
+		return nil, err
+	}
+	return verification, nil
+}
+
+var errChainBroken = fmt.Errorf("the audit chain is broken")
+
+// dedupeIds sorts the ids and removes the duplicates.
+func dedupeIds(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	var result []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// protectAuditLog makes the audit tables append only in Postgres, the updates
+// and the deletes fail even for the application.
+func protectAuditLog(db *gorm.DB) error {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION audit_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'the audit log is append only';
+		END
+		$$ LANGUAGE plpgsql`,
+	}
+	for _, table := range []string{"audit_entries", "audit_contacts"} {
+		statements = append(statements,
+			fmt.Sprintf("DROP TRIGGER IF EXISTS audit_append_only ON %s", table),
+			fmt.Sprintf("CREATE TRIGGER audit_append_only BEFORE UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE FUNCTION audit_append_only()", table),
+		)
+	}
+	for _, sql := range statements {
+		if result := db.Exec(sql); result.Error != nil {
+			return fmt.Errorf("cannot protect the audit log: %w", result.Error)
+		}
+	}
+	return nil
+}
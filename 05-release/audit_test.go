@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAuditBulkRead checks that a list of contacts records its query, not a
+// link to every contact.
+func TestAuditBulkRead(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	key := createTestAPIKey(t, "t", "admin", RoleAdmin)
+	for i := 0; i < 3; i++ {
+		decodeResponse(t, testRequest(t, r, key, "POST", "/contacts/", Contact{Name: fmt.Sprintf("contact %d", i)}), http.StatusCreated, nil)
+	}
+	decodeResponse(t, testRequest(t, r, key, "GET", "/contacts/?email=nobody@example.com&tag=vip", nil), http.StatusOK, nil)
+	decodeResponse(t, testRequest(t, r, key, "GET", "/contacts/", nil), http.StatusOK, nil)
+
+	var entries []AuditEntry
+	decodeResponse(t, testRequest(t, r, key, "GET", "/audit/?action=read", nil), http.StatusOK, &entries)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 reads, got %+v", entries)
+	}
+	if entries[0].Detail != "query all: 3 contacts" || len(entries[0].ContactIDs) != 0 {
+		t.Errorf("unexpected entry of the list: %+v", entries[0])
+	}
+	// the value of the email is personal data
+	if entries[1].Detail != "query email=redacted&tag=vip: 0 contacts" || strings.Contains(entries[1].Detail, "nobody") {
+		t.Errorf("unexpected entry of the search: %+v", entries[1])
+	}
+	var links int64
+	db.Model(AuditContact{}).Count(&links)
+	if links != 3 {
+		t.Errorf("expected a link for each created contact, got %d", links)
+	}
+}
+
+// TestAuditChain checks that the entries written at the same time make a
+// chain without gaps.
+func TestAuditChain(t *testing.T) {
+	setupTestDB(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tenant := []string{"alpha", "beta"}[i%2]
+			entry := AuditEntry{TenantID: tenant, CreatedAt: time.Now(), Actor: "test", Action: "read", Result: AuditSuccess}
+			errs <- appendAuditEntry(db.WithContext(withTenant(context.Background(), tenant)), &entry)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tenant := range []string{"alpha", "beta"} {
+		scoped := db.WithContext(withTenant(context.Background(), tenant))
+		verification, err := verifyAuditLog(scoped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verification.Valid || verification.Entries != 20 {
+			t.Errorf("the chain of %s is broken: %+v", tenant, verification)
+		}
+	}
+}
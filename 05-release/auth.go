@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Subject identifies the caller: the "sub" claim of the token or
+	// "apikey:<name>" for an API key.
+	Subject string
+	// Method is "apikey", "jwt", "session" or "none" when the authentication
+	// is disabled.
+	Method string
+	Roles  []string
+	// Tenant is the tenant of the caller, empty when it is not known.
+	Tenant string
+	// Teams are the teams of the caller, the address books can be shared
+	// with them.
+	Teams []string
+}
+
+// APIKey is a key used by scripts and other services to call the API. Only
+// the hash of the key is stored, the key itself is shown once when it is
+// created with the "apikey create" command.
+type APIKey struct {
+	ID       uint   `gorm:"primaryKey"`
+	TenantID string `gorm:"index" json:"-"`
+	Name     string `gorm:"uniqueIndex"`
+	// Prefix is the public part of the key, used to find it.
+	Prefix string `gorm:"uniqueIndex"`
+	Hash   string `json:"-"`
+	// Roles is a comma separated list of roles.
+	Roles      string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	// ExpiresAt ends the validity of the key, it is valid until it is
+	// revoked when it is not set.
+	ExpiresAt *time.Time
+}
+
+const (
+	principalKey = "principal"
+	apiKeyPrefix = "cm_"
+)
+
+// anonymous is the principal of every request when the authentication is
+// disabled, it can do everything.
+var anonymous = &Principal{Subject: "anonymous", Method: "none", Roles: []string{RoleAdmin}}
+
+// currentPrincipal returns the caller of the request.
+func currentPrincipal(c *gin.Context) *Principal {
+	if principal, ok := c.Get(principalKey); ok {
+		return principal.(*Principal)
+	}
+	return anonymous
+}
+
+func splitRoles(roles string) []string {
+	var result []string
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			result = append(result, role)
+		}
+	}
+	return result
+}
+
+// authenticate requires an API key, a bearer token or a session cookie on
+// every request. The API key is sent with the X-API-Key header or as a bearer
+// token, the JWT only as a bearer token. The session cookie is used only
+// when there is neither of them.
+func authenticate(verifier *jwtVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.AuthRequired {
+			c.Set(principalKey, anonymous)
+			c.Next()
+			return
+		}
+
+		token := c.GetHeader("X-API-Key")
+		if token == "" {
+			scheme, credentials, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(credentials)
+			}
+		}
+		cookie, _ := c.Cookie(sessionCookie)
+		if token == "" && cookie == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="contacts"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+			return
+		}
+
+		var principal *Principal
+		var err error
+		db := db.WithContext(c.Request.Context())
+		if token == "" {
+			principal, err = authenticateSession(db, c, cookie, time.Now())
+			if err == errCSRF {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+		} else if strings.HasPrefix(token, apiKeyPrefix) {
+			// the key gives the tenant of the request, it is looked up in
+			// all the tenants
+			err = forAllTenants(db, func(db *gorm.DB) error {
+				principal, err = authenticateAPIKey(db, token, time.Now())
+				return err
+			})
+		} else if verifier.enabled() {
+			principal, err = authenticateJWT(verifier, token, time.Now())
+		} else {
+			err = fmt.Errorf("bearer tokens are not configured")
+		}
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="contacts", error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+func authenticateJWT(verifier *jwtVerifier, token string, now time.Time) (*Principal, error) {
+	claims, err := verifier.verify(token, now)
+	if err != nil {
+		return nil, err
+	}
+	return principalFromClaims(claims, "jwt"), nil
+}
+
+// principalFromClaims reads the caller from the claims of a JWT or of an ID
+// token.
+func principalFromClaims(claims jwtClaims, method string) *Principal {
+	roles := claims.stringList("roles")
+	if len(roles) == 0 {
+		roles = claims.stringList("role")
+	}
+	teams := claims.stringList("teams")
+	if len(teams) == 0 {
+		teams = claims.stringList("groups")
+	}
+	// without the claim the tenant is the one of the subdomain, or the
+	// default one, see resolveTenant
+	tenant := claims.stringValue("tenant")
+	return &Principal{Subject: claims.stringValue("sub"), Method: method, Roles: roles, Teams: teams, Tenant: tenant}
+}
+
+func authenticateAPIKey(db *gorm.DB, token string, now time.Time) (*Principal, error) {
+	prefix, _, found := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !found {
+		return nil, errInvalidToken
+	}
+	var key APIKey
+	result := db.Where("prefix = ? AND revoked_at IS NULL", prefix).Limit(1).Find(&key)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the API keys")
+	}
+	if result.RowsAffected != 1 || subtle.ConstantTimeCompare([]byte(hashAPIKey(token)), []byte(key.Hash)) != 1 {
+		return nil, errInvalidToken
+	}
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return nil, fmt.Errorf("the API key is expired")
+	}
+	// the last use is saved at most once a minute, not at every request
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > time.Minute {
+		db.WithContext(withTenant(db.Statement.Context, key.TenantID)).
+			Model(APIKey{}).Where("id = ?", key.ID).Update("last_used_at", now)
+	}
+	return &Principal{Subject: "apikey:" + key.Name, Method: "apikey", Roles: splitRoles(key.Roles), Tenant: key.TenantID}, nil
+}
+
+func hashAPIKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// generateAPIKey returns a new random key and its prefix.
+func generateAPIKey() (token string, prefix string, err error) {
+	random := make([]byte, 36)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(random[:4])
+	secret := base64.RawURLEncoding.EncodeToString(random[4:])
+	return apiKeyPrefix + prefix + "_" + secret, prefix, nil
+}
+
+// COMMANDS
+////////////////////////////////////////////////////////////////////////////////
+
+// runAPIKeyCommand manages the API keys from the command line:
+//
+//	contact-manager apikey create -name hr-sync -roles editor -tenant sales
+//	contact-manager apikey list
+//	contact-manager apikey revoke -name hr-sync
+func runAPIKeyCommand(db *gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: apikey create|list|revoke")
+	}
+	flags := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	name := flags.String("name", "", "name of the key")
+	roles := flags.String("roles", "reader", "comma separated roles of the key")
+	tenant := flags.String("tenant", config.DefaultTenant, "tenant of the key")
+	expires := flags.Duration("expires", 0, "validity of the key, e.g. 2160h, by default until it is revoked")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	// the keys are created and revoked in the tenant of the flag
+	scoped := db.WithContext(withTenant(context.Background(), *tenant))
+	switch args[0] {
+	case "create":
+		if *name == "" {
+			return fmt.Errorf("the -name flag is required")
+		}
+		token, prefix, err := generateAPIKey()
+		if err != nil {
+			return err
+		}
+		if err := validateRoles(splitRoles(*roles)); err != nil {
+			return err
+		}
+		if !tenantPattern.MatchString(*tenant) {
+			return fmt.Errorf("invalid tenant '%s'", *tenant)
+		}
+		if *expires < 0 {
+			return fmt.Errorf("invalid validity '%s'", *expires)
+		}
+		key := APIKey{TenantID: *tenant, Name: *name, Prefix: prefix, Hash: hashAPIKey(token), Roles: *roles}
+		if *expires > 0 {
+			expiresAt := time.Now().Add(*expires)
+			key.ExpiresAt = &expiresAt
+		}
+		if result := scoped.Create(&key); result.Error != nil {
+			return fmt.Errorf("cannot save the API key '%s': %w", *name, result.Error)
+		}
+		fmt.Println("API key created, it will not be shown again:")
+		fmt.Println(token)
+	case "list":
+		var keys []APIKey
+		if result := db.Order("name").Find(&keys); result.Error != nil {
+			return fmt.Errorf("cannot list the API keys: %w", result.Error)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tTENANT\tPREFIX\tROLES\tCREATED\tLAST USED\tEXPIRES\tREVOKED")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", key.Name, key.TenantID, key.Prefix, key.Roles,
+				key.CreatedAt.Format(time.RFC3339), formatTime(key.LastUsedAt), formatTime(key.ExpiresAt), formatTime(key.RevokedAt))
+		}
+		w.Flush()
+	case "revoke":
+		result := scoped.Model(APIKey{}).
+			Where("name = ? AND revoked_at IS NULL", *name).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return fmt.Errorf("cannot revoke the API key '%s': %w", *name, result.Error)
+		}
+		if result.RowsAffected != 1 {
+			return fmt.Errorf("no active API key named '%s'", *name)
+		}
+		fmt.Printf("API key '%s' revoked\n", *name)
+	default:
+		return fmt.Errorf("unknown command 'apikey %s'", args[0])
+	}
+	return nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
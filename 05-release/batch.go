@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// BatchOperation is a single create, update or delete of a batch request.
+// ID is required by update and delete, Contact by create and update.
+type BatchOperation struct {
+	Op      string
+	ID      uint
+	Contact *Contact
+}
+
+// BatchRequest is a list of operations on contacts. In the "atomic" mode,
+// the default, either all the operations are applied or none of them. In the
+// "best_effort" mode every operation is applied on its own.
+type BatchRequest struct {
+	Mode       string
+	Operations []BatchOperation
+}
+
+// BatchResult is the result of one operation, in the same position of the
+// operation in the request. Status is an HTTP status code.
+type BatchResult struct {
+	Index   int
+	Op      string
+	Status  int
+	ID      uint     `json:",omitempty"`
+	Contact *Contact `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+}
+
+// BatchResponse collects the results of a batch request.
+type BatchResponse struct {
+	Mode      string
+	Succeeded int
+	Failed    int
+	Results   []BatchResult
+
+	// uncommitted is set when the transaction of an atomic batch could not
+	// be committed.
+	uncommitted bool
+}
+
+const (
+	BatchAtomic     = "atomic"
+	BatchBestEffort = "best_effort"
+
+	maxBatchOperations = 1000
+)
+
+// errBatchFailed rolls back the transaction of an atomic batch.
+var errBatchFailed = errors.New("the batch has been rolled back")
+
+// validateBatchOperation checks an operation before touching the database.
+func validateBatchOperation(operation *BatchOperation) []string {
+	var errs []string
+	switch operation.Op {
+	case "create":
+		if operation.ID != 0 {
+			errs = append(errs, "a create cannot have an ID")
+		}
+	case "update":
+		if operation.ID == 0 {
+			errs = append(errs, "the ID is required")
+		}
+	case "delete":
+		if operation.ID == 0 {
+			errs = append(errs, "the ID is required")
+		}
+		return errs
+	default:
+		return []string{fmt.Sprintf("unknown operation '%s'", operation.Op)}
+	}
+	if operation.Contact == nil {
+		return append(errs, "the contact is required")
+	}
+	operation.Contact.ID = 0
+	operation.Contact.CreatedAt, operation.Contact.UpdatedAt = time.Time{}, time.Time{}
+	return append(errs, validateContact(operation.Contact)...)
+}
+
+// checkBatchAccess checks that the principal can apply the operation. The
+// contact of a create gets its owner and address book.
+func checkBatchAccess(db *gorm.DB, principal *Principal, operation *BatchOperation) error {
+	switch operation.Op {
+	case "create":
+		return assignAddressBook(db, principal, operation.Contact)
+	case "update":
+		if err := checkContactAccess(db, principal, operation.ID, ShareWrite); err != nil {
+			return err
+		}
+		if operation.Contact.AddressBookID != 0 {
+			return checkBookAccess(db, principal, operation.Contact.AddressBookID, ShareWrite)
+		}
+	case "delete":
+		return checkContactAccess(db, principal, operation.ID, ShareWrite)
+	}
+	return nil
+}
+
+// contactsAction dispatches the custom methods of the contacts collection,
+// like POST /contacts:batch. The router sees the ":batch" suffix as the value
+// of the action parameter.
+func contactsAction(c *gin.Context) {
+	switch c.Param("action") {
+	case ":batch":
+		batchContacts(c)
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "page not found"})
+	}
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// BatchContacts godoc.
+// @Summary      Create, update and delete contacts in bulk.
+// @Description  Applies a list of operations. In atomic mode nothing is written if an
+// @Description  operation fails, in best_effort mode every operation is independent.
+// @Description  The creates are inserted in chunks, before the updates and the deletes.
+// @tags         Contact
+// @Accept       json
+// @Produce      json
+// @Param        Body  body      BatchRequest  true  "Mode and operations"
+// @Success      200   {object}  BatchResponse
+// @Failure      422   {object}  BatchResponse
+// @Router       /contacts:batch [post]
+func batchContacts(c *gin.Context) {
+	db := tenantDB(c)
+	var request BatchRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Mode == "" {
+		request.Mode = BatchAtomic
+	}
+	if request.Mode != BatchAtomic && request.Mode != BatchBestEffort {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown mode '%s'", request.Mode)})
+		return
+	}
+	if len(request.Operations) == 0 || len(request.Operations) > maxBatchOperations {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("a batch must have between 1 and %d operations", maxBatchOperations),
+		})
+		return
+	}
+
+	// a delete in a batch needs the same role of DELETE /contacts/:id
+	for _, operation := range request.Operations {
+		if operation.Op == "delete" && !allowed(c, http.MethodDelete, "/contacts/:id") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "permission denied: the batch deletes contacts"})
+			return
+		}
+	}
+
+	var response *BatchResponse
+	if request.Mode == BatchAtomic {
+		response = applyBatchAtomic(db, currentPrincipal(c), request.Operations)
+	} else {
+		response = applyBatchBestEffort(db, currentPrincipal(c), request.Operations)
+	}
+	for _, result := range response.Results {
+		if result.ID != 0 {
+			auditContacts(c, result.ID)
+		}
+	}
+	if response.uncommitted {
+		c.JSON(http.StatusInternalServerError, response)
+		return
+	}
+	if request.Mode == BatchAtomic && response.Failed > 0 {
+		c.JSON(http.StatusUnprocessableEntity, response)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+func newBatchResponse(mode string, operations []BatchOperation) *BatchResponse {
+	response := BatchResponse{Mode: mode, Results: make([]BatchResult, len(operations))}
+	for i, operation := range operations {
+		response.Results[i] = BatchResult{Index: i, Op: operation.Op, ID: operation.ID}
+	}
+	return &response
+}
+
+func (r *BatchResponse) fail(index int, status int, errs ...string) {
+	r.Results[index].Status = status
+	r.Results[index].Error = strings.Join(errs, ", ")
+	r.Failed++
+}
+
+func (r *BatchResponse) succeed(index int, status int, contact *Contact) {
+	r.Results[index].Status = status
+	r.Results[index].Contact = contact
+	if contact != nil {
+		r.Results[index].ID = contact.ID
+	}
+	r.Succeeded++
+}
+
+// applyBatchAtomic applies all the operations in one transaction. The first
+// failure rolls back everything, the other operations are reported with
+// status 424, failed dependency. When the commit fails every operation is
+// reported with status 500.
+func applyBatchAtomic(db *gorm.DB, principal *Principal, operations []BatchOperation) *BatchResponse {
+	response := newBatchResponse(BatchAtomic, operations)
+	for i := range operations {
+		if errs := validateBatchOperation(&operations[i]); len(errs) > 0 {
+			response.fail(i, http.StatusBadRequest, errs...)
+		} else if err := checkBatchAccess(db, principal, &operations[i]); err != nil {
+			response.fail(i, errorStatus(err, http.StatusInternalServerError), err.Error())
+		}
+	}
+	if response.Failed == 0 {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var creates []int
+			var contacts []Contact
+			for i, operation := range operations {
+				if operation.Op == "create" {
+					creates = append(creates, i)
+					contacts = append(contacts, *operation.Contact)
+				}
+			}
+			if len(contacts) > 0 {
+				if result := tx.CreateInBatches(&contacts, contactsBatchSize); result.Error != nil {
+					for _, i := range creates {
+						response.fail(i, http.StatusInternalServerError, "error saving contacts")
+					}
+					return errBatchFailed
+				}
+				for j, i := range creates {
+					response.succeed(i, http.StatusCreated, &contacts[j])
+				}
+			}
+
+			for i, operation := range operations {
+				if err := applyBatchChange(tx, response, i, operation); err != nil {
+					response.fail(i, batchChangeStatus(err), err.Error())
+					return errBatchFailed
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errBatchFailed) {
+			err = wrapDBError(err, "cannot commit the batch")
+			response.Succeeded, response.Failed, response.uncommitted = 0, 0, true
+			for i := range response.Results {
+				response.Results[i].ID = operations[i].ID
+				response.Results[i].Contact = nil
+				response.fail(i, http.StatusInternalServerError, err.Error())
+			}
+			return response
+		}
+	}
+
+	if response.Failed > 0 {
+		response.Succeeded = 0
+		for i := range response.Results {
+			result := &response.Results[i]
+			if result.Error == "" {
+				result.Status = http.StatusFailedDependency
+				result.ID = operations[i].ID
+				result.Contact = nil
+				result.Error = "not applied, another operation of the batch failed"
+				response.Failed++
+			}
+		}
+	}
+	return response
+}
+
+// applyBatchBestEffort applies every operation on its own. The creates are
+// inserted in chunks, a chunk that fails is retried one contact at time to
+// find the ones that cannot be saved.
+func applyBatchBestEffort(db *gorm.DB, principal *Principal, operations []BatchOperation) *BatchResponse {
+	response := newBatchResponse(BatchBestEffort, operations)
+	var creates []int
+	var contacts []Contact
+	for i := range operations {
+		if errs := validateBatchOperation(&operations[i]); len(errs) > 0 {
+			response.fail(i, http.StatusBadRequest, errs...)
+			continue
+		}
+		if err := checkBatchAccess(db, principal, &operations[i]); err != nil {
+			response.fail(i, errorStatus(err, http.StatusInternalServerError), err.Error())
+			continue
+		}
+		if operations[i].Op == "create" {
+			creates = append(creates, i)
+			contacts = append(contacts, *operations[i].Contact)
+		}
+	}
+
+	for start := 0; start < len(contacts); start += contactsBatchSize {
+		end := start + contactsBatchSize
+		if end > len(contacts) {
+			end = len(contacts)
+		}
+		chunk := contacts[start:end]
+		if result := db.Create(&chunk); result.Error == nil {
+			for j := range chunk {
+				response.succeed(creates[start+j], http.StatusCreated, &chunk[j])
+			}
+			continue
+		}
+		for j := range chunk {
+			if err := saveContact(db, &chunk[j]); err != nil {
+				response.fail(creates[start+j], http.StatusInternalServerError, err.Error())
+				continue
+			}
+			response.succeed(creates[start+j], http.StatusCreated, &chunk[j])
+		}
+	}
+
+	for i, operation := range operations {
+		if response.Results[i].Status != 0 {
+			continue
+		}
+		if err := applyBatchChange(db, response, i, operation); err != nil {
+			response.fail(i, batchChangeStatus(err), err.Error())
+		}
+	}
+	return response
+}
+
+// batchChangeStatus is the status of a failed update or delete: the failures
+// of the database are errors of the server, the access errors keep their
+// status and the other errors are missing contacts.
+func batchChangeStatus(err error) int {
+	var dbErr *dbError
+	if errors.As(err, &dbErr) {
+		return http.StatusInternalServerError
+	}
+	return errorStatus(err, http.StatusNotFound)
+}
+
+// applyBatchChange applies an update or a delete. Creates are ignored, they
+// are inserted in chunks by the callers.
+func applyBatchChange(db *gorm.DB, response *BatchResponse, index int, operation BatchOperation) error {
+	switch operation.Op {
+	case "update":
+		contact, err := updateContact(db, operation.ID, *operation.Contact)
+		if err != nil {
+			return err
+		}
+		response.succeed(index, http.StatusOK, contact)
+	case "delete":
+		if err := deleteContact(db, operation.ID); err != nil {
+			return err
+		}
+		response.succeed(index, http.StatusNoContent, nil)
+		response.Results[index].ID = operation.ID
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestBatch(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	key := createTestAPIKey(t, "alpha", "admin", RoleAdmin)
+	var contact Contact
+	decodeResponse(t, testRequest(t, r, key, "POST", "/contacts/", Contact{Name: "existing"}), http.StatusCreated, &contact)
+	count := func() int64 {
+		var count int64
+		db.Model(Contact{}).Count(&count)
+		return count
+	}
+
+	// an atomic batch with a missing contact applies nothing
+	var response BatchResponse
+	decodeResponse(t, testRequest(t, r, key, "POST", "/contacts:batch", BatchRequest{Operations: []BatchOperation{
+		{Op: "create", Contact: &Contact{Name: "created"}},
+		{Op: "update", ID: contact.ID, Contact: &Contact{Name: "updated"}},
+		{Op: "delete", ID: contact.ID + 100},
+	}}), http.StatusUnprocessableEntity, &response)
+	if response.Succeeded != 0 || response.Failed != 3 {
+		t.Errorf("unexpected response %+v", response)
+	}
+	for i, status := range []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound} {
+		if response.Results[i].Status != status {
+			t.Errorf("operation %d: expected %d, got %+v", i, status, response.Results[i])
+		}
+	}
+	if count() != 1 {
+		t.Errorf("the failed atomic batch has created contacts")
+	}
+
+	// the best effort batch applies the valid operations
+	response = BatchResponse{}
+	decodeResponse(t, testRequest(t, r, key, "POST", "/contacts:batch", BatchRequest{Mode: BatchBestEffort, Operations: []BatchOperation{
+		{Op: "create", Contact: &Contact{Name: "created"}},
+		{Op: "create", Contact: &Contact{Name: ""}},
+		{Op: "update", ID: contact.ID, Contact: &Contact{Name: "updated"}},
+		{Op: "delete", ID: contact.ID + 100},
+	}}), http.StatusOK, &response)
+	if response.Succeeded != 2 || response.Failed != 2 {
+		t.Errorf("unexpected response %+v", response)
+	}
+	for i, status := range []int{http.StatusCreated, http.StatusBadRequest, http.StatusOK, http.StatusNotFound} {
+		if response.Results[i].Status != status {
+			t.Errorf("operation %d: expected %d, got %+v", i, status, response.Results[i])
+		}
+	}
+	if count() != 2 {
+		t.Errorf("the best effort batch has not created the valid contact")
+	}
+}
+
+// TestBatchCommitFailure checks that an atomic batch whose commit fails does
+// not report the operations as applied.
+func TestBatchCommitFailure(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	key := createTestAPIKey(t, "alpha", "admin", RoleAdmin)
+
+	// the transaction is rolled back after the insert of the contacts, the
+	// commit fails
+	failCommit := false
+	err := db.Callback().Create().After("gorm:create").Register("test:rollback", func(tx *gorm.DB) {
+		if sqlTx, ok := tx.Statement.ConnPool.(*sql.Tx); ok && failCommit && tx.Statement.Table == "contacts" {
+			sqlTx.Rollback()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failCommit = true
+	var response BatchResponse
+	decodeResponse(t, testRequest(t, r, key, "POST", "/contacts:batch", BatchRequest{Operations: []BatchOperation{
+		{Op: "create", Contact: &Contact{Name: "first"}},
+		{Op: "create", Contact: &Contact{Name: "second"}},
+	}}), http.StatusInternalServerError, &response)
+	if response.Succeeded != 0 || response.Failed != 2 {
+		t.Errorf("unexpected response %+v", response)
+	}
+	for i, result := range response.Results {
+		if result.Status != http.StatusInternalServerError || result.ID != 0 || result.Contact != nil {
+			t.Errorf("operation %d is reported as applied: %+v", i, result)
+		}
+	}
+	var count int64
+	db.Model(Contact{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d contacts saved by the rolled back batch", count)
+	}
+}
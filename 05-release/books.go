@@ -0,0 +1,493 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AddressBook groups the contacts. Every user has a personal book, created
+// the first time it is needed and marked by Personal, and can create other
+// books to share with users and teams. The contacts are visible to the owner
+// of their book, to the users and teams the book is shared with, to the user
+// that created them and to the admins.
+type AddressBook struct {
+	ID       uint   `gorm:"primaryKey"`
+	TenantID string `gorm:"uniqueIndex:idx_address_book_owner" json:"-"`
+	Name     string `gorm:"uniqueIndex:idx_address_book_owner"`
+	Owner    string `gorm:"uniqueIndex:idx_address_book_owner"`
+	// Personal is set by the server, a book named like the personal one is
+	// not personal.
+	Personal  bool `gorm:"uniqueIndex:idx_address_book_owner"`
+	CreatedAt time.Time
+}
+
+// Share gives a user or a team access to an address book.
+type Share struct {
+	ID            uint   `gorm:"primaryKey"`
+	TenantID      string `gorm:"index" json:"-"`
+	AddressBookID uint   `gorm:"uniqueIndex:idx_share"`
+	// Grantee is "user:<subject>" or "team:<name>".
+	Grantee string `gorm:"uniqueIndex:idx_share"`
+	// Level is "read" or "write".
+	Level     string
+	CreatedAt time.Time
+}
+
+const (
+	ShareRead  = "read"
+	ShareWrite = "write"
+)
+
+const personalBookName = "Personal"
+
+// accessError is a request for a contact or a book that the caller cannot
+// see, or can see but not change.
+type accessError struct {
+	status  int
+	message string
+}
+
+func (e *accessError) Error() string {
+	return e.message
+}
+
+// errorStatus is the status of an accessError or the given one for the other
+// errors.
+func errorStatus(err error, status int) int {
+	if access, ok := err.(*accessError); ok {
+		return access.status
+	}
+	return status
+}
+
+// respondError writes the error with its status, see errorStatus.
+func respondError(c *gin.Context, status int, err error) {
+	c.JSON(errorStatus(err, status), gin.H{"error": err.Error()})
+}
+
+// grantees are the names that a share can use for the principal.
+func (p *Principal) grantees() []string {
+	grantees := []string{"user:" + p.Subject}
+	for _, team := range p.Teams {
+		grantees = append(grantees, "team:"+team)
+	}
+	return grantees
+}
+
+func shareLevels(level string) []string {
+	if level == ShareRead {
+		return []string{ShareRead, ShareWrite}
+	}
+	return []string{ShareWrite}
+}
+
+// visibleBooks is the query of the ids of the books that the principal can
+// access with the level. The shares are correlated with the tenant of the
+// book, the query never reads the shares of another tenant even when the
+// database is not scoped.
+func visibleBooks(db *gorm.DB, principal *Principal, level string) *gorm.DB {
+	shared := db.Model(Share{}).
+		Select("address_book_id").
+		Where("shares.tenant_id = address_books.tenant_id").
+		Where("grantee IN ? AND level IN ?", principal.grantees(), shareLevels(level))
+	return db.Model(AddressBook{}).
+		Select("id").
+		Where("owner = ? OR id IN (?)", principal.Subject, shared)
+}
+
+// visibleContacts restricts a query on the contacts to the ones that the
+// principal can access with the level.
+func visibleContacts(principal *Principal, level string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if principal.hasRole(RoleAdmin) {
+			return tx
+		}
+		books := visibleBooks(tx.Session(&gorm.Session{NewDB: true}), principal, level).
+			Where("address_books.tenant_id = contacts.tenant_id")
+		return tx.Where("contacts.owner = ? OR contacts.address_book_id IN (?)", principal.Subject, books)
+	}
+}
+
+// checkContactAccess fails when the principal cannot access the contact with
+// the level. A contact that the principal cannot see is reported as missing.
+func checkContactAccess(db *gorm.DB, principal *Principal, contactId uint, level string) error {
+	for _, check := range []string{ShareRead, level} {
+		var count int64
+		result := db.Model(Contact{}).
+			Scopes(visibleContacts(principal, check)).
+			Where("id = ?", contactId).
+			Count(&count)
+		if result.Error != nil {
+			return wrapDBError(result.Error, "cannot read contact with id '%d'", contactId)
+		}
+		if count == 1 {
+			continue
+		}
+		if check == ShareRead {
+			return &accessError{http.StatusNotFound, fmt.Sprintf("no contact found with id '%d'", contactId)}
+		}
+		return &accessError{http.StatusForbidden, fmt.Sprintf("contact with id '%d' is read only", contactId)}
+	}
+	return nil
+}
+
+// checkBookAccess fails when the principal cannot access the book with the
+// level, like checkContactAccess.
+func checkBookAccess(db *gorm.DB, principal *Principal, bookId uint, level string) error {
+	for _, check := range []string{ShareRead, level} {
+		query := db.Model(AddressBook{}).Where("id = ?", bookId)
+		if !principal.hasRole(RoleAdmin) {
+			query = query.Where("id IN (?)", visibleBooks(db, principal, check))
+		}
+		var count int64
+		if result := query.Count(&count); result.Error != nil {
+			return wrapDBError(result.Error, "cannot read address book with id '%d'", bookId)
+		}
+		if count == 1 {
+			continue
+		}
+		if check == ShareRead {
+			return &accessError{http.StatusNotFound, fmt.Sprintf("no address book found with id '%d'", bookId)}
+		}
+		return &accessError{http.StatusForbidden, fmt.Sprintf("address book with id '%d' is read only", bookId)}
+	}
+	return nil
+}
+
+// assignAddressBook prepares a new contact: the principal becomes its owner
+// and the contact goes in the personal book of the principal, unless it
+// names a book the principal can write to.
+func assignAddressBook(db *gorm.DB, principal *Principal, contact *Contact) error {
+	contact.Owner = principal.Subject
+	if contact.AddressBookID != 0 {
+		return checkBookAccess(db, principal, contact.AddressBookID, ShareWrite)
+	}
+	book, err := personalBook(db, principal.Subject)
+	if err != nil {
+		return err
+	}
+	contact.AddressBookID = book.ID
+	return nil
+}
+
+// checkBookManager fails when the principal is not the owner of the book or
+// an admin, only them can share the book.
+func checkBookManager(db *gorm.DB, principal *Principal, bookId uint) (*AddressBook, error) {
+	if err := checkBookAccess(db, principal, bookId, ShareRead); err != nil {
+		return nil, err
+	}
+	var book AddressBook
+	if result := db.First(&book, AddressBook{ID: bookId}); result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read address book with id '%d'", bookId)
+	}
+	if book.Owner != principal.Subject && !principal.hasRole(RoleAdmin) {
+		return nil, &accessError{http.StatusForbidden, fmt.Sprintf("only the owner can manage address book with id '%d'", bookId)}
+	}
+	return &book, nil
+}
+
+func validateShare(share *Share) error {
+	kind, name, _ := strings.Cut(share.Grantee, ":")
+	if (kind != "user" && kind != "team") || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("invalid grantee '%s', use user:<name> or team:<name>", share.Grantee)
+	}
+	if share.Level != ShareRead && share.Level != ShareWrite {
+		return fmt.Errorf("invalid level '%s', use %s or %s", share.Level, ShareRead, ShareWrite)
+	}
+	return nil
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// ListAddressBooks godoc.
+// @Summary      Get the address books.
+// @Description  Returns the address books that the caller owns or that are shared with it.
+// @tags         AddressBook
+// @Produce      json
+// @Success      200  {object}  []AddressBook
+// @Router       /books [get]
+func listAddressBooks(c *gin.Context) {
+	db := tenantDB(c)
+	principal := currentPrincipal(c)
+	if _, err := personalBook(db, principal.Subject); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	books, err := readAddressBooks(db, principal)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, books)
+}
+
+// CreateAddressBook godoc.
+// @Summary      Create an address book.
+// @Description  Creates an address book owned by the caller, it can be shared with users and teams.
+// @tags         AddressBook
+// @Accept       json
+// @Produce      json
+// @Param        Body  body      AddressBook  true  "The name of the book"
+// @Success      201   {object}  AddressBook
+// @Router       /books [post]
+func createAddressBook(c *gin.Context) {
+	db := tenantDB(c)
+	var book AddressBook
+	if err := c.ShouldBindJSON(&book); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(book.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the name is required"})
+		return
+	}
+	book = AddressBook{Name: book.Name, Owner: currentPrincipal(c).Subject}
+	if err := saveAddressBook(db, &book); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, book)
+}
+
+// DeleteAddressBook godoc.
+// @Summary      Delete an address book.
+// @Description  Deletes an empty address book and its shares. Only the owner can delete it.
+// @tags         AddressBook
+// @Param 		 id  path int true "Address book ID"
+// @Success      204
+// @Router       /books/{id} [delete]
+func deleteAddressBookById(c *gin.Context) {
+	db := tenantDB(c)
+	bookId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	book, err := checkBookManager(db, currentPrincipal(c), uint(bookId))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if book.Personal {
+		c.JSON(http.StatusConflict, gin.H{"error": "a personal address book cannot be deleted"})
+		return
+	}
+	if err := deleteAddressBook(db, book.ID); err != nil {
+		status := http.StatusConflict
+		var dbErr *dbError
+		if errors.As(err, &dbErr) {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusNoContent, "")
+}
+
+// ListShares godoc.
+// @Summary      Get the shares of an address book.
+// @tags         AddressBook
+// @Produce      json
+// @Param 		 id  path int true "Address book ID"
+// @Success      200  {object}  []Share
+// @Router       /books/{id}/shares [get]
+func listShares(c *gin.Context) {
+	db := tenantDB(c)
+	bookId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := checkBookManager(db, currentPrincipal(c), uint(bookId)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	shares, err := readShares(db, uint(bookId))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, shares)
+}
+
+// ShareAddressBook godoc.
+// @Summary      Share an address book.
+// @Description  Gives a user or a team read or write access to the book, or changes the
+// @Description  level of an existing share.
+// @tags         AddressBook
+// @Accept       json
+// @Produce      json
+// @Param 		 id    path  int    true  "Address book ID"
+// @Param        Body  body  Share  true  "Grantee, user:<name> or team:<name>, and Level, read or write"
+// @Success      200   {object}  Share
+// @Router       /books/{id}/shares [put]
+func shareAddressBook(c *gin.Context) {
+	db := tenantDB(c)
+	var share Share
+	if err := c.ShouldBindJSON(&share); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bookId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateShare(&share); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := checkBookManager(db, currentPrincipal(c), uint(bookId)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	share = Share{AddressBookID: uint(bookId), Grantee: share.Grantee, Level: share.Level}
+	if err := saveShare(db, &share); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, share)
+}
+
+// UnshareAddressBook godoc.
+// @Summary      Remove a share of an address book.
+// @tags         AddressBook
+// @Param 		 id        path  int  true  "Address book ID"
+// @Param 		 shareId   path  int  true  "Share ID"
+// @Success      204
+// @Router       /books/{id}/shares/{shareId} [delete]
+func unshareAddressBook(c *gin.Context) {
+	db := tenantDB(c)
+	bookId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shareId, err := strconv.ParseUint(c.Param("shareId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := checkBookManager(db, currentPrincipal(c), uint(bookId)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := deleteShare(db, uint(bookId), uint(shareId)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusNoContent, "")
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// personalBook returns the personal book of the user, it is created the
+// first time.
+func personalBook(db *gorm.DB, owner string) (*AddressBook, error) {
+	book := AddressBook{Name: personalBookName, Owner: owner, Personal: true}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&book)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot create the personal address book of '%s'", owner)
+	}
+	if result.RowsAffected == 1 {
+		return &book, nil
+	}
+	result = db.Where("owner = ? AND personal = ?", owner, true).First(&book)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the personal address book of '%s'", owner)
+	}
+	return &book, nil
+}
+
+func saveAddressBook(db *gorm.DB, book *AddressBook) error {
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(book)
+	if result.Error != nil {
+		return wrapDBError(result.Error, "error saving address book")
+	}
+	if result.RowsAffected != 1 {
+		return &accessError{http.StatusConflict, fmt.Sprintf("an address book named '%s' already exists", book.Name)}
+	}
+	return nil
+}
+
+func readAddressBooks(db *gorm.DB, principal *Principal) ([]AddressBook, error) {
+	books := []AddressBook{}
+	query := db.Order("owner, name")
+	if !principal.hasRole(RoleAdmin) {
+		query = query.Where("id IN (?)", visibleBooks(db, principal, ShareRead))
+	}
+	if result := query.Find(&books); result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot list address books")
+	}
+	return books, nil
+}
+
+// deleteAddressBook deletes the book and its shares, the book must be empty.
+func deleteAddressBook(db *gorm.DB, bookId uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if result := tx.Model(Contact{}).Where("address_book_id = ?", bookId).Count(&count); result.Error != nil {
+			return wrapDBError(result.Error, "cannot read the contacts of address book with id '%d'", bookId)
+		}
+		if count > 0 {
+			return fmt.Errorf("address book with id '%d' is not empty", bookId)
+		}
+		if result := tx.Where("address_book_id = ?", bookId).Delete(Share{}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete the shares of address book with id '%d'", bookId)
+		}
+		result := tx.Delete(AddressBook{}, AddressBook{ID: bookId})
+		if result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete address book with id '%d'", bookId)
+		}
+		if result.RowsAffected != 1 {
+			return fmt.Errorf("cannot delete address book with id '%d'", bookId)
+		}
+		return nil
+	})
+}
+
+func readShares(db *gorm.DB, bookId uint) ([]Share, error) {
+	shares := []Share{}
+	result := db.Where("address_book_id = ?", bookId).Order("grantee").Find(&shares)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the shares of address book with id '%d'", bookId)
+	}
+	return shares, nil
+}
+
+// saveShare creates the share or updates the level of the existing one.
+func saveShare(db *gorm.DB, share *Share) error {
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "address_book_id"}, {Name: "grantee"}},
+		DoUpdates: clause.AssignmentColumns([]string{"level"}),
+	}).Create(share)
+	if result.Error != nil {
+		return wrapDBError(result.Error, "error saving share")
+	}
+	result = db.Where("address_book_id = ? AND grantee = ?", share.AddressBookID, share.Grantee).First(share)
+	if result.Error != nil {
+		return wrapDBError(result.Error, "error saving share")
+	}
+	return nil
+}
+
+func deleteShare(db *gorm.DB, bookId uint, shareId uint) error {
+	result := db.Where("address_book_id = ?", bookId).Delete(Share{}, Share{ID: shareId})
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot delete share with id '%d'", shareId)
+	}
+	if result.RowsAffected != 1 {
+		return fmt.Errorf("cannot delete share with id '%d'", shareId)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateAddressBook(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	key := createTestAPIKey(t, "alpha", "owner", RoleEditor)
+	other := createTestAPIKey(t, "alpha", "other", RoleEditor)
+
+	for _, test := range []struct {
+		key    string
+		book   AddressBook
+		status int
+	}{
+		{key, AddressBook{Name: "customers"}, http.StatusCreated},
+		{key, AddressBook{Name: " "}, http.StatusBadRequest},
+		{key, AddressBook{Name: "customers"}, http.StatusConflict},
+		{other, AddressBook{Name: "customers"}, http.StatusCreated},
+	} {
+		if response := testRequest(t, r, test.key, "POST", "/books/", test.book); response.Code != test.status {
+			t.Errorf("%q: expected %d, got %d %s", test.book.Name, test.status, response.Code, response.Body.String())
+		}
+	}
+
+	// the errors of the database are not a conflict
+	if err := db.Migrator().DropTable(&AddressBook{}); err != nil {
+		t.Fatal(err)
+	}
+	if response := testRequest(t, r, key, "POST", "/books/", AddressBook{Name: "suppliers"}); response.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config collects all the settings of the application. Every value can be
+// overridden with an environment variable so the same executable can be
+// deployed on different servers without recompiling it.
+type Config struct {
+	// Logs: the level ("debug", "info", "warn" or "error"), the format
+	// ("json" or "text") and the duration of the queries logged as slow.
+	LogLevel           string
+	LogFormat          string
+	SlowQueryThreshold time.Duration
+	// Tracing with OpenTelemetry. TracesExporter is "otlp", "stdout" or
+	// "none", the OTLP exporter sends the spans with the OTLPProtocol,
+	// "grpc" or "http/protobuf". TraceSampleRatio is the fraction of the
+	// new traces that are recorded.
+	TracesExporter   string
+	OTLPProtocol     string
+	ServiceName      string
+	TraceSampleRatio float64
+	// Timeout of the checks of /readyz.
+	HealthTimeout time.Duration
+	// Bearer token that Prometheus sends to read /metrics, when it is set.
+	MetricsToken string
+
+	// HTTP server: the address, the timeouts of the connections and the
+	// time given to the requests in flight, and then to the workers, to
+	// finish when the application stops.
+	ServerAddr string
+	// PublicURL is the URL the callers use, e.g.
+	// "https://contacts.example.com", in the documentation of the API.
+	PublicURL         string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+
+	// Scheduler
+	TaskPollInterval time.Duration
+	// How often the import worker looks for queued imports.
+	ImportPollInterval time.Duration
+	// How long the responses of the requests with an Idempotency-Key are
+	// kept.
+	IdempotencyTTL time.Duration
+
+	// Authentication. When AuthRequired is false every request is accepted
+	// as an anonymous administrator, use it only for development.
+	AuthRequired bool
+	// The bearer tokens are signed with JWTSecret (HS256) or with one of
+	// the keys in JWTJWKSFile (RS256, ES256).
+	JWTSecret   string
+	JWTJWKSFile string
+	JWTIssuer   string
+	JWTAudience string
+	JWTLeeway   time.Duration
+	// Login of the browsers with OpenID Connect, enabled by OIDCIssuer.
+	// OIDCMock runs a fake identity provider inside the application, for
+	// the development and the tests only.
+	OIDCIssuer          string
+	OIDCClientID        string
+	OIDCClientSecret    string
+	OIDCRedirectURL     string
+	OIDCScopes          string
+	OIDCMock            bool
+	OIDCMockRoles       []string
+	SessionTTL          time.Duration
+	SessionCookieSecure bool
+	// JSON file with the roles required by the routes, see Policy.
+	RBACPolicyFile string
+
+	// Tenants. DefaultTenant is the tenant of the callers that do not
+	// belong to one, TenantDomain the domain whose subdomains name the
+	// tenants and TenantRLS enables the Postgres row level security.
+	DefaultTenant string
+	TenantDomain  string
+	TenantRLS     bool
+
+	// Rate limits of every client, like "600/1m", for the reads, the
+	// writes and the exports. An empty limit disables the budget. The
+	// buckets are kept in "memory" or in "redis".
+	RateLimitRead   string
+	RateLimitWrite  string
+	RateLimitExport string
+	// RateLimitIP is the budget of every IP address, counted before the
+	// authentication.
+	RateLimitIP    string
+	RateLimitStore string
+	RedisAddr      string
+	RedisPassword  string
+	RedisDB        int
+
+	// Encryption of the contact fields, enabled by the keyring file. The
+	// rotation job encrypts again the values with the primary key.
+	EncryptionKeyringFile      string
+	EncryptedFields            []string
+	EncryptionRotationInterval time.Duration
+
+	// Retention rules of the contacts, see RetentionRule. In a dry run the
+	// job only logs the contacts that the rules would delete or anonymize.
+	RetentionRulesFile string
+	RetentionDryRun    bool
+	RetentionInterval  time.Duration
+
+	// The origins allowed to call the API from a browser, "*" allows any
+	// origin. By default only the same origin is allowed.
+	CORSAllowedOrigins []string
+
+	// Notifier used to deliver the task reminders: "log", "smtp" or "webhook".
+	Notifier     string
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+	SMTPFrom     string
+	SMTPTo       string
+	WebhookURL   string
+}
+
+func loadConfig() Config {
+	return Config{
+		LogLevel:           getEnv("LOG_LEVEL", "info"),
+		LogFormat:          getEnv("LOG_FORMAT", "json"),
+		SlowQueryThreshold: getEnvDuration("LOG_SLOW_QUERY", 200*time.Millisecond),
+		MetricsToken:       getEnv("METRICS_TOKEN", ""),
+		HealthTimeout:      getEnvDuration("HEALTH_TIMEOUT", 2*time.Second),
+
+		TracesExporter:   getEnv("OTEL_TRACES_EXPORTER", "none"),
+		OTLPProtocol:     getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc"),
+		ServiceName:      getEnv("OTEL_SERVICE_NAME", "contact-manager"),
+		TraceSampleRatio: getEnvFloat("OTEL_TRACES_SAMPLER_ARG", 1),
+
+		ServerAddr:        ":" + getEnv("PORT", "8080"),
+		PublicURL:         getEnv("PUBLIC_URL", ""),
+		ReadHeaderTimeout: getEnvDuration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       getEnvDuration("SERVER_READ_TIMEOUT", time.Minute),
+		WriteTimeout:      getEnvDuration("SERVER_WRITE_TIMEOUT", 5*time.Minute),
+		IdleTimeout:       getEnvDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		ShutdownTimeout:   getEnvDuration("SHUTDOWN_TIMEOUT", 25*time.Second),
+
+		TaskPollInterval:   getEnvDuration("TASK_POLL_INTERVAL", time.Minute),
+		ImportPollInterval: getEnvDuration("IMPORT_POLL_INTERVAL", 10*time.Second),
+		IdempotencyTTL:     getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+
+		AuthRequired: getEnvBool("AUTH_REQUIRED", true),
+		JWTSecret:    getEnv("JWT_SECRET", ""),
+		JWTJWKSFile:  getEnv("JWT_JWKS_FILE", ""),
+		JWTIssuer:    getEnv("JWT_ISSUER", ""),
+		JWTAudience:  getEnv("JWT_AUDIENCE", ""),
+		JWTLeeway:    getEnvDuration("JWT_LEEWAY", time.Minute),
+
+		OIDCIssuer:          getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:        getEnv("OIDC_CLIENT_ID", "contact-manager"),
+		OIDCClientSecret:    getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:     getEnv("OIDC_REDIRECT_URL", "http://localhost:8080/auth/callback"),
+		OIDCScopes:          getEnv("OIDC_SCOPES", "openid profile email"),
+		OIDCMock:            getEnvBool("OIDC_MOCK", false),
+		OIDCMockRoles:       getEnvList("OIDC_MOCK_ROLES"),
+		SessionTTL:          getEnvDuration("SESSION_TTL", 8*time.Hour),
+		SessionCookieSecure: getEnvBool("SESSION_COOKIE_SECURE", true),
+
+		RBACPolicyFile: getEnv("RBAC_POLICY_FILE", ""),
+
+		DefaultTenant: getEnv("DEFAULT_TENANT", "default"),
+		TenantDomain:  getEnv("TENANT_DOMAIN", ""),
+		TenantRLS:     getEnvBool("TENANT_RLS", false),
+
+		RateLimitRead:   getEnv("RATE_LIMIT_READ", "600/1m"),
+		RateLimitWrite:  getEnv("RATE_LIMIT_WRITE", "120/1m"),
+		RateLimitExport: getEnv("RATE_LIMIT_EXPORT", "10/1h"),
+		RateLimitIP:     getEnv("RATE_LIMIT_IP", "1200/1m"),
+		RateLimitStore:  getEnv("RATE_LIMIT_STORE", "memory"),
+		RedisAddr:       getEnv("REDIS_ADDR", ""),
+		RedisPassword:   getEnv("REDIS_PASSWORD", ""),
+		RedisDB:         getEnvInt("REDIS_DB", 0),
+
+		EncryptionKeyringFile:      getEnv("ENCRYPTION_KEYRING_FILE", ""),
+		EncryptedFields:            getEnvListDefault("ENCRYPTED_FIELDS", []string{"Phone", "Email", "Address", "Notes"}),
+		EncryptionRotationInterval: getEnvDuration("ENCRYPTION_ROTATION_INTERVAL", time.Hour),
+
+		RetentionRulesFile: getEnv("RETENTION_RULES_FILE", ""),
+		RetentionDryRun:    getEnvBool("RETENTION_DRY_RUN", true),
+		RetentionInterval:  getEnvDuration("RETENTION_INTERVAL", 24*time.Hour),
+
+		CORSAllowedOrigins: getEnvList("CORS_ALLOWED_ORIGINS"),
+
+		Notifier:     getEnv("NOTIFIER", "log"),
+		SMTPAddr:     getEnv("SMTP_ADDR", "localhost:25"),
+		SMTPUser:     getEnv("SMTP_USER", ""),
+		SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+		SMTPFrom:     getEnv("SMTP_FROM", "contact-manager@localhost"),
+		SMTPTo:       getEnv("SMTP_TO", ""),
+		WebhookURL:   getEnv("WEBHOOK_URL", ""),
+	}
+}
+
+var config = loadConfig()
+
+// getEnv returns the value of the environment variable or the default value
+// when the variable is not set.
+func getEnv(key string, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+func getEnvBool(key string, def bool) bool {
+	value, err := strconv.ParseBool(getEnv(key, ""))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+func getEnvInt(key string, def int) int {
+	value, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// getEnvList reads a comma separated list.
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvListDefault reads a comma separated list, with a default when the
+// variable is not set.
+func getEnvListDefault(key string, def []string) []string {
+	if _, ok := os.LookupEnv(key); !ok {
+		return def
+	}
+	return getEnvList(key)
+}
+
+func getEnvFloat(key string, def float64) float64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil {
+		return def
+	}
+	return value
+}
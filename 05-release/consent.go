@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Consent records that a contact has granted or withdrawn the consent to be
+// contacted for a purpose, e.g. "newsletter", on a channel. The records are
+// never changed: a new record replaces the previous one for the same purpose
+// and channel, and the old ones prove what the contact had agreed to.
+type Consent struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"index" json:"-"`
+	ContactID uint   `gorm:"index:idx_consent"`
+	Purpose   string `gorm:"index:idx_consent"`
+	// Channel is "email", "phone", "sms", "post" or "any".
+	Channel string `gorm:"index:idx_consent"`
+	// Status is "granted" or "withdrawn".
+	Status string
+	// LegalBasis is the basis of the processing, see legalBases.
+	LegalBasis string
+	// Source tells where the consent was collected, e.g. "signup form".
+	Source string
+	// GivenAt is when the contact granted or withdrew the consent, by
+	// default when it is recorded.
+	GivenAt time.Time `gorm:"index"`
+	// ExpiresAt ends a consent granted for a limited time.
+	ExpiresAt  *time.Time
+	RecordedBy string
+	CreatedAt  time.Time
+}
+
+const (
+	ConsentGranted   = "granted"
+	ConsentWithdrawn = "withdrawn"
+	ChannelAny       = "any"
+)
+
+var consentChannels = []string{"email", "phone", "sms", "post", ChannelAny}
+
+// legalBases are the lawful bases of the processing of the GDPR.
+var legalBases = []string{
+	"consent", "contract", "legal_obligation", "vital_interests", "public_task", "legitimate_interests",
+}
+
+const maxPurposeLength = 100
+
+// validateConsent checks the values of a consent, it returns the list of the
+// problems found.
+func validateConsent(consent *Consent) (errs []string) {
+	consent.Purpose = strings.TrimSpace(consent.Purpose)
+	if consent.Purpose == "" {
+		errs = append(errs, "the purpose is required")
+	} else if len(consent.Purpose) > maxPurposeLength {
+		errs = append(errs, fmt.Sprintf("the purpose is longer than %d characters", maxPurposeLength))
+	}
+	if consent.Channel == "" {
+		consent.Channel = ChannelAny
+	}
+	if !contains(consentChannels, consent.Channel) {
+		errs = append(errs, fmt.Sprintf("the channel must be one of %s", strings.Join(consentChannels, ", ")))
+	}
+	if consent.Status != ConsentGranted && consent.Status != ConsentWithdrawn {
+		errs = append(errs, fmt.Sprintf("the status must be %s or %s", ConsentGranted, ConsentWithdrawn))
+	}
+	if consent.LegalBasis == "" {
+		consent.LegalBasis = "consent"
+	}
+	if !contains(legalBases, consent.LegalBasis) {
+		errs = append(errs, fmt.Sprintf("the legal basis must be one of %s", strings.Join(legalBases, ", ")))
+	}
+	if consent.ExpiresAt != nil && !consent.ExpiresAt.After(consent.GivenAt) {
+		errs = append(errs, "the consent must expire after it is given")
+	}
+	return errs
+}
+
+// withConsent restricts a query of the contacts to the ones that have a valid
+// consent for the purpose on the channel: a grant on the channel or on any
+// channel, not expired, that is not followed by another record on the same
+// channel or by a withdrawal on any channel.
+func withConsent(purpose string, channel string, now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		channels := []string{ChannelAny}
+		if channel != "" && channel != ChannelAny {
+			channels = append(channels, channel)
+		}
+		valid := db.Session(&gorm.Session{NewDB: true}).Table("consents AS c").Select("c.contact_id").
+			Where("c.purpose = ? AND c.channel IN ? AND c.status = ?", purpose, channels, ConsentGranted).
+			Where("c.expires_at IS NULL OR c.expires_at > ?", now).
+			Where(`NOT EXISTS (SELECT 1 FROM consents AS n WHERE n.tenant_id = c.tenant_id AND n.contact_id = c.contact_id
+				AND n.purpose = c.purpose AND n.channel IN ? AND (n.channel = c.channel OR n.status = ?)
+				AND (n.given_at > c.given_at OR (n.given_at = c.given_at AND n.id > c.id)))`, channels, ConsentWithdrawn)
+		if tenant, ok := tenantFromContext(db.Statement.Context); ok {
+			valid = valid.Where("c.tenant_id = ?", tenant)
+		}
+		return db.Where("contacts.id IN (?)", valid)
+	}
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// RecordConsent godoc.
+// @Summary      Record a consent.
+// @Description  Records that the contact has granted or withdrawn the consent for a purpose
+// @Description  on a channel, replacing the previous record for the same purpose and channel.
+// @tags         Consent
+// @Accept       json
+// @Produce      json
+// @Param 		 id    path  int      true  "Contact ID"
+// @Param        Body  body  Consent  true  "The purpose, channel, status, legal basis and source"
+// @Success      201  {object}  Consent
+// @Router       /contacts/{id}/consents [post]
+func recordConsent(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareWrite); err != nil {
+		respondError(c, errorStatus(err, http.StatusInternalServerError), err)
+		return
+	}
+	var consent Consent
+	if err := c.ShouldBindJSON(&consent); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	if consent.GivenAt.IsZero() {
+		consent.GivenAt = now
+	}
+	if consent.GivenAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the consent cannot be given in the future"})
+		return
+	}
+	if errs := validateConsent(&consent); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": strings.Join(errs, ", ")})
+		return
+	}
+	consent.ID = 0
+	consent.ContactID = uint(contactId)
+	consent.RecordedBy = currentPrincipal(c).Subject
+	if err := saveConsent(db, &consent); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, consent)
+}
+
+// ListContactConsents godoc.
+// @Summary      Get the consents of a contact.
+// @Description  Returns the current consent of the contact for every purpose and channel, or
+// @Description  with history=true all the records, the newest first.
+// @tags         Consent
+// @Produce      json
+// @Param 		 id       path   int     true   "Contact ID"
+// @Param        purpose  query  string  false  "Only the consents for this purpose"
+// @Param        history  query  bool    false  "All the records instead of the current ones"
+// @Success      200  {object}  []Consent
+// @Router       /contacts/{id}/consents [get]
+func listContactConsents(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareRead); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	filter := ConsentFilter{
+		ContactID: uint(contactId),
+		Purpose:   c.Query("purpose"),
+		History:   c.Query("history") == "true",
+	}
+	consents, err := readConsents(db, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, consents)
+}
+
+// ListConsents godoc.
+// @Summary      Get the consents.
+// @Description  Returns the current consents of the contacts that the caller can see, e.g.
+// @Description  all the contacts that have granted the consent for a purpose.
+// @tags         Consent
+// @Produce      json
+// @Param        purpose  query  string  false  "Only the consents for this purpose"
+// @Param        channel  query  string  false  "Only the consents on this channel"
+// @Param        status   query  string  false  "granted or withdrawn"
+// @Success      200  {object}  []Consent
+// @Router       /consents [get]
+func listConsents(c *gin.Context) {
+	db := tenantDB(c)
+	filter := ConsentFilter{
+		Purpose: c.Query("purpose"),
+		Channel: c.Query("channel"),
+		Status:  c.Query("status"),
+		Viewer:  currentPrincipal(c),
+	}
+	consents, err := readConsents(db, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, consents)
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// ConsentFilter selects the consents.
+type ConsentFilter struct {
+	ContactID uint
+	Purpose   string
+	Channel   string
+	Status    string
+	// History returns all the records, not only the current ones.
+	History bool
+	// Viewer restricts the consents to the contacts that it can see.
+	Viewer *Principal
+}
+
+func saveConsent(db *gorm.DB, consent *Consent) error {
+	result := db.Create(consent)
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot save the consent of contact with id '%d'", consent.ContactID)
+	}
+	return nil
+}
+
+func readConsents(db *gorm.DB, filter ConsentFilter) ([]Consent, error) {
+	consents := []Consent{}
+	query := db.Model(Consent{})
+	if filter.ContactID != 0 {
+		query = query.Where("contact_id = ?", filter.ContactID)
+	}
+	if filter.Viewer != nil {
+		visible := db.Model(Contact{}).Select("id").Scopes(visibleContacts(filter.Viewer, ShareRead))
+		query = query.Where("contact_id IN (?)", visible)
+	}
+	if filter.Purpose != "" {
+		query = query.Where("purpose = ?", filter.Purpose)
+	}
+	if filter.Channel != "" {
+		query = query.Where("channel = ?", filter.Channel)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if !filter.History {
+		query = query.Where(`NOT EXISTS (SELECT 1 FROM consents AS n WHERE n.tenant_id = consents.tenant_id
+			AND n.contact_id = consents.contact_id
+			AND n.purpose = consents.purpose AND n.channel = consents.channel
+			AND (n.given_at > consents.given_at OR (n.given_at = consents.given_at AND n.id > consents.id)))`)
+	}
+	result := query.Order("contact_id, purpose, channel, given_at DESC, id DESC").Find(&consents)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot list the consents")
+	}
+	return consents, nil
+}
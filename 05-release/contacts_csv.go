@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"gorm.io/gorm"
+)
+
+// ColumnMapping binds a column of a CSV file to a field of the Contact.
+type ColumnMapping struct {
+	Column string
+	Field  string
+}
+
+// CSVPreset describes the CSV layout used by another application. Import
+// lists all the columns we can read, more columns can fill the same field.
+// Export lists the columns that we write, one for each field.
+type CSVPreset struct {
+	Import []ColumnMapping
+	Export []ColumnMapping
+}
+
+// contactFields are the fields of the Contact that can be mapped to a column.
+var contactFields = []string{"Name", "Phone", "Address", "Email", "Website", "Notes"}
+
+var csvPresets = map[string]CSVPreset{
+	"default": {
+		Import: defaultColumns(),
+		Export: defaultColumns(),
+	},
+	// Google Contacts, both the old layout with the "Name" column and the
+	// new one where the name is split in more columns.
+	"google": {
+		Import: []ColumnMapping{
+			{"Name", "Name"},
+			{"First Name", "Name"},
+			{"Middle Name", "Name"},
+			{"Last Name", "Name"},
+			{"Phone 1 - Value", "Phone"},
+			{"Phone 2 - Value", "Phone"},
+			{"Address 1 - Formatted", "Address"},
+			{"E-mail 1 - Value", "Email"},
+			{"E-mail 2 - Value", "Email"},
+			{"Website 1 - Value", "Website"},
+			{"Notes", "Notes"},
+		},
+		Export: []ColumnMapping{
+			{"Name", "Name"},
+			{"Phone 1 - Value", "Phone"},
+			{"Address 1 - Formatted", "Address"},
+			{"E-mail 1 - Value", "Email"},
+			{"Website 1 - Value", "Website"},
+			{"Notes", "Notes"},
+		},
+	},
+	// Microsoft Outlook
+	"outlook": {
+		Import: []ColumnMapping{
+			{"First Name", "Name"},
+			{"Middle Name", "Name"},
+			{"Last Name", "Name"},
+			{"Mobile Phone", "Phone"},
+			{"Home Phone", "Phone"},
+			{"Business Phone", "Phone"},
+			{"Home Street", "Address"},
+			{"Home City", "Address"},
+			{"Home Postal Code", "Address"},
+			{"Home State", "Address"},
+			{"Home Country/Region", "Address"},
+			{"E-mail Address", "Email"},
+			{"E-mail 2 Address", "Email"},
+			{"Web Page", "Website"},
+			{"Notes", "Notes"},
+		},
+		Export: []ColumnMapping{
+			{"First Name", "Name"},
+			{"Mobile Phone", "Phone"},
+			{"Home Street", "Address"},
+			{"E-mail Address", "Email"},
+			{"Web Page", "Website"},
+			{"Notes", "Notes"},
+		},
+	},
+}
+
+func defaultColumns() []ColumnMapping {
+	columns := make([]ColumnMapping, len(contactFields))
+	for i, field := range contactFields {
+		columns[i] = ColumnMapping{Column: field, Field: field}
+	}
+	return columns
+}
+
+// fieldSeparators tells how the values of more columns mapped to the same
+// field are joined. For the other fields the first value that is not empty
+// is used.
+var fieldSeparators = map[string]string{
+	"Name":    " ",
+	"Address": ", ",
+	"Notes":   "\n",
+}
+
+func contactField(contact *Contact, field string) string {
+	switch field {
+	case "Name":
+		return contact.Name
+	case "Phone":
+		return contact.Phone
+	case "Address":
+		return contact.Address
+	case "Email":
+		return contact.Email
+	case "Website":
+		return contact.Website
+	case "Notes":
+		return contact.Notes
+	}
+	return ""
+}
+
+func setContactField(contact *Contact, field string, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	current := contactField(contact, field)
+	if current != "" {
+		separator, ok := fieldSeparators[field]
+		if !ok {
+			return
+		}
+		value = current + separator + value
+	}
+	switch field {
+	case "Name":
+		contact.Name = value
+	case "Phone":
+		contact.Phone = value
+	case "Address":
+		contact.Address = value
+	case "Email":
+		contact.Email = value
+	case "Website":
+		contact.Website = value
+	case "Notes":
+		contact.Notes = value
+	}
+}
+
+// csvMapping returns the column mapping requested with the preset and mapping
+// parameters.
+func csvMapping(c *gin.Context, export bool) ([]ColumnMapping, error) {
+	return presetMapping(formParam(c, "preset", "default"), formParam(c, "mapping", ""), export)
+}
+
+// presetMapping returns the columns of a preset or, when raw is given, the
+// custom mapping. The custom mapping is a JSON object from the column name to
+// the field name, it replaces the columns of the preset.
+func presetMapping(presetName string, raw string, export bool) ([]ColumnMapping, error) {
+	if presetName == "" {
+		presetName = "default"
+	}
+	preset, ok := csvPresets[presetName]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset '%s'", presetName)
+	}
+	columns := preset.Import
+	if export {
+		columns = preset.Export
+	}
+
+	if raw == "" {
+		return columns, nil
+	}
+	var custom map[string]string
+	if err := json.Unmarshal([]byte(raw), &custom); err != nil {
+		return nil, fmt.Errorf("the mapping must be a JSON object from column to field: %w", err)
+	}
+	names := make([]string, 0, len(custom))
+	for column := range custom {
+		names = append(names, column)
+	}
+	sort.Strings(names)
+	columns = nil
+	// the columns follow the order of the fields, so the export is stable.
+	for _, field := range contactFields {
+		for _, column := range names {
+			if strings.EqualFold(custom[column], field) {
+				columns = append(columns, ColumnMapping{Column: column, Field: field})
+			}
+		}
+	}
+	if len(columns) != len(custom) {
+		return nil, fmt.Errorf("the mapping contains unknown fields, valid fields are %s",
+			strings.Join(contactFields, ", "))
+	}
+	return columns, nil
+}
+
+// decodeText converts an uploaded file to UTF-8. When the encoding is not
+// given it is detected from the byte order mark or guessed from the content.
+func decodeText(data []byte, name string) (string, string, error) {
+	var enc encoding.Encoding
+	switch strings.ToLower(name) {
+	case "":
+		enc, name = detectEncoding(data)
+	case "utf-8", "utf8":
+		enc, name = unicode.UTF8BOM, "utf-8"
+	case "utf-16", "utf16":
+		enc, name = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), "utf-16"
+	case "utf-16le":
+		enc = unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case "utf-16be":
+		enc = unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	case "windows-1252", "cp1252":
+		enc, name = charmap.Windows1252, "windows-1252"
+	default:
+		return "", "", fmt.Errorf("unsupported encoding '%s'", name)
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", "", fmt.Errorf("the file is not valid %s: %w", name, err)
+	}
+	return string(decoded), name, nil
+}
+
+func detectEncoding(data []byte) (encoding.Encoding, string) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return unicode.UTF8BOM, "utf-8"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), "utf-16le"
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), "utf-16be"
+	}
+
+	// Without a byte order mark UTF-16 is recognised by the zero bytes of
+	// the ASCII characters, that are always in the even or in the odd
+	// positions.
+	sample := data
+	if len(sample) > 1024 {
+		sample = sample[:1024]
+	}
+	var even, odd int
+	for i, b := range sample {
+		if b == 0 {
+			if i%2 == 0 {
+				even++
+			} else {
+				odd++
+			}
+		}
+	}
+	if len(sample) >= 2 {
+		half := len(sample) / 2
+		if odd > half*3/4 {
+			return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "utf-16le"
+		}
+		if even > half*3/4 {
+			return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "utf-16be"
+		}
+	}
+
+	if utf8.Valid(data) {
+		return unicode.UTF8, "utf-8"
+	}
+	return charmap.Windows1252, "windows-1252"
+}
+
+// detectDelimiter chooses between comma, semicolon and tab looking at the
+// header, some localized applications don't use the comma.
+func detectDelimiter(text string) rune {
+	header := text
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		header = text[:i]
+	}
+	delimiter, best := ',', strings.Count(header, ",")
+	for _, candidate := range []rune{';', '\t'} {
+		if n := strings.Count(header, string(candidate)); n > best {
+			delimiter, best = candidate, n
+		}
+	}
+	return delimiter
+}
+
+// RowError collects the validation errors of a row of the file. Row is the
+// line of the file where the record starts, the header is line 1.
+type RowError struct {
+	Row    int
+	Errors []string
+}
+
+// ImportRecord is a contact read from an imported file together with the
+// problems found validating it.
+type ImportRecord struct {
+	Row     int
+	Contact Contact
+	Errors  []string
+}
+
+// splitRecords separates the valid contacts from the errors of the records
+// that are not valid.
+func splitRecords(records []ImportRecord) (contacts []Contact, rowErrors []RowError) {
+	for _, record := range records {
+		if len(record.Errors) > 0 {
+			rowErrors = append(rowErrors, RowError{Row: record.Row, Errors: record.Errors})
+			continue
+		}
+		contacts = append(contacts, record.Contact)
+	}
+	return contacts, rowErrors
+}
+
+// CSVImportReport is the result of an import.
+type CSVImportReport struct {
+	DryRun   bool
+	Encoding string
+	Rows     int
+	Imported int
+	Errors   []RowError
+}
+
+// parseContactsCSV reads the contacts from a CSV file, one record for every
+// row.
+func parseContactsCSV(text string, columns []ColumnMapping) ([]ImportRecord, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = detectDelimiter(text)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the header of the file: %w", err)
+	}
+	// the values of the record are read in the order of the mapping, so the
+	// joined fields like the address have their parts in the right order.
+	type mappedColumn struct {
+		index int
+		field string
+	}
+	var mapped []mappedColumn
+	for _, column := range columns {
+		for i, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column.Column) {
+				mapped = append(mapped, mappedColumn{index: i, field: column.Field})
+				break
+			}
+		}
+	}
+	if len(mapped) == 0 {
+		return nil, fmt.Errorf("no column of the file matches the mapping")
+	}
+
+	var records []ImportRecord
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, err
+			}
+			records = append(records, ImportRecord{Row: line, Errors: []string{err.Error()}})
+			continue
+		}
+
+		record := ImportRecord{Row: line}
+		for _, column := range mapped {
+			if column.index < len(values) {
+				setContactField(&record.Contact, column.field, values[column.index])
+			}
+		}
+		record.Errors = validateContact(&record.Contact)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// formParam returns a parameter of the query or, when the file is uploaded
+// with a multipart form, a field of the form. The body is never read as a
+// url-encoded form, it is the file itself.
+func formParam(c *gin.Context, name string, def string) string {
+	if value, ok := c.GetQuery(name); ok {
+		return value
+	}
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		if value, ok := c.GetPostForm(name); ok {
+			return value
+		}
+	}
+	return def
+}
+
+// importTarget returns the owner and the address book of the imported
+// contacts: the caller and the book parameter or its personal book.
+func importTarget(c *gin.Context) (*Contact, error) {
+	db := tenantDB(c)
+	var target Contact
+	if book := formParam(c, "book", ""); book != "" {
+		bookId, err := strconv.ParseUint(book, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid book '%s'", book)
+		}
+		target.AddressBookID = uint(bookId)
+	}
+	if err := assignAddressBook(db, currentPrincipal(c), &target); err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+// readUpload returns the uploaded file, sent either as the "file" field of a
+// multipart form or as the body of the request.
+func readUpload(c *gin.Context) ([]byte, error) {
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	return io.ReadAll(c.Request.Body)
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// ImportContactsCSV godoc.
+// @Summary      Import contacts from CSV.
+// @Description  Imports the contacts of a CSV file, sent as body or as the "file" field of
+// @Description  a form. Nothing is written if a row is not valid, the dry run only
+// @Description  validates the file.
+// @tags         Contact
+// @Accept       text/csv
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        preset    query  string  false  "default, google or outlook"
+// @Param        mapping   query  string  false  "JSON object from column to field, replaces the preset"
+// @Param        encoding  query  string  false  "utf-8, utf-16, utf-16le, utf-16be or windows-1252, detected by default"
+// @Param        dry_run   query  bool    false  "Only validate the file"
+// @Param        book      query  int     false  "Address book of the contacts, the personal book by default"
+// @Success      200  {object}  CSVImportReport
+// @Success      201  {object}  CSVImportReport
+// @Failure      422  {object}  CSVImportReport
+// @Router       /contacts/import.csv [post]
+func importContactsCSV(c *gin.Context) {
+	db := tenantDB(c)
+	columns, err := csvMapping(c, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(formParam(c, "dry_run", "false"))
+	target, err := importTarget(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	data, err := readUpload(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	text, detected, err := decodeText(data, formParam(c, "encoding", ""))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	records, err := parseContactsCSV(text, columns)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	contacts, rowErrors := splitRecords(records)
+	for i := range contacts {
+		contacts[i].Owner = target.Owner
+		contacts[i].AddressBookID = target.AddressBookID
+	}
+
+	report := CSVImportReport{
+		DryRun:   dryRun,
+		Encoding: detected,
+		Rows:     len(contacts) + len(rowErrors),
+		Errors:   rowErrors,
+	}
+	if dryRun {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+	if len(rowErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, report)
+		return
+	}
+	if err := saveContacts(db, contacts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	report.Imported = len(contacts)
+	c.JSON(http.StatusCreated, report)
+}
+
+// ExportContactsCSV godoc.
+// @Summary      Export contacts to CSV.
+// @Description  Writes all the contacts that the caller can see in a CSV file. With consent
+// @Description  only the contacts that have a valid consent for the purpose are written.
+// @tags         Contact
+// @Produce      text/csv
+// @Param        preset   query  string  false  "default, google or outlook"
+// @Param        mapping  query  string  false  "JSON object from column to field, replaces the preset"
+// @Param        consent  query  string  false  "Only the contacts with a valid consent for this purpose"
+// @Param        channel  query  string  false  "The channel of the consent, any by default"
+// @Success      200
+// @Router       /contacts/export.csv [get]
+func exportContactsCSV(c *gin.Context) {
+	db := tenantDB(c)
+	columns, err := csvMapping(c, true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// the exports for marketing leave out the contacts without consent
+	if purpose := c.Query("consent"); purpose != "" {
+		channel := c.DefaultQuery("channel", ChannelAny)
+		if !contains(consentChannels, channel) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown channel '%s'", channel)})
+			return
+		}
+		db = db.Scopes(withConsent(purpose, channel, time.Now()))
+	} else if c.Query("channel") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the channel requires the consent parameter"})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="contacts.csv"`)
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Column
+	}
+	writer.Write(header)
+	exported := 0
+	err = readContactsInBatches(db, currentPrincipal(c), func(contacts []Contact) error {
+		exported += len(contacts)
+		for i := range contacts {
+			record := make([]string, len(columns))
+			for j, column := range columns {
+				record[j] = contactField(&contacts[i], column.Field)
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	})
+	auditBulkRead(c, exported)
+	if err != nil {
+		// the headers are already sent, we can only stop the file.
+		c.Error(err)
+	}
+	writer.Flush()
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+const contactsBatchSize = 500
+
+// saveContacts inserts the contacts in batches, in one transaction.
+func saveContacts(db *gorm.DB, contacts []Contact) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.CreateInBatches(&contacts, contactsBatchSize)
+		if result.Error != nil {
+			return wrapDBError(result.Error, `error saving contacts`)
+		}
+		return nil
+	})
+}
+
+// readContactsInBatches calls fn with all the contacts that the principal can
+// see, a batch at time, so the whole table is never loaded in memory.
+func readContactsInBatches(db *gorm.DB, principal *Principal, fn func([]Contact) error) error {
+	var contacts []Contact
+	result := db.Scopes(visibleContacts(principal, ShareRead)).FindInBatches(&contacts, contactsBatchSize, func(tx *gorm.DB, batch int) error {
+		return fn(contacts)
+	})
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot list contacts")
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestPresetMapping(t *testing.T) {
+	for _, test := range []struct {
+		preset, mapping string
+		export          bool
+		columns         []ColumnMapping
+		err             string
+	}{
+		{"", "", false, defaultColumns(), ""},
+		{"google", "", true, csvPresets["google"].Export, ""},
+		{"outlook", "", false, csvPresets["outlook"].Import, ""},
+		{"other", "", false, nil, "unknown preset"},
+		// the custom mapping replaces the columns of the preset, in the
+		// order of the fields
+		{"google", `{"Mail": "email", "Full name": "Name", "Surname": "name"}`, false, []ColumnMapping{
+			{"Full name", "Name"},
+			{"Surname", "Name"},
+			{"Mail", "Email"},
+		}, ""},
+		{"", `{"Mail": "Fax"}`, false, nil, "unknown fields"},
+		{"", `["Name"]`, false, nil, "JSON object"},
+	} {
+		columns, err := presetMapping(test.preset, test.mapping, test.export)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("preset %q mapping %q: expected the error %q, got %v", test.preset, test.mapping, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("preset %q mapping %q: %v", test.preset, test.mapping, err)
+		} else if !reflect.DeepEqual(columns, test.columns) {
+			t.Errorf("preset %q mapping %q: unexpected columns %v", test.preset, test.mapping, columns)
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().String("Name\nRenée\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		data, encoding string
+		text, detected string
+	}{
+		{"Name\nRenée\n", "", "Name\nRenée\n", "utf-8"},
+		{"\xEF\xBB\xBFName\nRenée\n", "", "Name\nRenée\n", "utf-8"},
+		{"\xFF\xFE" + utf16, "", "Name\nRenée\n", "utf-16le"},
+		{utf16, "", "Name\nRenée\n", "utf-16le"},
+		{"Name\nRen\xe9e\n", "", "Name\nRenée\n", "windows-1252"},
+		{"Name\nRen\xe9e\n", "CP1252", "Name\nRenée\n", "windows-1252"},
+	} {
+		text, detected, err := decodeText([]byte(test.data), test.encoding)
+		if err != nil || text != test.text || detected != test.detected {
+			t.Errorf("%q as %q: got %q %q %v", test.data, test.encoding, text, detected, err)
+		}
+	}
+	if _, _, err := decodeText([]byte("Name"), "latin-9"); err == nil {
+		t.Error("an unsupported encoding is accepted")
+	}
+}
+
+func TestDetectDelimiter(t *testing.T) {
+	for text, delimiter := range map[string]rune{
+		"Name,Phone,Email\nA;B,C,D\n": ',',
+		"Name;Phone;Email\nA,B;C;D\n": ';',
+		"Name\tPhone\nA;B\tC\n":       '\t',
+		"Name\n":                      ',',
+	} {
+		if got := detectDelimiter(text); got != delimiter {
+			t.Errorf("%q: expected %q, got %q", text, delimiter, got)
+		}
+	}
+}
+
+func TestParseContactsCSV(t *testing.T) {
+	text := "First Name;Last Name;Home Street;Home City;E-mail Address;Web Page\n" +
+		"Jane;Roe;1 Main St;Springfield;jane@example.com;https://example.com\n" +
+		"\"John\n\";Doe;;Shelbyville;john;\n" +
+		";;;;;\n" +
+		"Ann;\"Lee\"x;;;;\n"
+	records, err := parseContactsCSV(text, csvPresets["outlook"].Import)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ImportRecord{
+		{Row: 2, Contact: Contact{Name: "Jane Roe", Address: "1 Main St, Springfield", Email: "jane@example.com", Website: "https://example.com"}},
+		{Row: 3, Contact: Contact{Name: "John Doe", Address: "Shelbyville", Email: "john"}, Errors: []string{"invalid email 'john'"}},
+		{Row: 5, Errors: []string{"the name is required"}},
+	}
+	if len(records) != 4 || !reflect.DeepEqual(records[:3], expected) {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if records[3].Row != 6 || len(records[3].Errors) != 1 || !strings.Contains(records[3].Errors[0], "quote") {
+		t.Errorf("the malformed row is not reported: %+v", records[3])
+	}
+
+	contacts, rowErrors := splitRecords(records)
+	if len(contacts) != 1 || contacts[0].Name != "Jane Roe" || len(rowErrors) != 3 || rowErrors[0].Row != 3 {
+		t.Errorf("unexpected contacts %+v and errors %+v", contacts, rowErrors)
+	}
+
+	if _, err := parseContactsCSV("Fax,Pager\n1,2\n", defaultColumns()); err == nil {
+		t.Error("a file without the columns of the mapping is accepted")
+	}
+}
@@ -1,17 +1,10 @@
-// Package docs GENERATED BY THE COMMAND ABOVE; DO NOT EDIT
+// Package docs GENERATED BY SWAG; DO NOT EDIT
 // This file was generated by swaggo/swag
 package docs
 
-import (
-	"bytes"
-	"encoding/json"
-	"strings"
-	"text/template"
+import "github.com/swaggo/swag"
 
-	"github.com/swaggo/swag"
-)
-
-var doc = `{
+const docTemplate = `{
     "schemes": {{ marshal .Schemes }},
     "swagger": "2.0",
     "info": {
@@ -32,45 +25,300 @@ var doc = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/contacts": {
+        "/audit": {
             "get": {
-                "description": "Returns all the contacts in the contact manager.",
+                "description": "Returns the entries of the audit log, the newest first. The next page\nis read passing the Seq of the last entry as before.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "Contact"
+                    "Audit"
+                ],
+                "summary": "Get the audit log.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only the entries of this caller",
+                        "name": "actor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "read, export, create, update or delete",
+                        "name": "action",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "success, denied, failed or error",
+                        "name": "result",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the entries from this address",
+                        "name": "ip",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only the entries about this contact",
+                        "name": "contact",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the entries after this time (RFC 3339)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the entries before this time (RFC 3339)",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only the entries with a lower Seq",
+                        "name": "before",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of entries, 100 by default and 1000 at most",
+                        "name": "limit",
+                        "in": "query"
+                    }
                 ],
-                "summary": "Get the Contacts.",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/main.Contact"
+                                "$ref": "#/definitions/main.AuditEntry"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/audit/export.jsonl": {
+            "get": {
+                "description": "Returns the entries of the audit log in JSON Lines, the oldest first.\nIt accepts the filters of the list, except before and limit.",
+                "produces": [
+                    "application/x-ndjson"
+                ],
+                "tags": [
+                    "Audit"
+                ],
+                "summary": "Export the audit log.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only the entries of this caller",
+                        "name": "actor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "read, export, create, update or delete",
+                        "name": "action",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "success, denied, failed or error",
+                        "name": "result",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only the entries about this contact",
+                        "name": "contact",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the entries after this time (RFC 3339)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the entries before this time (RFC 3339)",
+                        "name": "to",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/audit/verify": {
+            "get": {
+                "description": "Checks the hash chain of the audit log of the tenant and returns the first\nentry that was changed or removed.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Audit"
+                ],
+                "summary": "Verify the audit log.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.AuditVerification"
+                        }
+                    }
+                }
+            }
+        },
+        "/auth/callback": {
+            "get": {
+                "description": "Exchanges the code sent by the identity provider for an ID token, opens a\nsession and redirects to the page asked at the login.",
+                "tags": [
+                    "Auth"
+                ],
+                "summary": "Complete the login.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Authorization code",
+                        "name": "code",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "State of the login",
+                        "name": "state",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "302": {
+                        "description": "Found"
+                    }
+                }
+            }
+        },
+        "/auth/login": {
+            "get": {
+                "description": "Redirects the browser to the identity provider with an authorization\ncode request protected by PKCE.",
+                "tags": [
+                    "Auth"
+                ],
+                "summary": "Sign in with the identity provider.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Path to open after the login, / by default",
+                        "name": "return_to",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "302": {
+                        "description": "Found"
+                    }
+                }
+            }
+        },
+        "/auth/logout": {
+            "post": {
+                "description": "Closes the session of the browser, the X-CSRF-Token header is required.",
+                "tags": [
+                    "Auth"
+                ],
+                "summary": "Sign out.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "CSRF token of the session",
+                        "name": "X-CSRF-Token",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            }
+        },
+        "/auth/session": {
+            "get": {
+                "description": "Returns the user of the session and the CSRF token to send with the\nX-CSRF-Token header.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Auth"
+                ],
+                "summary": "Get the session of the browser.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.SessionInfo"
+                        }
+                    }
+                }
+            }
+        },
+        "/books": {
+            "get": {
+                "description": "Returns the address books that the caller owns or that are shared with it.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "AddressBook"
+                ],
+                "summary": "Get the address books.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.AddressBook"
                             }
                         }
                     }
                 }
             },
             "post": {
-                "description": "Creates a new contact",
+                "description": "Creates an address book owned by the caller, it can be shared with users and teams.",
                 "consumes": [
                     "application/json"
                 ],
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
-                    "Contact"
+                    "AddressBook"
                 ],
-                "summary": "Create new idea.",
+                "summary": "Create an address book.",
                 "parameters": [
                     {
-                        "description": "All the informations required to create a contact",
+                        "description": "The name of the book",
                         "name": "Body",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/main.Contact"
+                            "$ref": "#/definitions/main.AddressBook"
                         }
                     }
                 ],
@@ -78,26 +326,48 @@ var doc = `{
                     "201": {
                         "description": "Created",
                         "schema": {
-                            "$ref": "#/definitions/main.Contact"
+                            "$ref": "#/definitions/main.AddressBook"
                         }
                     }
                 }
             }
         },
-        "/contacts/{id}": {
+        "/books/{id}": {
+            "delete": {
+                "description": "Deletes an empty address book and its shares. Only the owner can delete it.",
+                "tags": [
+                    "AddressBook"
+                ],
+                "summary": "Delete an address book.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Address book ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            }
+        },
+        "/books/{id}/shares": {
             "get": {
-                "description": "Gets detailed info about a contact.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "Contact"
+                    "AddressBook"
                 ],
-                "summary": "Get contact details.",
+                "summary": "Get the shares of an address book.",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Contact ID",
+                        "description": "Address book ID",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -107,147 +377,2122 @@ var doc = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/main.Contact"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Share"
+                            }
                         }
                     }
                 }
             },
             "put": {
-                "description": "Update the contact informations",
+                "description": "Gives a user or a team read or write access to the book, or changes the\nlevel of an existing share.",
                 "consumes": [
                     "application/json"
                 ],
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
-                    "Contact"
+                    "AddressBook"
                 ],
-                "summary": "Update contact.",
+                "summary": "Share an address book.",
                 "parameters": [
                     {
-                        "description": "All the property of the contact",
+                        "type": "integer",
+                        "description": "Address book ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Grantee, user:\u003cname\u003e or team:\u003cname\u003e, and Level, read or write",
                         "name": "Body",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/main.Contact"
+                            "$ref": "#/definitions/main.Share"
                         }
-                    },
-                    {
-                        "type": "integer",
-                        "description": "Contact ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": ""
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Share"
+                        }
                     }
                 }
-            },
+            }
+        },
+        "/books/{id}/shares/{shareId}": {
             "delete": {
-                "description": "Allows the deletion of a contact.",
                 "tags": [
-                    "Contact"
+                    "AddressBook"
                 ],
-                "summary": "Request delete contact.",
+                "summary": "Remove a share of an address book.",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Contact ID",
+                        "description": "Address book ID",
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Share ID",
+                        "name": "shareId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            }
+        },
+        "/consents": {
+            "get": {
+                "description": "Returns the current consents of the contacts that the caller can see, e.g.\nall the contacts that have granted the consent for a purpose.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Consent"
+                ],
+                "summary": "Get the consents.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only the consents for this purpose",
+                        "name": "purpose",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the consents on this channel",
+                        "name": "channel",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "granted or withdrawn",
+                        "name": "status",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": ""
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Consent"
+                            }
+                        }
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "main.Contact": {
-            "type": "object",
-            "properties": {
-                "address": {
-                    "type": "string"
-                },
-                "email": {
-                    "type": "string"
-                },
-                "id": {
-                    "type": "integer"
-                },
+        },
+        "/contacts": {
+            "get": {
+                "description": "Returns all the contacts that the caller can see.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Get the Contacts.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "html adds the notes rendered to HTML",
+                        "name": "render",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the contacts with this email",
+                        "name": "email",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the contacts with this phone number",
+                        "name": "phone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the contacts with this tag",
+                        "name": "tag",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Contact"
+                            }
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Creates a new contact",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Create new idea.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Makes the request safe to retry",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    },
+                    {
+                        "description": "All the informations required to create a contact",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Contact"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/main.Contact"
+                        }
+                    }
+                }
+            }
+        },
+        "/contacts/by-external/{source}/{id}": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Get a contact by external id.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "The system that owns the id, e.g. crm",
+                        "name": "source",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "The id of the contact in the source",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "html adds the notes rendered to HTML",
+                        "name": "render",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Contact"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Updates the contact that the source knows with the given id, or creates\nit together with the reference when the id is new.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Create or update a contact by external id.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "The system that owns the id, e.g. crm",
+                        "name": "source",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "The id of the contact in the source",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "All the property of the contact",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Contact"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Contact"
+                        }
+                    },
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/main.Contact"
+                        }
+                    }
+                }
+            }
+        },
+        "/contacts/export.csv": {
+            "get": {
+                "description": "Writes all the contacts that the caller can see in a CSV file. With consent\nonly the contacts that have a valid consent for the purpose are written.",
+                "produces": [
+                    "text/csv"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Export contacts to CSV.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "default, google or outlook",
+                        "name": "preset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "JSON object from column to field, replaces the preset",
+                        "name": "mapping",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the contacts with a valid consent for this purpose",
+                        "name": "consent",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "The channel of the consent, any by default",
+                        "name": "channel",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/contacts/import.csv": {
+            "post": {
+                "description": "Imports the contacts of a CSV file, sent as body or as the \"file\" field of\na form. Nothing is written if a row is not valid, the dry run only\nvalidates the file.",
+                "consumes": [
+                    "text/csv",
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Import contacts from CSV.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "default, google or outlook",
+                        "name": "preset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "JSON object from column to field, replaces the preset",
+                        "name": "mapping",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "utf-8, utf-16, utf-16le, utf-16be or windows-1252, detected by default",
+                        "name": "encoding",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Only validate the file",
+                        "name": "dry_run",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Address book of the contacts, the personal book by default",
+                        "name": "book",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.CSVImportReport"
+                        }
+                    },
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/main.CSVImportReport"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/main.CSVImportReport"
+                        }
+                    }
+                }
+            }
+        },
+        "/contacts/{id}": {
+            "get": {
+                "description": "Gets detailed info about a contact.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Get contact details.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "html adds the notes rendered to HTML",
+                        "name": "render",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Contact"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Update the contact informations",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Update contact.",
+                "parameters": [
+                    {
+                        "description": "All the property of the contact",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Contact"
+                        }
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            },
+            "delete": {
+                "description": "Allows the deletion of a contact.",
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Request delete contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/contacts/{id}/consents": {
+            "get": {
+                "description": "Returns the current consent of the contact for every purpose and channel, or\nwith history=true all the records, the newest first.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Consent"
+                ],
+                "summary": "Get the consents of a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the consents for this purpose",
+                        "name": "purpose",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "All the records instead of the current ones",
+                        "name": "history",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Consent"
+                            }
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Records that the contact has granted or withdrawn the consent for a purpose\non a channel, replacing the previous record for the same purpose and channel.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Consent"
+                ],
+                "summary": "Record a consent.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "The purpose, channel, status, legal basis and source",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Consent"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/main.Consent"
+                        }
+                    }
+                }
+            }
+        },
+        "/contacts/{id}/external-refs": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Get the external ids of a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.ExternalReference"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/contacts/{id}/tags": {
+            "get": {
+                "description": "Returns the tags of the contact in alphabetical order.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Get the tags of a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/contacts/{id}/tags/{tag}": {
+            "put": {
+                "description": "Adds the tag to the contact, nothing changes when the contact has it already.",
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Tag a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Tag",
+                        "name": "tag",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            },
+            "delete": {
+                "description": "Removes the tag from the contact.",
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Remove a tag from a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Tag",
+                        "name": "tag",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            }
+        },
+        "/contacts/{id}/tasks": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Task"
+                ],
+                "summary": "Get the tasks of a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "overdue, today or upcoming",
+                        "name": "view",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Task"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/contacts/{id}/timeline": {
+            "get": {
+                "description": "Returns the interactions with a contact, the most recent first.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Timeline"
+                ],
+                "summary": "Get the timeline of a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page number, starting from 1",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of activities in a page, 20 by default",
+                        "name": "page_size",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.TimelinePage"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Appends a call, a meeting, an email or a note to the timeline of a contact.",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Timeline"
+                ],
+                "summary": "Log an interaction.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "The interaction, Type is required, Author is the caller",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Activity"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/main.Activity"
+                        }
+                    }
+                }
+            }
+        },
+        "/contacts:batch": {
+            "post": {
+                "description": "Applies a list of operations. In atomic mode nothing is written if an\noperation fails, in best_effort mode every operation is independent.\nThe creates are inserted in chunks, before the updates and the deletes.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Contact"
+                ],
+                "summary": "Create, update and delete contacts in bulk.",
+                "parameters": [
+                    {
+                        "description": "Mode and operations",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.BatchRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.BatchResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/main.BatchResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/healthz": {
+            "get": {
+                "description": "Answers as long as the process serves the requests, it does not check the\ndependencies.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Health"
+                ],
+                "summary": "Liveness of the instance.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/imports": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Import"
+                ],
+                "summary": "Get the imports.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.ImportJob"
+                            }
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Queues the import of a CSV, vCard or JSON file of contacts. The file is the\nbody of the request or the \"file\" field of a form. Sending the same file\nagain returns the job already created.",
+                "consumes": [
+                    "text/csv",
+                    "text/vcard",
+                    "application/json",
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Import"
+                ],
+                "summary": "Start an import.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "csv, vcard or json, by default from the content type",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "CSV only: default, google or outlook",
+                        "name": "preset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "CSV only: JSON object from column to field",
+                        "name": "mapping",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "utf-8, utf-16, utf-16le, utf-16be or windows-1252, detected by default",
+                        "name": "encoding",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Address book of the contacts, the personal book by default",
+                        "name": "book",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ImportJob"
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/main.ImportJob"
+                        }
+                    }
+                }
+            }
+        },
+        "/imports/{id}": {
+            "get": {
+                "description": "Returns the progress of an import and a page of the records that were not valid.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Import"
+                ],
+                "summary": "Get the state of an import.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Import ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page of the errors, starting from 1",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of errors in a page, 20 by default",
+                        "name": "page_size",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ImportJobReport"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Stops a queued or running import. The batches already committed are kept.",
+                "tags": [
+                    "Import"
+                ],
+                "summary": "Cancel an import.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Import ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ImportJob"
+                        }
+                    }
+                }
+            }
+        },
+        "/privacy/subjects/{id}/erase": {
+            "post": {
+                "description": "Deletes a contact with all its data, or pseudonymizes it keeping the records\nwithout the personal data. The data is removed from every table, the\nreturned certificate of erasure is written in the audit log.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Privacy"
+                ],
+                "summary": "Erase the data of a person.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "The mode and the reason of the erasure",
+                        "name": "Body",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErasureRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ErasureCertificate"
+                        }
+                    }
+                }
+            }
+        },
+        "/privacy/subjects/{id}/export": {
+            "get": {
+                "description": "Returns everything held about a contact, for a request of access or of\nportability: the contact, its tasks, its timeline, its external ids and\nthe history of the accesses.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Privacy"
+                ],
+                "summary": "Export the data of a person.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.SubjectExport"
+                        }
+                    }
+                }
+            }
+        },
+        "/readyz": {
+            "get": {
+                "description": "Checks the database, the migrations and the other dependencies. The instance\nis unavailable, with the status 503, when a critical component is down, and\ndegraded when another one is.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Health"
+                ],
+                "summary": "Readiness of the instance.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.HealthReport"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/main.HealthReport"
+                        }
+                    }
+                }
+            }
+        },
+        "/retention/report": {
+            "get": {
+                "description": "Returns the contacts of the tenant that the retention rules would delete or\nanonymize now, without changing them.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Privacy"
+                ],
+                "summary": "Preview the retention rules.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.RetentionReport"
+                        }
+                    }
+                }
+            }
+        },
+        "/tasks": {
+            "get": {
+                "description": "Returns the tasks of the contacts that the caller can see. The view parameter\nrestricts the result to the open tasks that are overdue, due today or upcoming.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Task"
+                ],
+                "summary": "Get the tasks.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "overdue, today or upcoming",
+                        "name": "view",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the tasks of this assignee",
+                        "name": "assignee",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only the tasks with this status",
+                        "name": "status",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.Task"
+                            }
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Creates a reminder or a follow-up task for a contact.",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Task"
+                ],
+                "summary": "Create a new task.",
+                "parameters": [
+                    {
+                        "description": "The task, ContactID, Title and DueAt are required",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Task"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/main.Task"
+                        }
+                    }
+                }
+            }
+        },
+        "/tasks/{id}": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Task"
+                ],
+                "summary": "Get task details.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Task"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Updates a task. Marking as done a recurring task creates the next occurrence.",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Task"
+                ],
+                "summary": "Update task.",
+                "parameters": [
+                    {
+                        "description": "All the property of the task",
+                        "name": "Body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.Task"
+                        }
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.Task"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Allows the deletion of a task.",
+                "tags": [
+                    "Task"
+                ],
+                "summary": "Delete task.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "main.Activity": {
+            "type": "object",
+            "properties": {
+                "author": {
+                    "description": "Author is the caller that logged the activity, it is set by the\nserver.",
+                    "type": "string"
+                },
+                "body": {
+                    "type": "string"
+                },
+                "contactID": {
+                    "type": "integer"
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "occurredAt": {
+                    "type": "string"
+                },
+                "type": {
+                    "description": "Type is one of \"call\", \"meeting\", \"email\" or \"note\".",
+                    "type": "string"
+                }
+            }
+        },
+        "main.AddressBook": {
+            "type": "object",
+            "properties": {
+                "createdAt": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "personal": {
+                    "description": "Personal is set by the server, a book named like the personal one is\nnot personal.",
+                    "type": "boolean"
+                }
+            }
+        },
+        "main.AuditEntry": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "description": "Action is \"read\", \"export\", \"create\", \"update\", \"delete\" or the\noperation of a job.",
+                    "type": "string"
+                },
+                "actor": {
+                    "description": "Actor is the subject of the caller, or the job.",
+                    "type": "string"
+                },
+                "authMethod": {
+                    "type": "string"
+                },
+                "contactIDs": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "detail": {
+                    "type": "string"
+                },
+                "hash": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "ip": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "prevHash": {
+                    "type": "string"
+                },
+                "result": {
+                    "description": "Result is \"success\", \"denied\", \"failed\" or \"error\".",
+                    "type": "string"
+                },
+                "route": {
+                    "description": "Route is the route called, e.g. \"GET /contacts/:id\", and Path the\npath with the values.",
+                    "type": "string"
+                },
+                "seq": {
+                    "description": "Seq numbers the entries of the tenant from 1, without gaps.",
+                    "type": "integer"
+                },
+                "status": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.AuditVerification": {
+            "type": "object",
+            "properties": {
+                "brokenAt": {
+                    "description": "BrokenAt is the Seq of the first entry that does not match.",
+                    "type": "integer"
+                },
+                "entries": {
+                    "type": "integer"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "valid": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "main.BatchOperation": {
+            "type": "object",
+            "properties": {
+                "contact": {
+                    "$ref": "#/definitions/main.Contact"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "op": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.BatchRequest": {
+            "type": "object",
+            "properties": {
+                "mode": {
+                    "type": "string"
+                },
+                "operations": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.BatchOperation"
+                    }
+                }
+            }
+        },
+        "main.BatchResponse": {
+            "type": "object",
+            "properties": {
+                "failed": {
+                    "type": "integer"
+                },
+                "mode": {
+                    "type": "string"
+                },
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.BatchResult"
+                    }
+                },
+                "succeeded": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.BatchResult": {
+            "type": "object",
+            "properties": {
+                "contact": {
+                    "$ref": "#/definitions/main.Contact"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "index": {
+                    "type": "integer"
+                },
+                "op": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.CSVImportReport": {
+            "type": "object",
+            "properties": {
+                "dryRun": {
+                    "type": "boolean"
+                },
+                "encoding": {
+                    "type": "string"
+                },
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.RowError"
+                    }
+                },
+                "imported": {
+                    "type": "integer"
+                },
+                "rows": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.ComponentHealth": {
+            "type": "object",
+            "properties": {
+                "critical": {
+                    "type": "boolean"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "latency": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.Consent": {
+            "type": "object",
+            "properties": {
+                "channel": {
+                    "description": "Channel is \"email\", \"phone\", \"sms\", \"post\" or \"any\".",
+                    "type": "string"
+                },
+                "contactID": {
+                    "type": "integer"
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "expiresAt": {
+                    "description": "ExpiresAt ends a consent granted for a limited time.",
+                    "type": "string"
+                },
+                "givenAt": {
+                    "description": "GivenAt is when the contact granted or withdrew the consent, by\ndefault when it is recorded.",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "legalBasis": {
+                    "description": "LegalBasis is the basis of the processing, see legalBases.",
+                    "type": "string"
+                },
+                "purpose": {
+                    "type": "string"
+                },
+                "recordedBy": {
+                    "type": "string"
+                },
+                "source": {
+                    "description": "Source tells where the consent was collected, e.g. \"signup form\".",
+                    "type": "string"
+                },
+                "status": {
+                    "description": "Status is \"granted\" or \"withdrawn\".",
+                    "type": "string"
+                }
+            }
+        },
+        "main.Contact": {
+            "type": "object",
+            "properties": {
+                "address": {
+                    "type": "string"
+                },
+                "addressBookID": {
+                    "description": "AddressBookID is the book of the contact, by default the personal book\nof the user that creates it.",
+                    "type": "integer"
+                },
+                "anonymizedAt": {
+                    "description": "AnonymizedAt is the time when the personal data of the contact was\nerased, the retention rules do not anonymize it again.",
+                    "type": "string"
+                },
+                "createdAt": {
+                    "description": "CreatedAt and UpdatedAt are set by the database, the retention rules\nlook at the time of the last change.",
+                    "type": "string"
+                },
+                "email": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "lastContacted": {
+                    "description": "LastContacted is the time of the last call, meeting or email in the\ntimeline of the contact.",
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "notes": {
+                    "type": "string"
+                },
+                "notes_html": {
+                    "description": "NotesHTML is the Notes Markdown rendered to sanitized HTML, it is\nreturned only when the request asks for it with ?render=html.",
+                    "type": "string"
+                },
+                "owner": {
+                    "description": "Owner is the user that created the contact, it is set by the server.",
+                    "type": "string"
+                },
+                "phone": {
+                    "type": "string"
+                },
+                "updatedAt": {
+                    "type": "string"
+                },
+                "website": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ErasureCertificate": {
+            "type": "object",
+            "properties": {
+                "auditHash": {
+                    "type": "string"
+                },
+                "auditSeq": {
+                    "description": "AuditSeq and AuditHash identify the entry of the certificate in the\naudit log.",
+                    "type": "integer"
+                },
+                "contactID": {
+                    "type": "integer"
+                },
+                "erasedAt": {
+                    "type": "string"
+                },
+                "erasedBy": {
+                    "type": "string"
+                },
+                "mode": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "records": {
+                    "description": "Records are the records erased or pseudonymized for every kind.",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "main.ErasureRequest": {
+            "type": "object",
+            "properties": {
+                "mode": {
+                    "description": "Mode is \"delete\", the default, or \"pseudonymize\".",
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ExternalReference": {
+            "type": "object",
+            "properties": {
+                "contactID": {
+                    "type": "integer"
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "externalID": {
+                    "type": "string"
+                },
+                "source": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.HealthReport": {
+            "type": "object",
+            "properties": {
+                "components": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/main.ComponentHealth"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ImportJob": {
+            "type": "object",
+            "properties": {
+                "addressBookID": {
+                    "description": "AddressBookID is the book of the imported contacts.",
+                    "type": "integer"
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "createdBy": {
+                    "description": "CreatedBy is the subject of the caller that started the import, it\nowns the imported contacts. Only the admins see the imports of the\nother users.",
+                    "type": "string"
+                },
+                "encoding": {
+                    "type": "string"
+                },
+                "failed": {
+                    "type": "integer"
+                },
+                "finishedAt": {
+                    "type": "string"
+                },
+                "format": {
+                    "description": "Format is one of \"csv\", \"vcard\" or \"json\".",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "imported": {
+                    "type": "integer"
+                },
+                "mapping": {
+                    "type": "string"
+                },
+                "message": {
+                    "description": "Message explains why the job failed.",
+                    "type": "string"
+                },
+                "preset": {
+                    "description": "Options of the CSV files, see the CSV import.",
+                    "type": "string"
+                },
+                "processed": {
+                    "type": "integer"
+                },
+                "status": {
+                    "description": "Status is one of \"queued\", \"running\", \"completed\", \"failed\" or\n\"cancelled\".",
+                    "type": "string"
+                },
+                "total": {
+                    "description": "Total is the number of records in the file, Processed the records\nalready handled, that are Imported or Failed.",
+                    "type": "integer"
+                },
+                "updatedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ImportJobError": {
+            "type": "object",
+            "properties": {
+                "errors": {
+                    "type": "string"
+                },
+                "row": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.ImportJobReport": {
+            "type": "object",
+            "properties": {
+                "addressBookID": {
+                    "description": "AddressBookID is the book of the imported contacts.",
+                    "type": "integer"
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "createdBy": {
+                    "description": "CreatedBy is the subject of the caller that started the import, it\nowns the imported contacts. Only the admins see the imports of the\nother users.",
+                    "type": "string"
+                },
+                "encoding": {
+                    "type": "string"
+                },
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.ImportJobError"
+                    }
+                },
+                "failed": {
+                    "type": "integer"
+                },
+                "finishedAt": {
+                    "type": "string"
+                },
+                "format": {
+                    "description": "Format is one of \"csv\", \"vcard\" or \"json\".",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "imported": {
+                    "type": "integer"
+                },
+                "mapping": {
+                    "type": "string"
+                },
+                "message": {
+                    "description": "Message explains why the job failed.",
+                    "type": "string"
+                },
+                "page": {
+                    "type": "integer"
+                },
+                "pageSize": {
+                    "type": "integer"
+                },
+                "preset": {
+                    "description": "Options of the CSV files, see the CSV import.",
+                    "type": "string"
+                },
+                "processed": {
+                    "type": "integer"
+                },
+                "status": {
+                    "description": "Status is one of \"queued\", \"running\", \"completed\", \"failed\" or\n\"cancelled\".",
+                    "type": "string"
+                },
+                "total": {
+                    "description": "Total is the number of records in the file, Processed the records\nalready handled, that are Imported or Failed.",
+                    "type": "integer"
+                },
+                "updatedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.RetentionMatch": {
+            "type": "object",
+            "properties": {
+                "contactID": {
+                    "type": "integer"
+                },
                 "name": {
                     "type": "string"
                 },
-                "notes": {
+                "tenantID": {
                     "type": "string"
                 },
-                "phone": {
+                "updatedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.RetentionReport": {
+            "type": "object",
+            "properties": {
+                "dryRun": {
+                    "type": "boolean"
+                },
+                "ranAt": {
                     "type": "string"
                 },
-                "website": {
+                "rules": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.RetentionRuleReport"
+                    }
+                }
+            }
+        },
+        "main.RetentionRuleReport": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "applied": {
+                    "description": "Applied is the number of contacts deleted or anonymized, always 0\nin a dry run.",
+                    "type": "integer"
+                },
+                "contacts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.RetentionMatch"
+                    }
+                },
+                "cutoff": {
+                    "description": "Cutoff is the time since when the matched contacts are untouched.",
+                    "type": "string"
+                },
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "rule": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.RowError": {
+            "type": "object",
+            "properties": {
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "row": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.SessionInfo": {
+            "type": "object",
+            "properties": {
+                "csrftoken": {
+                    "type": "string"
+                },
+                "expiresAt": {
+                    "type": "string"
+                },
+                "roles": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "subject": {
+                    "type": "string"
+                },
+                "teams": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "tenant": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.Share": {
+            "type": "object",
+            "properties": {
+                "addressBookID": {
+                    "type": "integer"
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "grantee": {
+                    "description": "Grantee is \"user:\u003csubject\u003e\" or \"team:\u003cname\u003e\".",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "level": {
+                    "description": "Level is \"read\" or \"write\".",
+                    "type": "string"
+                }
+            }
+        },
+        "main.SubjectExport": {
+            "type": "object",
+            "properties": {
+                "accessHistory": {
+                    "description": "AccessHistory is the audit log of the contact: who read, exported\nor changed it.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.AuditEntry"
+                    }
+                },
+                "addressBook": {
+                    "type": "string"
+                },
+                "consents": {
+                    "description": "Consents are all the consent records, the withdrawn ones too.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Consent"
+                    }
+                },
+                "contact": {
+                    "$ref": "#/definitions/main.Contact"
+                },
+                "exportedAt": {
+                    "type": "string"
+                },
+                "externalReferences": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.ExternalReference"
+                    }
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "tasks": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Task"
+                    }
+                },
+                "timeline": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Activity"
+                    }
+                }
+            }
+        },
+        "main.Task": {
+            "type": "object",
+            "properties": {
+                "assignee": {
+                    "type": "string"
+                },
+                "contactID": {
+                    "type": "integer"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "dueAt": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "notifiedAt": {
+                    "description": "NotifiedAt is set by the scheduler once the reminder has been sent.",
                     "type": "string"
+                },
+                "recurrence": {
+                    "description": "Recurrence is empty for a one-off task, otherwise one of \"daily\",\n\"weekly\", \"monthly\" or \"yearly\". When a recurring task is done the next\noccurrence is created automatically.",
+                    "type": "string"
+                },
+                "reminderAttempts": {
+                    "description": "ReminderAttempts counts the reminders that could not be sent, the next\none is tried at ReminderRetryAt. After maxReminderAttempts the\nreminder is given up and ReminderFailedAt is set.",
+                    "type": "integer"
+                },
+                "reminderFailedAt": {
+                    "type": "string"
+                },
+                "reminderRetryAt": {
+                    "type": "string"
+                },
+                "status": {
+                    "description": "Status is one of \"open\", \"done\" or \"cancelled\".",
+                    "type": "string"
+                },
+                "title": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.TimelinePage": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Activity"
+                    }
+                },
+                "page": {
+                    "type": "integer"
+                },
+                "pageSize": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
                 }
             }
         }
     }
 }`
 
-type swaggerInfo struct {
-	Version     string
-	Host        string
-	BasePath    string
-	Schemes     []string
-	Title       string
-	Description string
-}
-
 // SwaggerInfo holds exported Swagger Info so clients can modify it
-var SwaggerInfo = swaggerInfo{
-	Version:     "1.0",
-	Host:        "localhost:8080",
-	BasePath:    "",
-	Schemes:     []string{"http"},
-	Title:       "Swagger Example API",
-	Description: "This is a sample server celler server.",
-}
-
-type s struct{}
-
-func (s *s) ReadDoc() string {
-	sInfo := SwaggerInfo
-	sInfo.Description = strings.Replace(sInfo.Description, "\n", "\\n", -1)
-
-	t, err := template.New("swagger_info").Funcs(template.FuncMap{
-		"marshal": func(v interface{}) string {
-			a, _ := json.Marshal(v)
-			return string(a)
-		},
-		"escape": func(v interface{}) string {
-			// escape tabs
-			str := strings.Replace(v.(string), "\t", "\\t", -1)
-			// replace " with \", and if that results in \\", replace that with \\\"
-			str = strings.Replace(str, "\"", "\\\"", -1)
-			return strings.Replace(str, "\\\\\"", "\\\\\\\"", -1)
-		},
-	}).Parse(doc)
-	if err != nil {
-		return doc
-	}
-
-	var tpl bytes.Buffer
-	if err := t.Execute(&tpl, sInfo); err != nil {
-		return doc
-	}
-
-	return tpl.String()
+var SwaggerInfo = &swag.Spec{
+	Version:          "1.0",
+	Host:             "localhost:8080",
+	BasePath:         "",
+	Schemes:          []string{"http"},
+	Title:            "Swagger Example API",
+	Description:      "This is a sample server celler server.",
+	InfoInstanceName: "swagger",
+	SwaggerTemplate:  docTemplate,
 }
 
 func init() {
-	swag.Register("swagger", &s{})
+	swag.Register(SwaggerInfo.InstanceName(), SwaggerInfo)
 }
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// The sensitive fields of the contacts are encrypted in the database, so a
+// dump alone does not leak them. Every value is encrypted with AES-GCM and a
+// data key of its own, the data key is encrypted with the primary key of the
+// keyring (envelope encryption). A value is stored as
+//
+//	enc:v1:<key id>:<encrypted data key>:<encrypted value>
+//
+// The fieldEncryption plugin encrypts the values before they are written and
+// decrypts them after they are read, the rest of the application sees the
+// plain values. The encrypted values cannot be compared, the equality
+// lookups use a blind index: an HMAC of the normalized value, stored in the
+// <Field>Index column.
+
+const encryptedPrefix = "enc:v1:"
+
+// Keyring is the file with the key encryption keys. Primary is the key used
+// to encrypt, the other keys can only decrypt until the rotation has
+// encrypted everything again with the primary one. IndexKey computes the
+// blind indexes, changing it requires computing them again.
+type Keyring struct {
+	Primary  string
+	Keys     map[string]string
+	IndexKey string
+}
+
+// loadedKeyring is a keyring with the keys decoded.
+type loadedKeyring struct {
+	primary  string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+func readKeyring(file string) (*Keyring, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the keyring: %w", err)
+	}
+	var keyring Keyring
+	if err := json.Unmarshal(data, &keyring); err != nil {
+		return nil, fmt.Errorf("invalid keyring file: %w", err)
+	}
+	return &keyring, nil
+}
+
+func writeKeyring(file string, keyring *Keyring) error {
+	data, err := json.MarshalIndent(keyring, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the new file replaces the old one only when it is complete
+	if err := os.WriteFile(file+".tmp", append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("cannot write the keyring: %w", err)
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func loadKeyring(file string) (*loadedKeyring, error) {
+	keyring, err := readKeyring(file)
+	if err != nil {
+		return nil, err
+	}
+	loaded := &loadedKeyring{primary: keyring.Primary, keys: make(map[string]cipher.AEAD)}
+	for id, encoded := range keyring.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id '%s' in the keyring", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("the key '%s' of the keyring is not 32 bytes in base64", id)
+		}
+		if loaded.keys[id], err = newGCM(key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := loaded.keys[keyring.Primary]; !ok {
+		return nil, fmt.Errorf("the primary key '%s' is not in the keyring", keyring.Primary)
+	}
+	loaded.indexKey, err = base64.StdEncoding.DecodeString(keyring.IndexKey)
+	if err != nil || len(loaded.indexKey) < 32 {
+		return nil, fmt.Errorf("the index key of the keyring is not at least 32 bytes in base64")
+	}
+	return loaded, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// seal encrypts the data with the AEAD and a random nonce, that is prepended.
+func seal(aead cipher.AEAD, data []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, aad), nil
+}
+
+func unseal(aead cipher.AEAD, data []byte, aad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("the encrypted data is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// encrypt encrypts the value of a field with a new data key. The name of
+// the field is authenticated, a value cannot be moved to another field.
+func (k *loadedKeyring) encrypt(field string, value string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte("data key"))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := seal(aead, []byte(value), []byte(field))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + k.primary + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(encrypted), nil
+}
+
+// decrypt returns the plain value of a field, the values that are not
+// encrypted are returned as they are.
+func (k *loadedKeyring) decrypt(field string, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid encrypted value of %s", field)
+	}
+	kek, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("the key '%s' of %s is not in the keyring", parts[0], field)
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value of %s", field)
+	}
+	encrypted, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value of %s", field)
+	}
+	dataKey, err := unseal(kek, wrapped, []byte("data key"))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt the data key of %s: %w", field, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := unseal(aead, encrypted, []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt %s: %w", field, err)
+	}
+	return string(plain), nil
+}
+
+// blindIndex is the HMAC of the normalized value, the same value gives the
+// same index without revealing it. The field is part of the HMAC, the same
+// value in two fields gives two indexes.
+func (k *loadedKeyring) blindIndex(field string, value string) string {
+	value = normalizeIndexValue(field, value)
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(field + ":" + value))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeIndexValue makes the lookups ignore the differences that do not
+// matter: the case of the emails and the formatting of the phone numbers.
+func normalizeIndexValue(field string, value string) string {
+	value = strings.TrimSpace(value)
+	switch field {
+	case "Email":
+		return strings.ToLower(value)
+	case "Phone":
+		return strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) || r == '+' {
+				return r
+			}
+			return -1
+		}, value)
+	}
+	return value
+}
+
+// encryptedModel lists the encrypted fields of a table. The rows of the
+// tables that are not rotated expire before the old keys are removed.
+type encryptedModel struct {
+	model  interface{}
+	table  string
+	fields []string
+	rotate bool
+}
+
+// fieldEncryption is the GORM plugin that encrypts the fields of the
+// contacts, and the copies of the contacts kept by the idempotency keys and
+// by the imports.
+type fieldEncryption struct {
+	keyring *loadedKeyring
+	models  []encryptedModel
+	// fields are the names of the encrypted fields of Contact.
+	fields []string
+}
+
+// encryption is the encryption of the application, nil when it is disabled.
+var encryption *fieldEncryption
+
+// newFieldEncryption loads the keyring and checks the fields, they must be
+// string fields of Contact.
+func newFieldEncryption(cfg Config) (*fieldEncryption, error) {
+	if cfg.EncryptionKeyringFile == "" {
+		return nil, nil
+	}
+	keyring, err := loadKeyring(cfg.EncryptionKeyringFile)
+	if err != nil {
+		return nil, err
+	}
+	contactType := reflect.TypeOf(Contact{})
+	for _, field := range cfg.EncryptedFields {
+		f, ok := contactType.FieldByName(field)
+		if !ok || f.Type.Kind() != reflect.String || field == "TenantID" || field == "Owner" {
+			return nil, fmt.Errorf("cannot encrypt the field '%s' of the contacts", field)
+		}
+	}
+	return &fieldEncryption{
+		keyring: keyring,
+		fields:  cfg.EncryptedFields,
+		models: []encryptedModel{
+			{&Contact{}, "contacts", cfg.EncryptedFields, true},
+			{&IdempotencyRecord{}, "idempotency_records", []string{"Body"}, false},
+			{&ImportJob{}, "import_jobs", []string{"Payload"}, true},
+		},
+	}, nil
+}
+
+func (e *fieldEncryption) Name() string {
+	return "encryption"
+}
+
+func (e *fieldEncryption) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("gorm:create").Register("encryption:encrypt_create", e.encryptValues); err != nil {
+		return err
+	}
+	if err := callbacks.Create().After("gorm:create").Register("encryption:decrypt_create", e.decryptValues); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("encryption:encrypt_update", e.encryptValues); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("encryption:decrypt_update", e.decryptValues); err != nil {
+		return err
+	}
+	return callbacks.Query().After("gorm:query").Register("encryption:decrypt_query", e.decryptValues)
+}
+
+// encryptedFields returns the encrypted fields of the table of the statement.
+func (e *fieldEncryption) encryptedFields(tx *gorm.DB) []string {
+	if tx.Error != nil || tx.Statement.Schema == nil {
+		return nil
+	}
+	for _, model := range e.models {
+		if model.table == tx.Statement.Schema.Table {
+			return model.fields
+		}
+	}
+	return nil
+}
+
+// textValue returns the value of a string or []byte field.
+func textValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+// setText sets a string or []byte field.
+func setText(ctx context.Context, field *schema.Field, target reflect.Value, text string) error {
+	if field.FieldType.Kind() == reflect.Slice {
+		return field.Set(ctx, target, []byte(text))
+	}
+	return field.Set(ctx, target, text)
+}
+
+// encryptValues encrypts the fields that are written, both in the structs
+// and in the maps of the updates, and sets their blind indexes.
+func (e *fieldEncryption) encryptValues(tx *gorm.DB) {
+	fields := e.encryptedFields(tx)
+	if len(fields) == 0 {
+		return
+	}
+	s := tx.Statement.Schema
+	if values, ok := tx.Statement.Dest.(map[string]interface{}); ok {
+		for _, name := range fields {
+			key := s.LookUpField(name).DBName
+			value, ok := values[key]
+			if !ok {
+				if value, ok = values[name]; !ok {
+					continue
+				}
+				key = name
+			}
+			text, ok := textValue(value)
+			if !ok {
+				continue
+			}
+			if index := s.LookUpField(name + "Index"); index != nil {
+				values[index.DBName] = e.keyring.blindIndex(name, text)
+			}
+			if text == "" {
+				continue
+			}
+			encrypted, err := e.keyring.encrypt(name, text)
+			if err != nil {
+				tx.AddError(err)
+				return
+			}
+			if _, isBytes := value.([]byte); isBytes {
+				values[key] = []byte(encrypted)
+			} else {
+				values[key] = encrypted
+			}
+		}
+		return
+	}
+	e.eachRow(tx, func(ctx context.Context, row reflect.Value) error {
+		for _, name := range fields {
+			field := s.LookUpField(name)
+			value, _ := field.ValueOf(ctx, row)
+			text, _ := textValue(value)
+			if index := s.LookUpField(name + "Index"); index != nil {
+				if err := index.Set(ctx, row, e.keyring.blindIndex(name, text)); err != nil {
+					return err
+				}
+			}
+			if text == "" {
+				continue
+			}
+			encrypted, err := e.keyring.encrypt(name, text)
+			if err != nil {
+				return err
+			}
+			if err := setText(ctx, field, row, encrypted); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// decryptValues decrypts the fields that are read, and the ones just
+// written, so the caller keeps the plain values.
+func (e *fieldEncryption) decryptValues(tx *gorm.DB) {
+	fields := e.encryptedFields(tx)
+	if len(fields) == 0 {
+		return
+	}
+	if _, ok := tx.Statement.Dest.(map[string]interface{}); ok {
+		return
+	}
+	s := tx.Statement.Schema
+	e.eachRow(tx, func(ctx context.Context, row reflect.Value) error {
+		for _, name := range fields {
+			field := s.LookUpField(name)
+			value, _ := field.ValueOf(ctx, row)
+			text, _ := textValue(value)
+			if !strings.HasPrefix(text, encryptedPrefix) {
+				continue
+			}
+			plain, err := e.keyring.decrypt(name, text)
+			if err != nil {
+				return err
+			}
+			if err := setText(ctx, field, row, plain); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// eachRow calls fn with every struct of the statement.
+func (e *fieldEncryption) eachRow(tx *gorm.DB, fn func(context.Context, reflect.Value) error) {
+	ctx := tx.Statement.Context
+	value := tx.Statement.ReflectValue
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			item := reflect.Indirect(value.Index(i))
+			if item.Kind() != reflect.Struct {
+				continue
+			}
+			if err := fn(ctx, item); err != nil {
+				tx.AddError(err)
+				return
+			}
+		}
+	case reflect.Struct:
+		if err := fn(ctx, value); err != nil {
+			tx.AddError(err)
+		}
+	}
+}
+
+// fieldEquals is the scope of the contacts whose field is equal to the value,
+// through the blind index when the field is encrypted.
+func fieldEquals(field string, value string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		column := "contacts." + db.NamingStrategy.ColumnName("", field)
+		if encryption == nil || !contains(encryption.fields, field) {
+			if field == "Email" {
+				return db.Where("LOWER("+column+") = ?", normalizeIndexValue(field, value))
+			}
+			return db.Where(column+" = ?", value)
+		}
+		return db.Where(column+"_index = ?", encryption.keyring.blindIndex(field, value))
+	}
+}
+
+// WORKER
+////////////////////////////////////////////////////////////////////////////////
+
+// runKeyRotation encrypts again with the primary key the values encrypted
+// with an older key, or not encrypted yet, until the context is cancelled.
+func runKeyRotation(ctx context.Context, db *gorm.DB, enc *fieldEncryption, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var count int
+		err := forAllTenants(db, func(db *gorm.DB) error {
+			var err error
+			count, err = reencrypt(db, enc)
+			return err
+		})
+		if err != nil {
+			slog.Error("cannot encrypt again with the primary key", "error", err)
+		} else if count > 0 {
+			slog.Info("rows encrypted again", "rows", count, "key", enc.keyring.primary)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// reencrypt saves again the rows that have a field not encrypted with the
+// primary key, the plugin encrypts them with it. It returns the number of
+// rows saved.
+func reencrypt(db *gorm.DB, enc *fieldEncryption) (int, error) {
+	total := 0
+	for _, model := range enc.models {
+		if !model.rotate {
+			continue
+		}
+		count, err := reencryptModel(db, enc, model)
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func reencryptModel(db *gorm.DB, enc *fieldEncryption, model encryptedModel) (int, error) {
+	// the values that do not start with the prefix of the primary key, the
+	// comparison works on the text and on the binary columns
+	current := encryptedPrefix + enc.keyring.primary + ":"
+	modelType := reflect.TypeOf(model.model).Elem()
+	var conditions []string
+	var args []interface{}
+	for _, name := range model.fields {
+		column := db.NamingStrategy.ColumnName("", name)
+		conditions = append(conditions, fmt.Sprintf("(length(%s) > 0 AND substr(%s, 1, ?) <> ?)", column, column))
+		if field, _ := modelType.FieldByName(name); field.Type.Kind() == reflect.Slice {
+			args = append(args, len(current), []byte(current))
+		} else {
+			args = append(args, len(current), current)
+		}
+	}
+	if len(conditions) == 0 {
+		return 0, nil
+	}
+
+	count := 0
+	rows := reflect.New(reflect.SliceOf(modelType))
+	result := db.Model(model.model).Select("id").Where(strings.Join(conditions, " OR "), args...).
+		FindInBatches(rows.Interface(), contactsBatchSize, func(batchTx *gorm.DB, batch int) error {
+			var ids []interface{}
+			for i := 0; i < rows.Elem().Len(); i++ {
+				ids = append(ids, rows.Elem().Index(i).FieldByName("ID").Interface())
+			}
+			// the rows are read again locked, a change made in the meanwhile
+			// is not lost
+			return db.Transaction(func(tx *gorm.DB) error {
+				locked := reflect.New(reflect.SliceOf(modelType))
+				if result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", ids).Find(locked.Interface()); result.Error != nil {
+					return result.Error
+				}
+				for i := 0; i < locked.Elem().Len(); i++ {
+					row := locked.Elem().Index(i)
+					// the plugin encrypts the values of the map and sets the
+					// blind indexes, UpdateColumns keeps the update time and
+					// skips the hooks, the contact has not changed
+					values := map[string]interface{}{}
+					for _, name := range model.fields {
+						values[name] = row.FieldByName(name).Interface()
+					}
+					if result := tx.Model(row.Addr().Interface()).UpdateColumns(values); result.Error != nil {
+						return result.Error
+					}
+					count++
+				}
+				return nil
+			})
+		})
+	if result.Error != nil {
+		return count, fmt.Errorf("cannot encrypt the %s again: %w", model.table, result.Error)
+	}
+	return count, nil
+}
+
+// COMMANDS
+////////////////////////////////////////////////////////////////////////////////
+
+// runKeyringCommand manages the keyring from the command line:
+//
+//	contact-manager keyring add     adds a new primary key, creating the file
+//	contact-manager keyring rotate  encrypts everything with the primary key
+func runKeyringCommand(db *gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: keyring add|rotate")
+	}
+	flags := flag.NewFlagSet("keyring "+args[0], flag.ContinueOnError)
+	file := flags.String("file", config.EncryptionKeyringFile, "keyring file")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("the -file flag or ENCRYPTION_KEYRING_FILE is required")
+	}
+
+	switch args[0] {
+	case "add":
+		keyring, err := readKeyring(*file)
+		if errors.Is(err, os.ErrNotExist) {
+			keyring = &Keyring{Keys: map[string]string{}}
+			if keyring.IndexKey, err = newKey(); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		key, err := newKey()
+		if err != nil {
+			return err
+		}
+		id := time.Now().UTC().Format("20060102150405")
+		keyring.Keys[id] = key
+		keyring.Primary = id
+		if err := writeKeyring(*file, keyring); err != nil {
+			return err
+		}
+		fmt.Printf("key '%s' added to %s, it is the primary key from the next start\n", id, *file)
+	case "rotate":
+		cfg := config
+		cfg.EncryptionKeyringFile = *file
+		enc, err := newFieldEncryption(cfg)
+		if err != nil {
+			return err
+		}
+		if err := db.Use(enc); err != nil {
+			return err
+		}
+		count, err := reencrypt(db, enc)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d rows encrypted with the key '%s'\n", count, enc.keyring.primary)
+	default:
+		return fmt.Errorf("unknown keyring command '%s'", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReencrypt checks that the rotation encrypts the contacts again with
+// the new primary key without changing their update time nor their blind
+// indexes.
+func TestReencrypt(t *testing.T) {
+	setupTestDB(t)
+	first, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexKey, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "keyring.json")
+	keyring := &Keyring{Primary: "k1", Keys: map[string]string{"k1": first}, IndexKey: indexKey}
+	if err := writeKeyring(file, keyring); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config
+	cfg.EncryptionKeyringFile = file
+	enc, err := newFieldEncryption(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(enc); err != nil {
+		t.Fatal(err)
+	}
+
+	scoped := db.WithContext(withTenant(context.Background(), "alpha"))
+	contact := Contact{Name: "Jane Roe", Email: "jane@example.com", Phone: "555-0100"}
+	if result := scoped.Create(&contact); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	updatedAt := time.Now().Add(-48 * time.Hour).UTC().Truncate(time.Second)
+	if result := scoped.Model(&contact).UpdateColumn("updated_at", updatedAt); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	stored := func() (email, emailIndex string, updated time.Time) {
+		t.Helper()
+		row := db.Raw("SELECT email, email_index, updated_at FROM contacts WHERE id = ?", contact.ID).Row()
+		if err := row.Scan(&email, &emailIndex, &updated); err != nil {
+			t.Fatal(err)
+		}
+		return email, emailIndex, updated
+	}
+	email, index, _ := stored()
+	if !strings.HasPrefix(email, encryptedPrefix+"k1:") {
+		t.Fatalf("the email is not encrypted with the first key: %s", email)
+	}
+
+	// a new primary key, the rotation encrypts the contact again
+	second, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring.Keys["k2"] = second
+	keyring.Primary = "k2"
+	if err := writeKeyring(file, keyring); err != nil {
+		t.Fatal(err)
+	}
+	if enc.keyring, err = loadKeyring(file); err != nil {
+		t.Fatal(err)
+	}
+	count, err := reencrypt(db, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d rows encrypted again, expected 1", count)
+	}
+	rotated, rotatedIndex, updated := stored()
+	if !strings.HasPrefix(rotated, encryptedPrefix+"k2:") {
+		t.Errorf("the email is not encrypted with the new key: %s", rotated)
+	}
+	if rotatedIndex != index {
+		t.Errorf("the blind index has changed: %s, expected %s", rotatedIndex, index)
+	}
+	if !updated.Equal(updatedAt) {
+		t.Errorf("the rotation changes the update time: %s, expected %s", updated, updatedAt)
+	}
+	var read Contact
+	if result := scoped.First(&read, contact.ID); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if read.Email != contact.Email || read.Phone != contact.Phone {
+		t.Errorf("the contact reads %s %s after the rotation", read.Email, read.Phone)
+	}
+	if count, err := reencrypt(db, enc); err != nil || count != 0 {
+		t.Errorf("the rotation encrypts again %d rows encrypted with the primary key: %v", count, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ExternalReference binds the identifier that another system, the source,
+// uses for a contact to our contact. A source identifies a contact only once
+// in a tenant.
+type ExternalReference struct {
+	ID         uint   `gorm:"primaryKey" json:"-"`
+	TenantID   string `gorm:"uniqueIndex:idx_external_reference_tenant" json:"-"`
+	Source     string `gorm:"uniqueIndex:idx_external_reference_tenant"`
+	ExternalID string `gorm:"uniqueIndex:idx_external_reference_tenant"`
+	ContactID  uint   `gorm:"index"`
+	CreatedAt  time.Time
+}
+
+const maxExternalIdLength = 255
+
+// errExternalConflict means that somebody else created the same reference
+// while we were creating it.
+var errExternalConflict = errors.New("the external reference has been created concurrently")
+
+func validateExternalReference(source string, externalId string) error {
+	if strings.TrimSpace(source) == "" || strings.TrimSpace(externalId) == "" {
+		return fmt.Errorf("the source and the external id are required")
+	}
+	if len(source) > maxExternalIdLength || len(externalId) > maxExternalIdLength {
+		return fmt.Errorf("the source and the external id must be at most %d characters", maxExternalIdLength)
+	}
+	return nil
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// UpsertContactByExternalId godoc.
+// @Summary      Create or update a contact by external id.
+// @Description  Updates the contact that the source knows with the given id, or creates
+// @Description  it together with the reference when the id is new.
+// @tags         Contact
+// @Accept       json
+// @Produce      json
+// @Param        source  path  string   true  "The system that owns the id, e.g. crm"
+// @Param        id      path  string   true  "The id of the contact in the source"
+// @Param        Body    body  Contact  true  "All the property of the contact"
+// @Success      200  {object}  Contact
+// @Success      201  {object}  Contact
+// @Router       /contacts/by-external/{source}/{id} [put]
+func upsertContactByExternalId(c *gin.Context) {
+	db := tenantDB(c)
+	var contact Contact
+	if err := c.ShouldBindJSON(&contact); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	source, externalId := c.Param("source"), c.Param("id")
+	if err := validateExternalReference(source, externalId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	contact.CreatedAt, contact.UpdatedAt = time.Time{}, time.Time{}
+	if errs := validateContact(&contact); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": strings.Join(errs, ", ")})
+		return
+	}
+	saved, created, err := upsertContactByExternalReference(db, currentPrincipal(c), source, externalId, contact)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	auditContacts(c, saved.ID)
+	renderNotes(c, saved)
+	if created {
+		c.JSON(http.StatusCreated, saved)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+// GetContactByExternalId godoc.
+// @Summary      Get a contact by external id.
+// @tags         Contact
+// @Produce      json
+// @Param        source  path   string  true   "The system that owns the id, e.g. crm"
+// @Param        id      path   string  true   "The id of the contact in the source"
+// @Param        render  query  string  false  "html adds the notes rendered to HTML"
+// @Success      200  {object}  Contact
+// @Router       /contacts/by-external/{source}/{id} [get]
+func getContactByExternalId(c *gin.Context) {
+	db := tenantDB(c)
+	source, externalId := c.Param("source"), c.Param("id")
+	contact, err := readContactByExternalReference(db, source, externalId)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), contact.ID, ShareRead); err != nil {
+		// a contact that the caller cannot see is missing, without telling
+		// its id
+		if errorStatus(err, http.StatusInternalServerError) == http.StatusNotFound {
+			err = &accessError{http.StatusNotFound, fmt.Sprintf("no contact found with external id '%s/%s'", source, externalId)}
+		}
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	auditContacts(c, contact.ID)
+	renderNotes(c, contact)
+	c.JSON(http.StatusOK, contact)
+}
+
+// ListExternalReferences godoc.
+// @Summary      Get the external ids of a contact.
+// @tags         Contact
+// @Produce      json
+// @Param 		 id  path int true "Contact ID"
+// @Success      200  {object}  []ExternalReference
+// @Router       /contacts/{id}/external-refs [get]
+func listExternalReferences(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareRead); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	refs, err := readExternalReferences(db, uint(contactId))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, refs)
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// upsertContactByExternalReference updates the contact bound to the external
+// id or creates a new one, in one transaction. It returns whether the contact
+// has been created. The principal must be able to write the existing contact.
+func upsertContactByExternalReference(db *gorm.DB, principal *Principal, source string, externalId string, contact Contact) (saved *Contact, created bool, err error) {
+	// when two requests create the same reference at the same time, the
+	// second one finds the reference at the next attempt and updates it.
+	for attempt := 0; attempt < 3; attempt++ {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var ref ExternalReference
+			result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("source = ? AND external_id = ?", source, externalId).
+				Limit(1).
+				Find(&ref)
+			if result.Error != nil {
+				return wrapDBError(result.Error, "cannot read the external reference '%s/%s'", source, externalId)
+			}
+			if result.RowsAffected == 1 {
+				if err := checkContactAccess(tx, principal, ref.ContactID, ShareWrite); err != nil {
+					return err
+				}
+				if contact.AddressBookID != 0 {
+					if err := checkBookAccess(tx, principal, contact.AddressBookID, ShareWrite); err != nil {
+						return err
+					}
+				}
+				updated, err := updateContact(tx, ref.ContactID, contact)
+				if err != nil {
+					return err
+				}
+				saved, created = updated, false
+				return nil
+			}
+
+			// a copy, the failed attempts must not change the contact
+			newContact := contact
+			newContact.ID = 0
+			if err := assignAddressBook(tx, principal, &newContact); err != nil {
+				return err
+			}
+			if err := saveContact(tx, &newContact); err != nil {
+				return err
+			}
+			ref = ExternalReference{Source: source, ExternalID: externalId, ContactID: newContact.ID}
+			result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ref)
+			if result.Error != nil {
+				return wrapDBError(result.Error, "cannot save the external reference '%s/%s'", source, externalId)
+			}
+			if result.RowsAffected != 1 {
+				return errExternalConflict
+			}
+			saved, created = &newContact, true
+			return nil
+		})
+		if !errors.Is(err, errExternalConflict) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return saved, created, nil
+}
+
+func readContactByExternalReference(db *gorm.DB, source string, externalId string) (*Contact, error) {
+	var ref ExternalReference
+	result := db.Where("source = ? AND external_id = ?", source, externalId).Limit(1).Find(&ref)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read contact with external id '%s/%s'", source, externalId)
+	}
+	if result.RowsAffected != 1 {
+		return nil, &accessError{http.StatusNotFound, fmt.Sprintf("no contact found with external id '%s/%s'", source, externalId)}
+	}
+	return readContactById(db, ref.ContactID)
+}
+
+func readExternalReferences(db *gorm.DB, contactId uint) ([]ExternalReference, error) {
+	refs := []ExternalReference{}
+	result := db.Where("contact_id = ?", contactId).Order("source, external_id").Find(&refs)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the external ids of contact with id '%d'", contactId)
+	}
+	return refs, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetContactByExternalId(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	owner := createTestAPIKey(t, "alpha", "owner", RoleEditor)
+	other := createTestAPIKey(t, "alpha", "other", RoleEditor)
+
+	var saved, read Contact
+	decodeResponse(t, testRequest(t, r, owner, "PUT", "/contacts/by-external/crm/A-12", Contact{Name: "Jane Roe"}), http.StatusCreated, &saved)
+	decodeResponse(t, testRequest(t, r, owner, "GET", "/contacts/by-external/crm/A-12", nil), http.StatusOK, &read)
+	if read.ID != saved.ID || read.Name != "Jane Roe" {
+		t.Errorf("unexpected contact %+v", read)
+	}
+
+	// the contact of another user is missing, without telling its id
+	for _, test := range []struct {
+		key, id string
+	}{
+		{owner, "B-34"},
+		{other, "A-12"},
+	} {
+		var response map[string]string
+		decodeResponse(t, testRequest(t, r, test.key, "GET", "/contacts/by-external/crm/"+test.id, nil), http.StatusNotFound, &response)
+		if response["error"] != "no contact found with external id 'crm/"+test.id+"'" {
+			t.Errorf("%s: unexpected error %q", test.id, response["error"])
+		}
+	}
+
+	// the errors of the database are not a missing contact
+	if err := db.Migrator().DropTable(&ExternalReference{}); err != nil {
+		t.Fatal(err)
+	}
+	if response := testRequest(t, r, owner, "GET", "/contacts/by-external/crm/A-12", nil); response.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d %s", response.Code, response.Body.String())
+	}
+}
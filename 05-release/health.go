@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The orchestrator asks /healthz if the process is alive, to restart it when
+// it is not, and /readyz if the instance can serve the requests, to route the
+// traffic to it. An instance is ready when its database answers and is
+// migrated, the other dependencies, the identity provider and the servers of
+// the reminders, are reported without making the instance unready: when they
+// are down the whole service is, and no instance would serve.
+
+const (
+	HealthUp       = "up"
+	HealthDown     = "down"
+	HealthReady    = "ready"
+	HealthDegraded = "degraded"
+	HealthNotReady = "unavailable"
+)
+
+// HealthReport is the state of the instance and of its components, with the
+// lower case names that the probes and the monitoring tools expect.
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+// ComponentHealth is the result of the check of a component. A critical
+// component that is down makes the instance unready.
+type ComponentHealth struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Latency  string `json:"latency"`
+	Error    string `json:"error,omitempty"`
+}
+
+// healthCheck checks a component, it returns an error when the component is
+// down.
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+// Health runs the checks of the readiness.
+type Health struct {
+	timeout time.Duration
+	checks  []healthCheck
+}
+
+// newHealth checks the database, the migrations, with the error of the
+// migrations at the start, and the dependencies of the configuration. Every
+// check has the timeout.
+func newHealth(db *gorm.DB, cfg Config, migrationErr error) *Health {
+	h := &Health{timeout: cfg.HealthTimeout}
+	h.checks = append(h.checks,
+		healthCheck{name: "database", critical: true, check: func(ctx context.Context) error {
+			sqlDB, err := db.DB()
+			if err != nil {
+				return err
+			}
+			return sqlDB.PingContext(ctx)
+		}},
+		healthCheck{name: "migrations", critical: true, check: func(context.Context) error {
+			if migrationErr != nil {
+				return fmt.Errorf("the migrations failed: %w", migrationErr)
+			}
+			return nil
+		}},
+	)
+	if cfg.OIDCIssuer != "" && !cfg.OIDCMock {
+		discovery := strings.TrimSuffix(cfg.OIDCIssuer, "/") + "/.well-known/openid-configuration"
+		h.checks = append(h.checks, healthCheck{name: "identity_provider", check: httpCheck(discovery)})
+	}
+	switch cfg.Notifier {
+	case "smtp":
+		h.checks = append(h.checks, healthCheck{name: "smtp", check: dialCheck(cfg.SMTPAddr)})
+	case "webhook":
+		if u, err := url.Parse(cfg.WebhookURL); err == nil {
+			addr := u.Host
+			if u.Port() == "" {
+				addr = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+			}
+			h.checks = append(h.checks, healthCheck{name: "webhook", check: dialCheck(addr)})
+		}
+	}
+	return h
+}
+
+// httpCheck expects a successful answer to a GET of the URL.
+func httpCheck(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			return fmt.Errorf("%s answers %s", url, response.Status)
+		}
+		return nil
+	}
+}
+
+// dialCheck expects the server to accept a TCP connection.
+func dialCheck(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// report runs the checks at the same time and collects their results.
+func (h *Health) report(ctx context.Context) HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	report := HealthReport{Status: HealthReady, Components: map[string]ComponentHealth{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range h.checks {
+		wg.Add(1)
+		go func(check healthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := check.check(ctx)
+			component := ComponentHealth{
+				Status:   HealthUp,
+				Critical: check.critical,
+				Latency:  time.Since(start).Round(time.Microsecond).String(),
+			}
+			if err != nil {
+				component.Status = HealthDown
+				component.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[check.name] = component
+		}(check)
+	}
+	wg.Wait()
+	for _, component := range report.Components {
+		if component.Status == HealthUp {
+			continue
+		}
+		if component.Critical {
+			report.Status = HealthNotReady
+			break
+		}
+		report.Status = HealthDegraded
+	}
+	return report
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// Liveness godoc.
+// @Summary      Liveness of the instance.
+// @Description  Answers as long as the process serves the requests, it does not check the
+// @Description  dependencies.
+// @tags         Health
+// @Produce      json
+// @Success      200  {object}  map[string]string
+// @Router       /healthz [get]
+func liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": HealthUp})
+}
+
+// Readiness godoc.
+// @Summary      Readiness of the instance.
+// @Description  Checks the database, the migrations and the other dependencies. The instance
+// @Description  is unavailable, with the status 503, when a critical component is down, and
+// @Description  degraded when another one is.
+// @tags         Health
+// @Produce      json
+// @Success      200  {object}  HealthReport
+// @Failure      503  {object}  HealthReport
+// @Router       /readyz [get]
+func readiness(h *Health) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := h.report(c.Request.Context())
+		status := http.StatusOK
+		if report.Status == HealthNotReady {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, report)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyRecord stores the response given to a request with an
+// Idempotency-Key header, so a retry of the same request gets the same
+// response instead of repeating the operation.
+type IdempotencyRecord struct {
+	// Key is the Idempotency-Key header, scoped to the tenant, the caller,
+	// the method and the path.
+	Key         string `gorm:"primaryKey"`
+	TenantID    string `gorm:"index" json:"-"`
+	RequestHash string
+	// Status is zero while the first request is still running.
+	Status      int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey is the longest key accepted.
+const maxIdempotencyKey = 255
+
+// responseRecorder keeps a copy of the body written by the handlers.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent makes a route safe to retry. When the request has an
+// Idempotency-Key header the response is stored for the configured window:
+// a retry with the same key and the same body gets the stored response, a
+// retry with a different body is refused with 422. Requests without the
+// header are not affected.
+func idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := tenantDB(c)
+		key := c.GetHeader(idempotencyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "the Idempotency-Key is too long"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		now := time.Now()
+		record := IdempotencyRecord{
+			Key:         currentTenant(c) + " " + currentPrincipal(c).Subject + " " + c.Request.Method + " " + c.FullPath() + " " + key,
+			RequestHash: hex.EncodeToString(hash[:]),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(config.IdempotencyTTL),
+		}
+		existing, err := claimIdempotencyKey(db, &record, now)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+					"error": "the Idempotency-Key has already been used with a different request",
+				})
+			case existing.Status == 0:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+					"error": "a request with the same Idempotency-Key is still running",
+				})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.Status, existing.ContentType, existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		// the key is released when the handler panics, writes nothing or
+		// answers with a server error, the client can retry with the same
+		// key. The recovery of the panics runs after this middleware.
+		stored := false
+		defer func() {
+			if !stored {
+				releaseIdempotencyKey(db, record.Key)
+			}
+		}()
+		c.Next()
+
+		if !recorder.Written() || recorder.Status() >= http.StatusInternalServerError {
+			return
+		}
+		stored = true
+		record.Status = recorder.Status()
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.Body = recorder.body.Bytes()
+		if err := saveIdempotencyResponse(db, &record); err != nil {
+			slog.ErrorContext(c.Request.Context(), "cannot save the idempotent response", "error", err)
+		}
+	}
+}
+
+// runIdempotencyCleaner deletes the expired keys until the context is
+// cancelled.
+func runIdempotencyCleaner(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := forAllTenants(db, func(db *gorm.DB) error {
+				return db.Where("expires_at < ?", time.Now()).Delete(IdempotencyRecord{}).Error
+			})
+			if err != nil {
+				slog.Error("cannot delete the expired idempotency keys", "error", err)
+			}
+		}
+	}
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// claimIdempotencyKey stores the key of a new request. When the key is
+// already in use it returns the record of the first request.
+func claimIdempotencyKey(db *gorm.DB, record *IdempotencyRecord, now time.Time) (*IdempotencyRecord, error) {
+	// an expired key can be used again
+	result := db.Where("key = ? AND expires_at < ?", record.Key, now).Delete(IdempotencyRecord{})
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot delete the expired idempotency key")
+	}
+	result = db.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot save the idempotency key")
+	}
+	if result.RowsAffected == 1 {
+		return nil, nil
+	}
+	var existing IdempotencyRecord
+	if result := db.First(&existing, "key = ?", record.Key); result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the idempotency key")
+	}
+	return &existing, nil
+}
+
+func saveIdempotencyResponse(db *gorm.DB, record *IdempotencyRecord) error {
+	result := db.Model(IdempotencyRecord{}).
+		Where("key = ?", record.Key).
+		Updates(map[string]interface{}{
+			"status":       record.Status,
+			"content_type": record.ContentType,
+			"body":         record.Body,
+		})
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot save the response of the idempotency key")
+	}
+	return nil
+}
+
+func releaseIdempotencyKey(db *gorm.DB, key string) {
+	if result := db.Where("key = ?", key).Delete(IdempotencyRecord{}); result.Error != nil {
+		slog.ErrorContext(db.Statement.Context, "cannot release the idempotency key", "error", result.Error)
+	}
+}
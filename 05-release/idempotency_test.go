@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotentRequest sends a request with the Idempotency-Key header.
+func idempotentRequest(r http.Handler, path string, key string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+	request.Header.Set(idempotencyHeader, key)
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestIdempotent(t *testing.T) {
+	setupTestDB(t)
+	calls := 0
+	started, finish := make(chan struct{}), make(chan struct{})
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.POST("/create", idempotent(), func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusCreated, gin.H{"call": calls})
+	})
+	r.POST("/slow", idempotent(), func(c *gin.Context) {
+		close(started)
+		<-finish
+		c.Status(http.StatusAccepted)
+		c.Writer.WriteHeaderNow()
+	})
+	r.POST("/panic", idempotent(), func(c *gin.Context) {
+		calls++
+		if calls == 1 {
+			panic("the handler failed")
+		}
+		c.JSON(http.StatusCreated, gin.H{"call": calls})
+	})
+
+	// a retry gets the stored response
+	first := idempotentRequest(r, "/create", "one", `{"Name": "Jane"}`)
+	replay := idempotentRequest(r, "/create", "one", `{"Name": "Jane"}`)
+	if first.Code != http.StatusCreated || replay.Code != http.StatusCreated ||
+		replay.Body.String() != first.Body.String() || replay.Header().Get("Idempotent-Replayed") != "true" || calls != 1 {
+		t.Errorf("the response is not replayed: %d %s, %d %s, %d calls",
+			first.Code, first.Body.String(), replay.Code, replay.Body.String(), calls)
+	}
+	// the same key with another request
+	if response := idempotentRequest(r, "/create", "one", `{"Name": "John"}`); response.Code != http.StatusUnprocessableEntity || calls != 1 {
+		t.Errorf("expected 422, got %d %s", response.Code, response.Body.String())
+	}
+
+	// a retry while the first request is running
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- idempotentRequest(r, "/slow", "two", "")
+	}()
+	<-started
+	if response := idempotentRequest(r, "/slow", "two", ""); response.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d %s", response.Code, response.Body.String())
+	}
+	close(finish)
+	if response := <-done; response.Code != http.StatusAccepted {
+		t.Errorf("expected 202, got %d %s", response.Code, response.Body.String())
+	}
+
+	// the key of a request that panics can be used again
+	calls = 0
+	if response := idempotentRequest(r, "/panic", "three", ""); response.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d %s", response.Code, response.Body.String())
+	}
+	if response := idempotentRequest(r, "/panic", "three", ""); response.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("the key of the panicked request is not released: %d %s", response.Code, response.Body.String())
+	}
+}
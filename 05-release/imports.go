@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ImportJob is the import of a file of contacts that runs in background.
+// The file is stored with the job, so an import interrupted by a restart
+// resumes from the last committed batch.
+type ImportJob struct {
+	ID       uint   `gorm:"primaryKey"`
+	TenantID string `gorm:"index" json:"-"`
+	// Format is one of "csv", "vcard" or "json".
+	Format string
+	// Options of the CSV files, see the CSV import.
+	Preset   string
+	Mapping  string
+	Encoding string
+	// Status is one of "queued", "running", "completed", "failed" or
+	// "cancelled".
+	Status string `gorm:"index"`
+	// Message explains why the job failed.
+	Message string
+	// CreatedBy is the subject of the caller that started the import, it
+	// owns the imported contacts. Only the admins see the imports of the
+	// other users.
+	CreatedBy string `gorm:"index"`
+	// AddressBookID is the book of the imported contacts.
+	AddressBookID uint
+	// Total is the number of records in the file, Processed the records
+	// already handled, that are Imported or Failed.
+	Total      int
+	Processed  int
+	Imported   int
+	Failed     int
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	FinishedAt *time.Time
+	// Hash identifies the file and the options. Sending again the same file
+	// returns the same job instead of importing the contacts twice.
+	Hash    string `gorm:"index" json:"-"`
+	Payload []byte `json:"-"`
+}
+
+// ImportJobError is a record of an imported file that was not valid.
+type ImportJobError struct {
+	ID          uint   `gorm:"primaryKey" json:"-"`
+	TenantID    string `gorm:"index" json:"-"`
+	ImportJobID uint   `gorm:"index" json:"-"`
+	Row         int
+	Errors      string
+}
+
+// ImportJobReport is the state of a job with a page of its errors.
+type ImportJobReport struct {
+	ImportJob
+	Errors   []ImportJobError
+	Page     int
+	PageSize int
+}
+
+const (
+	ImportQueued    = "queued"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+	ImportCancelled = "cancelled"
+)
+
+const importBatchSize = 500
+
+var errImportCancelled = errors.New("the import has been cancelled")
+
+// importWake wakes up the import worker when a new job is queued.
+var importWake = make(chan struct{}, 1)
+
+// parseImport reads all the records of the file of a job.
+func parseImport(job *ImportJob) ([]ImportRecord, error) {
+	text, _, err := decodeText(job.Payload, job.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	switch job.Format {
+	case "csv":
+		columns, err := presetMapping(job.Preset, job.Mapping, false)
+		if err != nil {
+			return nil, err
+		}
+		return parseContactsCSV(text, columns)
+	case "vcard":
+		return parseVCards(text)
+	case "json":
+		return parseContactsJSON(text)
+	}
+	return nil, fmt.Errorf("unknown format '%s'", job.Format)
+}
+
+// parseContactsJSON reads a JSON array of contacts. Row is the position of
+// the contact in the array, starting from 1.
+func parseContactsJSON(text string) ([]ImportRecord, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(text), &items); err != nil {
+		return nil, fmt.Errorf("the file must be a JSON array of contacts: %w", err)
+	}
+	records := make([]ImportRecord, len(items))
+	for i, item := range items {
+		records[i].Row = i + 1
+		if err := json.Unmarshal(item, &records[i].Contact); err != nil {
+			records[i].Errors = []string{err.Error()}
+			continue
+		}
+		records[i].Contact.ID = 0
+		records[i].Contact.CreatedAt, records[i].Contact.UpdatedAt = time.Time{}, time.Time{}
+		records[i].Errors = validateContact(&records[i].Contact)
+	}
+	return records, nil
+}
+
+// importFormat returns the format of the uploaded file, from the format
+// parameter or from the content type.
+func importFormat(c *gin.Context) (string, error) {
+	format := formParam(c, "format", "")
+	if format == "" {
+		switch c.ContentType() {
+		case "text/csv":
+			format = "csv"
+		case "text/vcard", "text/x-vcard", "text/directory":
+			format = "vcard"
+		case "application/json":
+			format = "json"
+		}
+	}
+	switch format {
+	case "csv", "vcard", "json":
+		return format, nil
+	case "":
+		return "", fmt.Errorf("the format parameter is required")
+	}
+	return "", fmt.Errorf("unknown format '%s'", format)
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// CreateImport godoc.
+// @Summary      Start an import.
+// @Description  Queues the import of a CSV, vCard or JSON file of contacts. The file is the
+// @Description  body of the request or the "file" field of a form. Sending the same file
+// @Description  again returns the job already created.
+// @tags         Import
+// @Accept       text/csv
+// @Accept       text/vcard
+// @Accept       application/json
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        format    query  string  false  "csv, vcard or json, by default from the content type"
+// @Param        preset    query  string  false  "CSV only: default, google or outlook"
+// @Param        mapping   query  string  false  "CSV only: JSON object from column to field"
+// @Param        encoding  query  string  false  "utf-8, utf-16, utf-16le, utf-16be or windows-1252, detected by default"
+// @Param        book      query  int     false  "Address book of the contacts, the personal book by default"
+// @Success      200  {object}  ImportJob
+// @Success      202  {object}  ImportJob
+// @Router       /imports [post]
+func createImport(c *gin.Context) {
+	db := tenantDB(c)
+	format, err := importFormat(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	target, err := importTarget(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	data, err := readUpload(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	job := ImportJob{
+		Format:        format,
+		Encoding:      formParam(c, "encoding", ""),
+		Status:        ImportQueued,
+		CreatedBy:     target.Owner,
+		AddressBookID: target.AddressBookID,
+		Payload:       data,
+	}
+	// the options are checked now, so a wrong request fails immediately
+	if format == "csv" {
+		job.Preset = formParam(c, "preset", "default")
+		job.Mapping = formParam(c, "mapping", "")
+		if _, err := presetMapping(job.Preset, job.Mapping, false); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if _, _, err := decodeText(data, job.Encoding); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash := sha256.New()
+	book := strconv.FormatUint(uint64(job.AddressBookID), 10)
+	for _, value := range []string{job.CreatedBy, book, job.Format, job.Preset, job.Mapping, job.Encoding} {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	hash.Write(data)
+	job.Hash = hex.EncodeToString(hash.Sum(nil))
+
+	existing, created, err := saveImportJob(db, &job)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/imports/%d", existing.ID))
+	if !created {
+		c.JSON(http.StatusOK, existing)
+		return
+	}
+	select {
+	case importWake <- struct{}{}:
+	default:
+	}
+	c.JSON(http.StatusAccepted, existing)
+}
+
+// GetImport godoc.
+// @Summary      Get the state of an import.
+// @Description  Returns the progress of an import and a page of the records that were not valid.
+// @tags         Import
+// @Produce      json
+// @Param 		 id         path   int  true   "Import ID"
+// @Param        page       query  int  false  "Page of the errors, starting from 1"
+// @Param        page_size  query  int  false  "Number of errors in a page, 20 by default"
+// @Success      200  {object}  ImportJobReport
+// @Router       /imports/{id} [get]
+func getImportById(c *gin.Context) {
+	db := tenantDB(c)
+	jobId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	page, pageSize, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := readImportReport(db, currentPrincipal(c), uint(jobId), page, pageSize)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// ListImports godoc.
+// @Summary      Get the imports.
+// @tags         Import
+// @Produce      json
+// @Success      200  {object}  []ImportJob
+// @Router       /imports [get]
+func listImports(c *gin.Context) {
+	db := tenantDB(c)
+	jobs, err := readImportJobs(db, currentPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// CancelImport godoc.
+// @Summary      Cancel an import.
+// @Description  Stops a queued or running import. The batches already committed are kept.
+// @tags         Import
+// @Param 		 id  path int true "Import ID"
+// @Success      200  {object}  ImportJob
+// @Router       /imports/{id} [delete]
+func cancelImportById(c *gin.Context) {
+	db := tenantDB(c)
+	jobId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	job, err := cancelImportJob(db, currentPrincipal(c), uint(jobId))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// WORKER
+////////////////////////////////////////////////////////////////////////////////
+
+// runImportWorker runs the queued imports, one at time, until the context is
+// cancelled. The jobs that were running when the application stopped are
+// queued again and resume from their last committed batch.
+func runImportWorker(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	if err := forAllTenants(db, requeueRunningImports); err != nil {
+		slog.Error("cannot requeue the running imports", "error", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// the jobs of all the tenants are claimed, each one runs in the
+		// tenant of the job
+		err := forAllTenants(db, func(db *gorm.DB) error {
+			for ctx.Err() == nil {
+				job, err := claimImportJob(db)
+				if err != nil || job == nil {
+					return err
+				}
+				runImportJob(ctx, db, job)
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("cannot claim an import", "error", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-importWake:
+		}
+	}
+}
+
+func runImportJob(ctx context.Context, db *gorm.DB, job *ImportJob) {
+	// the contacts and the errors belong to the tenant of the job, the batch
+	// in progress is committed when the application stops, the context is
+	// only checked between the batches
+	db = db.WithContext(withTenant(context.WithoutCancel(ctx), job.TenantID))
+	records, err := parseImport(job)
+	if err != nil {
+		finishImportJob(db, job.ID, ImportFailed, err.Error())
+		return
+	}
+	for i := range records {
+		records[i].Contact.Owner = job.CreatedBy
+		records[i].Contact.AddressBookID = job.AddressBookID
+	}
+	if err := setImportTotal(db, job.ID, len(records)); err != nil {
+		slog.Error("cannot start the import", "import", job.ID, "error", err)
+		return
+	}
+
+	for start := job.Processed; start < len(records); start += importBatchSize {
+		if ctx.Err() != nil {
+			// the application is stopping, the job stays running and it
+			// will be resumed at the next start.
+			return
+		}
+		end := start + importBatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		err := commitImportBatch(db, job.ID, start, records[start:end])
+		if errors.Is(err, errImportCancelled) {
+			return
+		}
+		if err != nil {
+			finishImportJob(db, job.ID, ImportFailed, err.Error())
+			return
+		}
+	}
+	finishImportJob(db, job.ID, ImportCompleted, "")
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// saveImportJob creates the job, unless the same file is already imported or
+// being imported. It returns the job and whether it has been created.
+func saveImportJob(db *gorm.DB, job *ImportJob) (*ImportJob, bool, error) {
+	var existing ImportJob
+	result := db.Omit("Payload").
+		Where("hash = ? AND status IN ?", job.Hash, []string{ImportQueued, ImportRunning, ImportCompleted}).
+		Limit(1).
+		Find(&existing)
+	if result.Error != nil {
+		return nil, false, wrapDBError(result.Error, "cannot read the imports")
+	}
+	if result.RowsAffected == 1 {
+		return &existing, false, nil
+	}
+	if result := db.Create(job); result.Error != nil {
+		return nil, false, wrapDBError(result.Error, "error saving import")
+	}
+	return job, true, nil
+}
+
+// ownImportJobs restricts a query on the imports to the ones started by the
+// principal, the admins see all of them.
+func ownImportJobs(principal *Principal) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if principal.hasRole(RoleAdmin) {
+			return tx
+		}
+		return tx.Where("created_by = ?", principal.Subject)
+	}
+}
+
+func readImportJobs(db *gorm.DB, principal *Principal) ([]ImportJob, error) {
+	var jobs []ImportJob
+	result := db.Scopes(ownImportJobs(principal)).Omit("Payload").Order("id DESC").Find(&jobs)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot list imports")
+	}
+	return jobs, nil
+}
+
+func readImportReport(db *gorm.DB, principal *Principal, jobId uint, page int, pageSize int) (*ImportJobReport, error) {
+	report := ImportJobReport{Errors: []ImportJobError{}, Page: page, PageSize: pageSize}
+	result := db.Scopes(ownImportJobs(principal)).Omit("Payload").First(&report.ImportJob, ImportJob{ID: jobId})
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, wrapDBError(result.Error, "cannot read import with id '%d'", jobId)
+	}
+	if result.RowsAffected != 1 {
+		return nil, &accessError{http.StatusNotFound, fmt.Sprintf("no import found with id '%d'", jobId)}
+	}
+	result = db.Where("import_job_id = ?", jobId).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: "row"}}).
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&report.Errors)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the errors of import with id '%d'", jobId)
+	}
+	return &report, nil
+}
+
+func cancelImportJob(db *gorm.DB, principal *Principal, jobId uint) (*ImportJob, error) {
+	result := db.Model(ImportJob{}).
+		Scopes(ownImportJobs(principal)).
+		Where("id = ? AND status IN ?", jobId, []string{ImportQueued, ImportRunning}).
+		Updates(map[string]interface{}{"status": ImportCancelled, "finished_at": time.Now()})
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot cancel import with id '%d'", jobId)
+	}
+	var job ImportJob
+	read := db.Scopes(ownImportJobs(principal)).Omit("Payload").Limit(1).Find(&job, ImportJob{ID: jobId})
+	if read.Error != nil {
+		return nil, wrapDBError(read.Error, "cannot read import with id '%d'", jobId)
+	}
+	if read.RowsAffected != 1 {
+		return nil, &accessError{http.StatusNotFound, fmt.Sprintf("no import found with id '%d'", jobId)}
+	}
+	if result.RowsAffected != 1 {
+		return nil, &accessError{http.StatusConflict, fmt.Sprintf("import with id '%d' is not queued or running", jobId)}
+	}
+	return &job, nil
+}
+
+func requeueRunningImports(db *gorm.DB) error {
+	result := db.Model(ImportJob{}).
+		Where("status = ?", ImportRunning).
+		Update("status", ImportQueued)
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot resume the imports")
+	}
+	return nil
+}
+
+// claimImportJob takes the oldest queued job and marks it as running. It
+// returns nil when there is nothing to do.
+func claimImportJob(db *gorm.DB) (*ImportJob, error) {
+	for {
+		var job ImportJob
+		result := db.Where("status = ?", ImportQueued).Order("id").Limit(1).Find(&job)
+		if result.Error != nil {
+			return nil, wrapDBError(result.Error, "cannot read the queued imports")
+		}
+		if result.RowsAffected == 0 {
+			return nil, nil
+		}
+		result = db.Model(ImportJob{}).
+			Where("id = ? AND status = ?", job.ID, ImportQueued).
+			Update("status", ImportRunning)
+		if result.Error != nil {
+			return nil, wrapDBError(result.Error, "cannot start import with id '%d'", job.ID)
+		}
+		// somebody else took or cancelled the job, try the next one
+		if result.RowsAffected == 1 {
+			job.Status = ImportRunning
+			return &job, nil
+		}
+	}
+}
+
+func setImportTotal(db *gorm.DB, jobId uint, total int) error {
+	result := db.Model(ImportJob{}).Where("id = ?", jobId).Update("total", total)
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot update import with id '%d'", jobId)
+	}
+	return nil
+}
+
+// commitImportBatch saves the valid contacts and the errors of a batch and
+// moves the progress of the job forward, in one transaction. A batch is
+// either fully imported or not at all, so a resumed job never imports a
+// contact twice.
+func commitImportBatch(db *gorm.DB, jobId uint, start int, records []ImportRecord) error {
+	contacts, rowErrors := splitRecords(records)
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(ImportJob{}).
+			Where("id = ? AND status = ? AND processed = ?", jobId, ImportRunning, start).
+			Updates(map[string]interface{}{
+				"processed": start + len(records),
+				"imported":  gorm.Expr("imported + ?", len(contacts)),
+				"failed":    gorm.Expr("failed + ?", len(rowErrors)),
+			})
+		if result.Error != nil {
+			return wrapDBError(result.Error, "cannot update import with id '%d'", jobId)
+		}
+		if result.RowsAffected != 1 {
+			return errImportCancelled
+		}
+		if len(contacts) > 0 {
+			if result := tx.CreateInBatches(&contacts, contactsBatchSize); result.Error != nil {
+				return wrapDBError(result.Error, "error saving contacts")
+			}
+		}
+		if len(rowErrors) > 0 {
+			jobErrors := make([]ImportJobError, len(rowErrors))
+			for i, rowError := range rowErrors {
+				jobErrors[i] = ImportJobError{
+					ImportJobID: jobId,
+					Row:         rowError.Row,
+					Errors:      strings.Join(rowError.Errors, ", "),
+				}
+			}
+			if result := tx.Create(&jobErrors); result.Error != nil {
+				return wrapDBError(result.Error, "error saving the errors of import with id '%d'", jobId)
+			}
+		}
+		return nil
+	})
+}
+
+func finishImportJob(db *gorm.DB, jobId uint, status string, message string) {
+	result := db.Model(ImportJob{}).
+		Where("id = ? AND status = ?", jobId, ImportRunning).
+		Updates(map[string]interface{}{"status": status, "message": message, "finished_at": time.Now()})
+	if result.Error != nil {
+		slog.Error("cannot finish the import", "import", jobId, "error", result.Error)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestResumeImport checks that a job interrupted by a restart continues from
+// the last committed batch, without importing its contacts twice.
+func TestResumeImport(t *testing.T) {
+	setupTestDB(t)
+	scoped := db.WithContext(withTenant(context.Background(), "alpha"))
+
+	// the first contact was committed before the restart
+	job := ImportJob{
+		Format:    "json",
+		Status:    ImportRunning,
+		CreatedBy: "apikey:sync",
+		Total:     3,
+		Processed: 1,
+		Imported:  1,
+		Payload:   []byte(`[{"Name": "first"}, {"Name": "second"}, {"Name": "third", "Email": "not valid"}]`),
+	}
+	if result := scoped.Create(&job); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result := scoped.Create(&Contact{Name: "first", Owner: job.CreatedBy}); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	if claimed, err := claimImportJob(scoped); err != nil || claimed != nil {
+		t.Fatalf("a running job is claimed again: %v %v", claimed, err)
+	}
+	if err := requeueRunningImports(scoped); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := claimImportJob(scoped)
+	if err != nil || claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("the requeued job is not claimed: %v %v", claimed, err)
+	}
+	runImportJob(context.Background(), db, claimed)
+
+	var finished ImportJob
+	if result := scoped.First(&finished, job.ID); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if finished.Status != ImportCompleted || finished.Processed != 3 || finished.Imported != 2 || finished.Failed != 1 {
+		t.Errorf("unexpected job %+v", finished)
+	}
+	var names []string
+	scoped.Model(Contact{}).Order("id").Pluck("name", &names)
+	if len(names) != 2 || names[0] != "first" || names[1] != "second" {
+		t.Errorf("unexpected contacts %v", names)
+	}
+	var jobErrors []ImportJobError
+	scoped.Where("import_job_id = ?", job.ID).Find(&jobErrors)
+	if len(jobErrors) != 1 || jobErrors[0].Row != 3 {
+		t.Errorf("unexpected errors %+v", jobErrors)
+	}
+}
+
+func TestImportStatus(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	owner := createTestAPIKey(t, "alpha", "owner", RoleEditor)
+	other := createTestAPIKey(t, "alpha", "other", RoleEditor)
+	var job ImportJob
+	decodeResponse(t, testRequest(t, r, owner, "POST", "/imports/?format=json", `[{"Name": "imported"}]`), http.StatusAccepted, &job)
+	path := fmt.Sprintf("/imports/%d", job.ID)
+
+	for _, test := range []struct {
+		key, method, path string
+		status            int
+	}{
+		{owner, "GET", path, http.StatusOK},
+		{owner, "GET", "/imports/999", http.StatusNotFound},
+		{other, "GET", path, http.StatusNotFound},
+		{owner, "DELETE", "/imports/999", http.StatusNotFound},
+		{other, "DELETE", path, http.StatusNotFound},
+		{owner, "DELETE", path, http.StatusOK},
+		{owner, "DELETE", path, http.StatusConflict},
+	} {
+		if response := testRequest(t, r, test.key, test.method, test.path, nil); response.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d %s", test.method, test.path, test.status, response.Code, response.Body.String())
+		}
+	}
+
+	// the errors of the database are not a missing import
+	if err := db.Migrator().DropTable(&ImportJobError{}); err != nil {
+		t.Fatal(err)
+	}
+	if response := testRequest(t, r, owner, "GET", path, nil); response.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d %s", response.Code, response.Body.String())
+	}
+}
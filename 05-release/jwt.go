@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// The bearer tokens are JSON Web Tokens signed either with a shared secret
+// (HS256, HS384, HS512) or with one of the public keys of a JWKS file
+// (RS256, RS384, RS512, ES256, ES384, ES512).
+
+// jwtVerifier checks the signature and the claims of the tokens.
+type jwtVerifier struct {
+	secret   []byte
+	keys     map[string]interface{}
+	issuer   string
+	audience string
+	leeway   time.Duration
+}
+
+// jwtClaims are the claims of a valid token.
+type jwtClaims map[string]interface{}
+
+var errInvalidToken = errors.New("invalid token")
+
+// errUnknownKey is returned when no key has the kid of the token.
+var errUnknownKey = errors.New("unknown token key")
+
+func newJWTVerifier(cfg Config) (*jwtVerifier, error) {
+	verifier := &jwtVerifier{
+		secret:   []byte(cfg.JWTSecret),
+		keys:     make(map[string]interface{}),
+		issuer:   cfg.JWTIssuer,
+		audience: cfg.JWTAudience,
+		leeway:   cfg.JWTLeeway,
+	}
+	if cfg.JWTJWKSFile != "" {
+		data, err := os.ReadFile(cfg.JWTJWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the JWKS file: %w", err)
+		}
+		if verifier.keys, err = parseJWKS(data); err != nil {
+			return nil, err
+		}
+	}
+	return verifier, nil
+}
+
+// enabled reports if a secret or some keys are configured, without them no
+// token can be valid.
+func (v *jwtVerifier) enabled() bool {
+	return len(v.secret) > 0 || len(v.keys) > 0
+}
+
+// jwk is a key of a JWKS file, only the fields of the RSA and EC public keys
+// are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS file: %w", err)
+	}
+	keys := make(map[string]interface{})
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch key.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(key.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(key.E)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid RSA key '%s' in the JWKS file", key.Kid)
+			}
+			keys[key.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch key.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve '%s' in the JWKS file", key.Crv)
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(key.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(key.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid EC key '%s' in the JWKS file", key.Kid)
+			}
+			keys[key.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
+
+// verify checks the token and returns its claims.
+func (v *jwtVerifier) verify(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if err := v.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if err := v.verifyClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (v *jwtVerifier) verifySignature(alg string, kid string, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported token algorithm '%s'", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm '%s'", alg)
+	}
+
+	// the family of the algorithm must match the kind of the key, a public
+	// key is never used as a HMAC secret.
+	switch alg[:2] {
+	case "HS":
+		if len(v.secret) == 0 {
+			return fmt.Errorf("unsupported token algorithm '%s'", alg)
+		}
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errInvalidToken
+		}
+		return nil
+	case "RS":
+		key, ok := v.keys[kid].(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w '%s'", errUnknownKey, kid)
+		}
+		digest := hash.New()
+		digest.Write([]byte(signed))
+		if rsa.VerifyPKCS1v15(key, hash, digest.Sum(nil), signature) != nil {
+			return errInvalidToken
+		}
+		return nil
+	case "ES":
+		key, ok := v.keys[kid].(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w '%s'", errUnknownKey, kid)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errInvalidToken
+		}
+		digest := hash.New()
+		digest.Write([]byte(signed))
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest.Sum(nil), r, s) {
+			return errInvalidToken
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported token algorithm '%s'", alg)
+}
+
+func (v *jwtVerifier) verifyClaims(claims jwtClaims, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("the token has no expiration")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return fmt.Errorf("the token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("the token is not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return fmt.Errorf("the token has a wrong issuer")
+	}
+	if v.audience != "" && !contains(claims.stringList("aud"), v.audience) {
+		return fmt.Errorf("the token has a wrong audience")
+	}
+	if claims.stringValue("sub") == "" {
+		return fmt.Errorf("the token has no subject")
+	}
+	return nil
+}
+
+func (c jwtClaims) stringValue(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// stringList reads a claim that is either a string or a list of strings.
+func (c jwtClaims) stringList(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signTestJWT returns a token with the header and the claims, signed by the
+// function.
+func signTestJWT(t *testing.T, header map[string]interface{}, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	var parts []string
+	for _, part := range []map[string]interface{}{header, claims} {
+		data, err := json.Marshal(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+	signed := strings.Join(parts, ".")
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+// signHS256 signs with the secret.
+func signHS256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	secret := []byte("a secret of the tests")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": %q, "e": %q},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q}]}`,
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()))
+	keys, err := parseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &jwtVerifier{secret: secret, keys: keys, issuer: "https://idp.example.com", audience: "contacts", leeway: time.Minute}
+	// the verifier of the public keys only, a token cannot use them as a
+	// HMAC secret
+	publicOnly := &jwtVerifier{keys: keys, leeway: time.Minute}
+	publicKey, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://idp.example.com",
+			"aud": "contacts",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+
+	for _, test := range []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		valid    bool
+	}{
+		{"HS256", verifier, signTestJWT(t, hs256, claims(nil), signHS256(secret)), true},
+		{"RS256", verifier, signTestJWT(t, rs256, claims(nil), signRS256(t, rsaKey)), true},
+		{"ES256", verifier, signTestJWT(t, map[string]interface{}{"alg": "ES256", "kid": "ec"}, claims(nil), signES256(t, ecKey)), true},
+
+		// the algorithm is the one of the key
+		{"alg none", verifier, signTestJWT(t, map[string]interface{}{"alg": "none"}, claims(nil), func([]byte) []byte { return nil }), false},
+		{"HS256 with the RSA key", publicOnly, signTestJWT(t, hs256, claims(nil), signHS256(publicKey)), false},
+		{"HS256 with the RSA key as secret", verifier, signTestJWT(t, hs256, claims(nil), signHS256(publicKey)), false},
+		{"RS256 with the EC key", verifier, signTestJWT(t, map[string]interface{}{"alg": "RS256", "kid": "ec"}, claims(nil), signES256(t, ecKey)), false},
+		{"unknown kid", verifier, signTestJWT(t, map[string]interface{}{"alg": "RS256", "kid": "other"}, claims(nil), signRS256(t, rsaKey)), false},
+		{"bad signature", verifier, signTestJWT(t, hs256, claims(nil), signHS256([]byte("another secret"))), false},
+		{"changed claims", verifier, func() string {
+			token := signTestJWT(t, hs256, claims(nil), signHS256(secret))
+			parts := strings.Split(token, ".")
+			parts[1] = strings.Split(signTestJWT(t, hs256, claims(map[string]interface{}{"sub": "mallory"}), signHS256(secret)), ".")[1]
+			return strings.Join(parts, ".")
+		}(), false},
+		{"not a JWT", verifier, "a.b", false},
+
+		// the times, with the leeway
+		{"no exp", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"exp": nil}), signHS256(secret)), false},
+		{"expired", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}), signHS256(secret)), false},
+		{"expired within the leeway", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}), signHS256(secret)), true},
+		{"not valid yet", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}), signHS256(secret)), false},
+		{"not valid yet within the leeway", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}), signHS256(secret)), true},
+
+		// the issuer, the audience and the subject
+		{"wrong issuer", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"iss": "https://other.example.com"}), signHS256(secret)), false},
+		{"no issuer", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"iss": nil}), signHS256(secret)), false},
+		{"wrong audience", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"aud": "other"}), signHS256(secret)), false},
+		{"audience in a list", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"aud": []string{"other", "contacts"}}), signHS256(secret)), true},
+		{"no subject", verifier, signTestJWT(t, hs256, claims(map[string]interface{}{"sub": nil}), signHS256(secret)), false},
+	} {
+		claims, err := test.verifier.verify(test.token, now)
+		if test.valid && (err != nil || claims.stringValue("sub") != "alice") {
+			t.Errorf("%s: the token is refused: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: the token is accepted", test.name)
+		}
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	setupTestDB(t)
+	now := time.Now()
+	token := createTestAPIKey(t, "alpha", "sync", RoleEditor)
+	principal, err := authenticateAPIKey(db, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Subject != "apikey:sync" || principal.Tenant != "alpha" || !principal.hasRole(RoleEditor) {
+		t.Errorf("unexpected principal %+v", principal)
+	}
+
+	// a key that is not the saved one
+	prefix, _, _ := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	for _, wrong := range []string{apiKeyPrefix + prefix + "_wrong", apiKeyPrefix + "nokey", apiKeyPrefix + "00000000_secret"} {
+		if _, err := authenticateAPIKey(db, wrong, now); err == nil {
+			t.Errorf("the key %s is accepted", wrong)
+		}
+	}
+
+	// an expired key, valid until its expiration
+	expired := createTestAPIKey(t, "alpha", "expired", RoleEditor)
+	if result := db.Model(APIKey{}).Where("name = ?", "expired").Update("expires_at", now.Add(time.Hour)); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if _, err := authenticateAPIKey(db, expired, now); err != nil {
+		t.Errorf("the key is refused before its expiration: %v", err)
+	}
+	if _, err := authenticateAPIKey(db, expired, now.Add(time.Hour)); err == nil {
+		t.Error("the expired key is accepted")
+	}
+
+	// a revoked key
+	if result := db.Model(APIKey{}).Where("name = ?", "sync").Update("revoked_at", now); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if _, err := authenticateAPIKey(db, token, now); err == nil {
+		t.Error("the revoked key is accepted")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The application writes its logs with log/slog, in JSON by default. Every
+// request has an ID, taken from the X-Request-ID header of the request or
+// generated, that is returned in the X-Request-ID header of the response and
+// in the errors, and is added to every log written for the request, the
+// queries of the database included.
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "requestID"
+)
+
+type requestIDContextKey struct{}
+
+// validRequestID limits the IDs accepted from the callers, that end up in
+// the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:+=/-]{1,128}$`)
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(random[:])
+}
+
+// newLogger creates the logger of the application, "json" or "text", that
+// writes the logs of the level and above.
+func newLogger(cfg Config) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level '%s', use debug, info, warn or error", cfg.LogLevel)
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch cfg.LogFormat {
+	case "json":
+		return slog.New(contextHandler{slog.NewJSONHandler(os.Stdout, options)}), nil
+	case "text":
+		return slog.New(contextHandler{slog.NewTextHandler(os.Stdout, options)}), nil
+	}
+	return nil, fmt.Errorf("unknown log format '%s', use json or text", cfg.LogFormat)
+}
+
+// contextHandler adds the ID of the request in the context to the logs, and
+// the IDs of the trace and of the span when the request is traced.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// dbError is a failure of the database. The message is the one returned to
+// the caller, the cause, that can reveal the schema, stays available to
+// errors.Is and errors.As and is logged with the query.
+type dbError struct {
+	message string
+	cause   error
+}
+
+func (e *dbError) Error() string {
+	return e.message
+}
+
+func (e *dbError) Unwrap() error {
+	return e.cause
+}
+
+// LogValue logs the cause with the message.
+func (e *dbError) LogValue() slog.Value {
+	return slog.StringValue(e.message + ": " + e.cause.Error())
+}
+
+// wrapDBError wraps the error of the database with the message for the
+// caller.
+func wrapDBError(cause error, format string, args ...interface{}) error {
+	return &dbError{message: fmt.Sprintf(format, args...), cause: cause}
+}
+
+// requestID gives its ID to the request, before anything else, and adds it
+// to the response.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+		c.Writer = &errorWriter{ResponseWriter: c.Writer, requestID: id}
+		c.Next()
+	}
+}
+
+// errorWriter adds the request ID to the JSON errors, e.g.
+// {"request_id": "...", "error": "..."}, so the callers can report it.
+type errorWriter struct {
+	gin.ResponseWriter
+	requestID string
+}
+
+func (w *errorWriter) Write(data []byte) (int, error) {
+	if w.Status() < 400 || !bytes.HasPrefix(data, []byte("{")) ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		return w.ResponseWriter.Write(data)
+	}
+	id, _ := json.Marshal(w.requestID)
+	patched := append([]byte(`{"request_id":`), id...)
+	if rest := bytes.TrimSpace(data[1:]); !bytes.HasPrefix(rest, []byte("}")) {
+		patched = append(patched, ',')
+	}
+	if _, err := w.ResponseWriter.Write(append(patched, data[1:]...)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// accessLog logs every request when it is done, with the caller and the
+// tenant, the server errors as errors.
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		status := c.Writer.Status()
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("ip", c.ClientIP()),
+		}
+		if principal, ok := c.Get(principalKey); ok {
+			attrs = append(attrs, slog.String("subject", principal.(*Principal).Subject))
+		}
+		if tenant, ok := tenantFromContext(c.Request.Context()); ok {
+			attrs = append(attrs, slog.String("tenant", tenant))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// gormLogger writes the logs of GORM with slog: the failed queries as
+// errors, the slow ones as warnings and all the others in debug. The
+// queries made for a request have its ID. The values of the queries are
+// personal data, the database must be opened with redactedDialector to
+// keep them out of the logs.
+type gormLogger struct {
+	slowThreshold time.Duration
+}
+
+func (l gormLogger) LogMode(logger.LogLevel) logger.Interface {
+	return l
+}
+
+func (l gormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	slog.InfoContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l gormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	slog.WarnContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l gormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	slog.ErrorContext(ctx, fmt.Sprintf(msg, data...))
+}
+
+func (l gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		slog.ErrorContext(ctx, "query failed", "error", err, "sql", sql, "rows", rows, "duration", elapsed)
+	case l.slowThreshold > 0 && elapsed > l.slowThreshold:
+		sql, rows := fc()
+		slog.WarnContext(ctx, "slow query", "sql", sql, "rows", rows, "duration", elapsed)
+	case slog.Default().Enabled(ctx, slog.LevelDebug):
+		sql, rows := fc()
+		slog.DebugContext(ctx, "query", "sql", sql, "rows", rows, "duration", elapsed)
+	}
+}
+
+// redactedDialector writes the queries in the logs with the placeholders
+// instead of the values.
+type redactedDialector struct {
+	gorm.Dialector
+}
+
+func (d redactedDialector) Explain(sql string, vars ...interface{}) string {
+	return sql
+}
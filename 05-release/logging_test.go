@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// TestQueryLogs checks that the queries are logged without their values.
+func TestQueryLogs(t *testing.T) {
+	var logs bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	testDB, err := gorm.Open(redactedDialector{sqlite.Open("file:logs?mode=memory")}, &gorm.Config{Logger: gormLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.AutoMigrate(&Contact{}); err != nil {
+		t.Fatal(err)
+	}
+	testDB.Create(&Contact{Name: "Jane Roe", Email: "jane@example.com"})
+	testDB.Where("email = ?", "jane@example.com").Find(&[]Contact{})
+	testDB.Exec("SELECT * FROM missing WHERE email = ?", "jane@example.com")
+
+	if !strings.Contains(logs.String(), `"msg":"query failed"`) || !strings.Contains(logs.String(), "email = ?") {
+		t.Fatalf("the queries are not logged: %s", logs.String())
+	}
+	if strings.Contains(logs.String(), "jane") {
+		t.Errorf("the values of the queries are logged: %s", logs.String())
+	}
+}
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -13,13 +23,56 @@ import (
 
 // Contact example
 type Contact struct {
-	ID      uint `gorm:"primaryKey"`
-	Name    string
-	Phone   string
-	Address string
-	Email   string
-	Website string
-	Notes   string
+	ID       uint   `gorm:"primaryKey"`
+	TenantID string `gorm:"index" json:"-"`
+	Name     string
+	Phone    string
+	Address  string
+	Email    string
+	Website  string
+	Notes    string
+	// AddressBookID is the book of the contact, by default the personal book
+	// of the user that creates it.
+	AddressBookID uint `gorm:"index"`
+	// Owner is the user that created the contact, it is set by the server.
+	Owner string `gorm:"index"`
+	// CreatedAt and UpdatedAt are set by the database, the retention rules
+	// look at the time of the last change.
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
+	// AnonymizedAt is the time when the personal data of the contact was
+	// erased, the retention rules do not anonymize it again.
+	AnonymizedAt *time.Time `gorm:"<-:update" json:",omitempty"`
+	// LastContacted is the time of the last call, meeting or email in the
+	// timeline of the contact.
+	LastContacted *time.Time `gorm:"-"`
+	// EmailIndex and PhoneIndex are the blind indexes of the encrypted
+	// Email and Phone, for the lookups.
+	EmailIndex string `gorm:"index" json:"-"`
+	PhoneIndex string `gorm:"index" json:"-"`
+	// NotesHTML is the Notes Markdown rendered to sanitized HTML, it is
+	// returned only when the request asks for it with ?render=html.
+	NotesHTML string `json:"notes_html,omitempty" gorm:"-"`
+}
+
+// validateContact checks the values of a contact, it returns the list of
+// the problems found.
+func validateContact(contact *Contact) (errs []string) {
+	if strings.TrimSpace(contact.Name) == "" {
+		errs = append(errs, "the name is required")
+	}
+	if contact.Email != "" {
+		if _, err := mail.ParseAddress(contact.Email); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid email '%s'", contact.Email))
+		}
+	}
+	if contact.Website != "" {
+		u, err := url.Parse(contact.Website)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("invalid website '%s'", contact.Website))
+		}
+	}
+	return errs
 }
 
 // @title           Swagger Example API
@@ -51,38 +104,333 @@ func initDB() *gorm.DB {
 			sslmode=disable 
 			TimeZone=Europe/Rome`
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(redactedDialector{postgres.Open(dsn)}, &gorm.Config{
+		Logger: gormLogger{slowThreshold: config.SlowQueryThreshold},
+	})
 	if err != nil {
 		panic("failed to connect database")
 	}
+	// every query made for a request is scoped to the tenant of the request
+	if err := db.Use(tenantScope{}); err != nil {
+		panic(err)
+	}
 	return db
 }
 
-var db = initDB()
+// db is the connection to the database, opened by main.
+var db *gorm.DB
 
 // This is the main application entry point
 // it can be run with 'go run main.go'.
 // to build the application we need to run
 // the command 'go build'.
 func main() {
+	db = initDB()
+	logger, err := newLogger(config)
+	if err != nil {
+		panic(err)
+	}
+	slog.SetDefault(logger)
 
 	// This command creates and keeps update the database table related to the
 	// contact Entity.
-	db.AutoMigrate(&Contact{})
+	// The errors of the migrations are reported by /readyz.
+	// When they fail the instance starts unready, without the steps that
+	// need the tables.
+	migrationErr := db.AutoMigrate(append(models, &Session{}, &OIDCLogin{})...)
+	if migrationErr != nil {
+		slog.Error("the migrations failed", "error", migrationErr)
+	} else if err := prepareDatabase(db); err != nil {
+		panic(err)
+	}
+
+	// administrative commands, e.g. 'contact-manager apikey create -name x'
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "apikey":
+			err := forAllTenants(db, func(db *gorm.DB) error { return runAPIKeyCommand(db, os.Args[2:]) })
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		case "keyring":
+			err := forAllTenants(db, func(db *gorm.DB) error { return runKeyringCommand(db, os.Args[2:]) })
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command '%s'\n", os.Args[1])
+			os.Exit(2)
+		}
+		return
+	}
+
+	// the context of the workers is cancelled on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var background workers
+
+	// the encrypted fields are encrypted and decrypted by the database, the
+	// keyring is loaded after the commands so 'keyring add' can create it
+	enc, err := newFieldEncryption(config)
+	if err != nil {
+		panic(err)
+	}
+	if enc != nil {
+		if err := db.Use(enc); err != nil {
+			panic(err)
+		}
+		encryption = enc
+		background.run(func() { runKeyRotation(ctx, db, enc, config.EncryptionRotationInterval) })
+	}
+
+	// the queries are measured from here, the migrations are not. The
+	// metrics are split by tenant only when they are protected by the token.
+	metrics, err := newMetrics(db, config.MetricsToken != "")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Use(metrics); err != nil {
+		panic(err)
+	}
+
+	tracerProvider, err := newTracerProvider(context.Background(), config)
+	if err != nil {
+		panic(err)
+	}
+	if tracerProvider != nil {
+		setupTracing(tracerProvider)
+		if err := db.Use(newQueryTracer(db)); err != nil {
+			panic(err)
+		}
+	}
+
+	verifier, err := newJWTVerifier(config)
+	if err != nil {
+		panic(err)
+	}
+	policy, err := loadPolicy(config.RBACPolicyFile)
+	if err != nil {
+		panic(err)
+	}
+	limiter, err := newLimiter(config)
+	if err != nil {
+		panic(err)
+	}
+	retentionRules, err := loadRetentionRules(config.RetentionRulesFile)
+	if err != nil {
+		panic(err)
+	}
+	notifier, err := newNotifier(config)
+	if err != nil {
+		panic(err)
+	}
+	background.run(func() { runTaskScheduler(ctx, db, notifier, config.TaskPollInterval) })
+	background.run(func() { runImportWorker(ctx, db, config.ImportPollInterval) })
+	background.run(func() { runIdempotencyCleaner(ctx, db, time.Hour) })
+	background.run(func() { runRetention(ctx, db, retentionRules, config.RetentionDryRun, config.RetentionInterval) })
+
+	r := gin.New()
+	r.Use(requestID(), accessLog(), instrument(metrics))
+	if tracerProvider != nil {
+		r.Use(traceRequests())
+	}
+	r.Use(gin.Recovery())
+	if len(config.CORSAllowedOrigins) > 0 {
+		corsConfig := cors.DefaultConfig()
+		if config.CORSAllowedOrigins[0] == "*" {
+			corsConfig.AllowAllOrigins = true
+		} else {
+			corsConfig.AllowOrigins = config.CORSAllowedOrigins
+			// the browsers logged in send the session cookie
+			corsConfig.AllowCredentials = true
+		}
+		corsConfig.AddAllowHeaders("Authorization", "X-API-Key", idempotencyHeader, csrfHeader, requestIDHeader, "traceparent", "tracestate")
+		corsConfig.AddExposeHeaders(requestIDHeader, "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After")
+		r.Use(cors.New(corsConfig))
+	}
+
+	// the metrics are scraped by Prometheus, with the token when it is set
+	r.GET("/metrics", serveMetrics(metrics, config.MetricsToken))
+	// the probes of the orchestrator
+	r.GET("/healthz", liveness)
+	r.GET("/readyz", readiness(newHealth(db, config, migrationErr)))
+	// the documentation of the API
+	setupAPIDocs(config)
+	r.GET("/openapi.json", serveOpenAPI)
+	r.GET("/docs", func(c *gin.Context) { c.Redirect(http.StatusMovedPermanently, "docs/index.html") })
+	r.GET("/docs/*any", serveAPIDocs())
+
+	// login of the browsers with the identity provider, the mock one signs
+	// in anybody and is only for the development
+	if config.OIDCMock && config.OIDCIssuer == "" {
+		config.OIDCIssuer = "http://localhost:8080/mock-idp"
+	}
+	if err := registerLogin(r, config, limiter); err != nil {
+		panic(err)
+	}
+
+	registerAPI(r, verifier, limiter, policy, retentionRules)
+
+	// the server runs until SIGINT or SIGTERM, then the requests in flight,
+	// the workers and the export of the spans are given the shutdown timeout
+	// to finish before the connections to the database are closed
+	serveErr := serve(ctx, newServer(config, r), config.ShutdownTimeout)
+	if serveErr != nil {
+		slog.Error("the server failed", "error", serveErr)
+	}
+	stop()
+	if !background.wait(config.ShutdownTimeout) {
+		slog.Warn("the workers are still running at the shutdown timeout")
+	}
+	if tracerProvider != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+			slog.Error("cannot export the last spans", "error", err)
+		}
+		cancel()
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			slog.Error("cannot close the connections to the database", "error", err)
+		}
+	}
+	if serveErr != nil {
+		os.Exit(1)
+	}
+	slog.Info("stopped")
+}
+
+// registerLogin adds the routes of the login of the browsers, when the
+// identity provider is configured, and the ones of the mock provider when it
+// is enabled. The logins are limited by IP address.
+func registerLogin(r gin.IRouter, cfg Config, limiter *Limiter) error {
+	if cfg.OIDCMock {
+		roles := cfg.OIDCMockRoles
+		if len(roles) == 0 {
+			roles = []string{RoleEditor}
+		}
+		idp, err := newMockIdP(cfg.OIDCIssuer, roles)
+		if err != nil {
+			return err
+		}
+		issuer, err := url.Parse(cfg.OIDCIssuer)
+		if err != nil {
+			return err
+		}
+		slog.Warn("the mock identity provider signs in anybody", "issuer", cfg.OIDCIssuer)
+		idp.register(r.Group(issuer.Path))
+	}
+	if provider := newOIDCProvider(cfg); provider != nil {
+		auth := r.Group("/auth", rateLimitIP(limiter))
+		{
+			auth.GET("/login", login(provider))
+			auth.GET("/callback", loginCallback(provider))
+			auth.GET("/session", getSession)
+			auth.POST("/logout", logout)
+		}
+	}
+	return nil
+}
+
+// prepareDatabase completes the migrations: it gives the rows to the
+// tenants, sets the times of the contacts, and protects the tables with the
+// row level security and the triggers of the audit log.
+func prepareDatabase(db *gorm.DB) error {
+	err := forAllTenants(db, func(db *gorm.DB) error {
+		if err := migrateTenants(db, config.DefaultTenant); err != nil {
+			return err
+		}
+		return backfillContactTimes(db)
+	})
+	if err != nil {
+		return err
+	}
+	if config.TenantRLS {
+		if err := enableRowLevelSecurity(db); err != nil {
+			return err
+		}
+	}
+	if db.Dialector.Name() == "postgres" {
+		return protectAuditLog(db)
+	}
+	return nil
+}
 
-	r := gin.Default()
-	r.Use(cors.Default())
+// registerAPI adds the routes of the API to the router. Every route requires
+// an authenticated caller with the role that the policy requires for the
+// route, is limited by the budget of the caller, works on the data of the
+// tenant of the caller and is written in the audit log, the denied ones too.
+func registerAPI(r gin.IRouter, verifier *jwtVerifier, limiter *Limiter, policy Policy, retentionRules []RetentionRule) {
+	api := r.Group("", rateLimitIP(limiter), authenticate(verifier), rateLimit(limiter), resolveTenant(), audit(), authorize(policy))
 
-	contacts := r.Group("/contacts")
+	contacts := api.Group("/contacts")
 	{
-		contacts.POST("/", createContact)
+		contacts.GET("/export.csv", exportContactsCSV)
+		contacts.POST("/import.csv", importContactsCSV)
+		contacts.POST("/", idempotent(), createContact)
 		contacts.PUT(":id", updateContactById)
 		contacts.DELETE(":id", deleteContactById)
 		contacts.GET(":id", getContactById)
 		contacts.GET("/", listContacts)
+		contacts.GET(":id/tasks", listContactTasks)
+		contacts.POST(":id/timeline", createActivity)
+		contacts.GET(":id/timeline", getTimeline)
+		contacts.GET(":id/external-refs", listExternalReferences)
+		contacts.POST(":id/consents", recordConsent)
+		contacts.GET(":id/consents", listContactConsents)
+		contacts.GET(":id/tags", listContactTags)
+		contacts.PUT(":id/tags/:tag", tagContact)
+		contacts.DELETE(":id/tags/:tag", untagContact)
+		contacts.PUT("/by-external/:source/:id", upsertContactByExternalId)
+		contacts.GET("/by-external/:source/:id", getContactByExternalId)
+	}
+	// custom methods of the collection, e.g. POST /contacts:batch
+	api.POST("/contacts:action", contactsAction)
+
+	tasks := api.Group("/tasks")
+	{
+		tasks.POST("/", createTask)
+		tasks.PUT(":id", updateTaskById)
+		tasks.DELETE(":id", deleteTaskById)
+		tasks.GET(":id", getTaskById)
+		tasks.GET("/", listTasks)
+	}
+
+	books := api.Group("/books")
+	{
+		books.POST("/", createAddressBook)
+		books.DELETE(":id", deleteAddressBookById)
+		books.GET("/", listAddressBooks)
+		books.GET(":id/shares", listShares)
+		books.PUT(":id/shares", shareAddressBook)
+		books.DELETE(":id/shares/:shareId", unshareAddressBook)
+	}
+
+	imports := api.Group("/imports")
+	{
+		imports.POST("/", createImport)
+		imports.GET(":id", getImportById)
+		imports.DELETE(":id", cancelImportById)
+		imports.GET("/", listImports)
+	}
+
+	auditLog := api.Group("/audit")
+	{
+		auditLog.GET("/", listAuditEntries)
+		auditLog.GET("/export.jsonl", exportAuditLog)
+		auditLog.GET("/verify", getAuditVerification)
 	}
 
-	r.Run()
+	api.GET("/consents", listConsents)
+
+	privacy := api.Group("/privacy/subjects")
+	{
+		privacy.GET(":id/export", exportSubject)
+		privacy.POST(":id/erase", eraseSubject)
+	}
+	api.GET("/retention/report", getRetentionReport(retentionRules))
 }
 
 // CONTROLLERS
@@ -93,19 +441,29 @@ func main() {
 // @Description  Creates a new contact
 // @tags         Contact
 // @Accept       json
+// @Param        Idempotency-Key  header  string  false  "Makes the request safe to retry"
 // @Param        Body  body      Contact  true  "All the informations required to create a contact"
 // @Success      201   {object}  Contact
 // @Router       /contacts [post]
 func createContact(c *gin.Context) {
+	db := tenantDB(c)
 	var contact Contact
 	if err := c.ShouldBindJSON(&contact); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// the times are set by the database
+	contact.CreatedAt, contact.UpdatedAt = time.Time{}, time.Time{}
+	if err := assignAddressBook(db, currentPrincipal(c), &contact); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
 	err := saveContact(db, &contact)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	} else {
+		auditContacts(c, contact.ID)
+		renderNotes(c, &contact)
 		c.JSON(http.StatusCreated, contact)
 	}
 }
@@ -120,6 +478,7 @@ func createContact(c *gin.Context) {
 // @Success      200
 // @Router       /contacts/{id} [put]
 func updateContactById(c *gin.Context) {
+	db := tenantDB(c)
 	var contact Contact
 	if err := c.ShouldBindJSON(&contact); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -132,12 +491,25 @@ func updateContactById(c *gin.Context) {
 		})
 		return
 	}
+	principal := currentPrincipal(c)
+	if err := checkContactAccess(db, principal, uint(contactId), ShareWrite); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	// moving the contact to another book needs write access to the book
+	if contact.AddressBookID != 0 {
+		if err := checkBookAccess(db, principal, contact.AddressBookID, ShareWrite); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
 	updatedContact, err := updateContact(db, uint(contactId), contact)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 		})
 	} else {
+		renderNotes(c, updatedContact)
 		c.JSON(http.StatusOK, updatedContact)
 	}
 }
@@ -150,6 +522,7 @@ func updateContactById(c *gin.Context) {
 // @Success      200
 // @Router       /contacts/{id} [delete]
 func deleteContactById(c *gin.Context) {
+	db := tenantDB(c)
 	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -157,6 +530,10 @@ func deleteContactById(c *gin.Context) {
 		})
 		return
 	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareWrite); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
 	err = deleteContact(db, uint(contactId))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -171,11 +548,13 @@ func deleteContactById(c *gin.Context) {
 // @Summary      Get contact details.
 // @Description  Gets detailed info about a contact.
 // @Param 		 id  path int true "Contact ID"
+// @Param        render  query  string  false  "html adds the notes rendered to HTML"
 // @tags         Contact
 // @Produce      json
 // @Success      200  {object}  Contact
 // @Router       /contacts/{id} [get]
 func getContactById(c *gin.Context) {
+	db := tenantDB(c)
 	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -183,46 +562,95 @@ func getContactById(c *gin.Context) {
 		})
 		return
 	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareRead); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
 	contact, err := readContactById(db, uint(contactId))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 		})
 	} else {
+		renderNotes(c, contact)
 		c.JSON(http.StatusOK, contact)
 	}
 }
 
 // GetAllContacts Get all contacts.
 // @Summary      Get the Contacts.
-// @Description  Returns all the contacts in the contact manager.
+// @Description  Returns all the contacts that the caller can see.
 // @tags         Contact
 // @Produce      json
+// @Param        render  query  string  false  "html adds the notes rendered to HTML"
+// @Param        email   query  string  false  "Only the contacts with this email"
+// @Param        phone   query  string  false  "Only the contacts with this phone number"
+// @Param        tag     query  string  false  "Only the contacts with this tag"
 // @Success      200  {object}  []Contact
 // @Router       /contacts [get]
 func listContacts(c *gin.Context) {
-	allContacts, err := readAllContacts(db)
+	db := tenantDB(c)
+	var filters []func(*gorm.DB) *gorm.DB
+	if email := c.Query("email"); email != "" {
+		filters = append(filters, fieldEquals("Email", email))
+	}
+	if phone := c.Query("phone"); phone != "" {
+		filters = append(filters, fieldEquals("Phone", phone))
+	}
+	if tag := c.Query("tag"); tag != "" {
+		filters = append(filters, taggedWith(tag))
+	}
+	allContacts, err := readAllContacts(db, currentPrincipal(c), filters...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 		})
 		return
 	}
+	auditBulkRead(c, len(allContacts))
+	for i := range allContacts {
+		renderNotes(c, &allContacts[i])
+	}
 	c.JSON(http.StatusOK, allContacts)
 }
 
 // DATABASE
 func deleteContact(db *gorm.DB, contactId uint) error {
-	result := db.Delete(Contact{}, Contact{ID: contactId})
-	if result.RowsAffected != 1 {
-		return fmt.Errorf("cannot delete contact with id '%d'", contactId)
-	}
-	return nil
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(Contact{}, Contact{ID: contactId})
+		if result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete contact with id '%d'", contactId)
+		}
+		if result.RowsAffected != 1 {
+			return fmt.Errorf("cannot delete contact with id '%d'", contactId)
+		}
+		// the tasks, the timeline, the external ids, the consents and the tags
+		// of the contact are useless without the contact.
+		if result := tx.Where("contact_id = ?", contactId).Delete(Task{}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete the tasks of contact with id '%d'", contactId)
+		}
+		if result := tx.Where("contact_id = ?", contactId).Delete(Activity{}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete the timeline of contact with id '%d'", contactId)
+		}
+		if result := tx.Where("contact_id = ?", contactId).Delete(ExternalReference{}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete the external ids of contact with id '%d'", contactId)
+		}
+		if result := tx.Where("contact_id = ?", contactId).Delete(Consent{}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete the consents of contact with id '%d'", contactId)
+		}
+		if result := tx.Where("contact_id = ?", contactId).Delete(ContactTag{}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete the tags of contact with id '%d'", contactId)
+		}
+		return nil
+	})
 }
 
 func updateContact(db *gorm.DB, contactId uint, contact Contact) (c *Contact, err error) {
 
 	result := db.Model(Contact{}).First(&c, Contact{ID: contactId})
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, wrapDBError(result.Error, "cannot retrieve contact with id '%d'", contactId)
+	}
 	if result.RowsAffected != 1 {
 		return nil, fmt.Errorf("cannot retrieve contact with id '%d'", contactId)
 	}
@@ -233,27 +661,42 @@ func updateContact(db *gorm.DB, contactId uint, contact Contact) (c *Contact, er
 	c.Notes = contact.Notes
 	c.Website = contact.Website
 	c.Phone = contact.Phone
+	if contact.AddressBookID != 0 {
+		c.AddressBookID = contact.AddressBookID
+	}
 
 	result = db.Save(&c)
 	if result.Error != nil {
-		return nil, fmt.Errorf("cannot update contact with id '%d'", contactId)
+		return nil, wrapDBError(result.Error, "cannot update contact with id '%d'", contactId)
+	}
+	if err := fillContactLastContacted(db, c); err != nil {
+		return nil, err
 	}
 	return
 }
 
 func readContactById(db *gorm.DB, contactId uint) (contact *Contact, err error) {
 	result := db.Model(Contact{}).First(&contact, Contact{ID: contactId})
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, wrapDBError(result.Error, `cannot read contact with id '%d'`, contactId)
+	}
 	if result.RowsAffected != 1 {
 		return nil, fmt.Errorf(`no user found with id '%d'`, contactId)
 	}
+	if err := fillContactLastContacted(db, contact); err != nil {
+		return nil, err
+	}
 	return
 }
 
-func readAllContacts(db *gorm.DB) ([]Contact, error) {
+func readAllContacts(db *gorm.DB, principal *Principal, filters ...func(*gorm.DB) *gorm.DB) ([]Contact, error) {
 	var contacts []Contact
-	result := db.Find(&contacts)
+	result := db.Scopes(visibleContacts(principal, ShareRead)).Scopes(filters...).Find(&contacts)
 	if result.Error != nil {
-		return nil, fmt.Errorf("cannot list contacts")
+		return nil, wrapDBError(result.Error, "cannot list contacts")
+	}
+	if err := fillLastContacted(db, contacts); err != nil {
+		return nil, err
 	}
 	return contacts, nil
 }
@@ -261,7 +704,7 @@ func readAllContacts(db *gorm.DB) ([]Contact, error) {
 func saveContact(db *gorm.DB, contact *Contact) error {
 	result := db.Create(&contact)
 	if result.Error != nil {
-		return fmt.Errorf(`error saving contact`)
+		return wrapDBError(result.Error, `error saving contact`)
 	}
 	return nil
 }
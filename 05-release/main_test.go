@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The tests run the handlers on an in-memory SQLite database in place of
+// Postgres, the features that only Postgres has (the row level security, the
+// triggers of the audit log) are not tested.
+
+var testDatabases int64
+
+// setupTestDB replaces the database and the configuration of the
+// application with a new in-memory database and the default configuration,
+// they are restored at the end of the test.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	name := fmt.Sprintf("file:test%d?mode=memory&cache=shared", atomic.AddInt64(&testDatabases, 1))
+	testDB, err := gorm.Open(sqlite.Open(name), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.Use(tenantScope{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.AutoMigrate(append(models, &Session{}, &OIDCLogin{})...); err != nil {
+		t.Fatal(err)
+	}
+	savedDB, savedConfig := db, config
+	db = testDB
+	t.Cleanup(func() {
+		db, config = savedDB, savedConfig
+		if sqlDB, err := testDB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// newTestAPI returns a router with the routes of the API, that require an
+// API key.
+func newTestAPI(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	config.AuthRequired = true
+	verifier, err := newJWTVerifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := newLimiter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	registerAPI(r, verifier, limiter, policy, nil)
+	return r
+}
+
+// createTestAPIKey saves an API key of the tenant and returns its token.
+func createTestAPIKey(t *testing.T, tenant string, name string, roles string) string {
+	t.Helper()
+	token, prefix, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := APIKey{TenantID: tenant, Name: name, Prefix: prefix, Hash: hashAPIKey(token), Roles: roles}
+	if result := db.Create(&key); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	return token
+}
+
+// testRequest sends a request with the API key, the body is encoded to
+// JSON unless it is a string.
+func testRequest(t *testing.T, r http.Handler, key string, method string, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(body)
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewBuffer(data)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		request.Header.Set("X-API-Key", key)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// decodeResponse decodes the JSON body of a response, it fails the test when
+// the status is not the expected one.
+func decodeResponse(t *testing.T, recorder *httptest.ResponseRecorder, status int, value interface{}) {
+	t.Helper()
+	if recorder.Code != status {
+		t.Fatalf("expected the status %d, got %d: %s", status, recorder.Code, recorder.Body.String())
+	}
+	if value == nil {
+		return
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), value); err != nil {
+		t.Fatalf("cannot decode %s: %v", recorder.Body.String(), err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/russross/blackfriday/v2"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The notes of a contact are written in Markdown. The HTML produced from them
+// ends up in a web page, hence it goes through a strict allow-list sanitizer:
+// everything that is not in the lists below is removed.
+
+// allowedTags are the HTML elements that the notes can contain, with the
+// attributes allowed for each one of them.
+var allowedTags = map[atom.Atom][]string{
+	atom.P: nil, atom.Br: nil, atom.Hr: nil,
+	atom.H1: nil, atom.H2: nil, atom.H3: nil, atom.H4: nil, atom.H5: nil, atom.H6: nil,
+	atom.Em: nil, atom.Strong: nil, atom.Del: nil, atom.Code: nil, atom.Pre: nil,
+	atom.Blockquote: nil, atom.Ul: nil, atom.Ol: nil, atom.Li: nil,
+	atom.Table: nil, atom.Thead: nil, atom.Tbody: nil, atom.Tr: nil, atom.Th: nil, atom.Td: nil,
+	atom.A: {"href", "title"},
+}
+
+// droppedTags are removed together with their content.
+var droppedTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Iframe: true, atom.Object: true,
+	atom.Embed: true, atom.Template: true, atom.Noscript: true, atom.Textarea: true,
+}
+
+var allowedSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+// renderMarkdown converts the Markdown notes to sanitized HTML.
+func renderMarkdown(markdown string) string {
+	if strings.TrimSpace(markdown) == "" {
+		return ""
+	}
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.SkipHTML | blackfriday.SkipImages | blackfriday.Safelink |
+			blackfriday.NofollowLinks | blackfriday.NoreferrerLinks,
+	})
+	unsafe := blackfriday.Run([]byte(markdown), blackfriday.WithRenderer(renderer))
+	return sanitizeHTML(string(unsafe))
+}
+
+// sanitizeHTML keeps only the allowed tags and attributes of a HTML fragment.
+func sanitizeHTML(fragment string) string {
+	var out bytes.Buffer
+	tokenizer := html.NewTokenizer(strings.NewReader(fragment))
+	// depth of the dropped elements we are in, their content is skipped
+	dropped := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return out.String()
+		case html.TextToken:
+			if dropped == 0 {
+				out.WriteString(html.EscapeString(string(tokenizer.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if droppedTags[token.DataAtom] {
+				if token.Type == html.StartTagToken {
+					dropped++
+				}
+				continue
+			}
+			attrs, ok := allowedTags[token.DataAtom]
+			if !ok || dropped > 0 {
+				continue
+			}
+			out.WriteString("<" + token.DataAtom.String())
+			for _, attr := range token.Attr {
+				if !contains(attrs, attr.Key) {
+					continue
+				}
+				if attr.Key == "href" && !safeURL(attr.Val) {
+					continue
+				}
+				out.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			if token.DataAtom == atom.A {
+				out.WriteString(` rel="nofollow noopener noreferrer"`)
+			}
+			out.WriteString(">")
+		case html.EndTagToken:
+			token := tokenizer.Token()
+			if droppedTags[token.DataAtom] {
+				if dropped > 0 {
+					dropped--
+				}
+				continue
+			}
+			if _, ok := allowedTags[token.DataAtom]; ok && dropped == 0 {
+				switch token.DataAtom {
+				case atom.Br, atom.Hr:
+				default:
+					out.WriteString("</" + token.DataAtom.String() + ">")
+				}
+			}
+		}
+	}
+}
+
+// safeURL reports if a link points to an allowed scheme. Relative links are
+// allowed, "javascript:" and "data:" links are not.
+func safeURL(raw string) bool {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" || allowedSchemes[strings.ToLower(u.Scheme)]
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// renderNotes fills the NotesHTML field of the contacts when the request
+// asks for it with the ?render=html query parameter.
+func renderNotes(c *gin.Context, contacts ...*Contact) {
+	if c.Query("render") != "html" {
+		return
+	}
+	for _, contact := range contacts {
+		contact.NotesHTML = renderMarkdown(contact.Notes)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, test := range []struct {
+		markdown string
+		expected []string
+		absent   []string
+	}{
+		{markdown: "", expected: nil},
+		{markdown: "**bold** and _em_", expected: []string{"<p><strong>bold</strong> and <em>em</em></p>"}},
+		{markdown: "# Title\n\n- one\n- two", expected: []string{"<h1>Title</h1>", "<li>one</li>"}},
+		{markdown: "[site](https://example.com)", expected: []string{`<a href="https://example.com" rel="nofollow noopener noreferrer">site</a>`}},
+		{markdown: "[mail](mailto:a@example.com)", expected: []string{`href="mailto:a@example.com"`}},
+
+		// the scripts and the raw HTML, the tags inline are skipped and
+		// their content is left as text
+		{markdown: "<script>alert(1)</script>", expected: []string{"<p>alert(1)</p>"}, absent: []string{"<script"}},
+		{markdown: "text <script>alert(1)</script> text", expected: []string{"<p>text alert(1) text</p>"}, absent: []string{"<script"}},
+		{markdown: "<div onclick=\"alert(1)\">block</div>\n\nafter", expected: []string{"after"}, absent: []string{"<div", "onclick"}},
+		{markdown: "<img src=x onerror=alert(1)>", absent: []string{"<img", "onerror"}},
+		{markdown: "<iframe src=\"https://evil.example.com\"></iframe>", absent: []string{"<iframe", "evil"}},
+		{markdown: "![image](https://example.com/a.png)", absent: []string{"<img"}},
+
+		// the links to the dangerous schemes
+		{markdown: "[click](javascript:alert(1))", absent: []string{"javascript", `href="`}},
+		{markdown: "[click](JaVaScRiPt:alert(1))", absent: []string{`href="`}},
+		{markdown: "[click](data:text/html;base64,PHNjcmlwdD4=)", absent: []string{"data:", `href="`}},
+		{markdown: "[click](vbscript:msgbox)", absent: []string{`href="`}},
+		{markdown: "[click](&#106;avascript:alert(1))", absent: []string{`href="`}},
+		{markdown: "<a href=\"javascript:alert(1)\">raw</a>", absent: []string{"javascript", "<a"}},
+	} {
+		rendered := renderMarkdown(test.markdown)
+		if test.expected == nil && test.absent == nil && rendered != "" {
+			t.Errorf("%q renders %q, expected nothing", test.markdown, rendered)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(rendered, expected) {
+				t.Errorf("%q renders %q, without %q", test.markdown, rendered, expected)
+			}
+		}
+		for _, absent := range test.absent {
+			if strings.Contains(strings.ToLower(rendered), strings.ToLower(absent)) {
+				t.Errorf("%q renders %q, with %q", test.markdown, rendered, absent)
+			}
+		}
+	}
+}
+
+// TestSanitizeHTML checks the sanitizer on its own, on the HTML that the
+// Markdown renderer would not produce.
+func TestSanitizeHTML(t *testing.T) {
+	for _, test := range []struct {
+		html, expected string
+	}{
+		{`<p>text</p>`, `<p>text</p>`},
+		{`<p onclick="alert(1)" style="color: red">text</p>`, `<p>text</p>`},
+		{`<script>alert(1)</script><p>kept</p>`, `<p>kept</p>`},
+		{`<style>p { display: none }</style>text`, `text`},
+		{`<svg><script>alert(1)</script></svg>`, ``},
+		{`<scr<script>ipt>alert(1)</script>`, `ipt&gt;alert(1)`},
+		{`<a href="javascript:alert(1)">a</a>`, `<a rel="nofollow noopener noreferrer">a</a>`},
+		{`<a href=" javascript:alert(1)">a</a>`, `<a rel="nofollow noopener noreferrer">a</a>`},
+		{`<a href="&#106;&#97;vascript:alert(1)">a</a>`, `<a rel="nofollow noopener noreferrer">a</a>`},
+		{`<a href="javascript&colon;alert(1)">a</a>`, `<a rel="nofollow noopener noreferrer">a</a>`},
+		{`<a href="java&#x09;script:alert(1)">a</a>`, `<a rel="nofollow noopener noreferrer">a</a>`},
+		{`<a href="data:text/html,<script>alert(1)</script>">a</a>`, `<a rel="nofollow noopener noreferrer">a</a>`},
+		{`<a href="/contacts/1" title="a &quot;title&quot;" onmouseover="alert(1)">a</a>`,
+			`<a href="/contacts/1" title="a &#34;title&#34;" rel="nofollow noopener noreferrer">a</a>`},
+		{`<a href="https://example.com" rel="opener" target="_blank">a</a>`, `<a href="https://example.com" rel="nofollow noopener noreferrer">a</a>`},
+		{`&lt;script&gt;`, `&lt;script&gt;`},
+		{`<p>unclosed`, `<p>unclosed`},
+	} {
+		if sanitized := sanitizeHTML(test.html); sanitized != test.expected {
+			t.Errorf("%s is sanitized to %s, expected %s", test.html, sanitized, test.expected)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// The metrics of the application are exposed to Prometheus at /metrics: the
+// requests by route and status, the durations of the queries, the pool of
+// connections of the database and the numbers of the contacts, the tasks and
+// the imports of every tenant, computed when Prometheus scrapes them.
+
+const metricsNamespace = "contact_manager"
+
+// Metrics collects the metrics of the application.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	queryDuration   *prometheus.HistogramVec
+}
+
+// newMetrics registers the metrics of the application, of the database and
+// of the Go runtime. Without byTenant the numbers of the contacts, the tasks
+// and the imports are the totals of all the tenants, so the metrics served
+// without a token don't list the tenants.
+func newMetrics(db *gorm.DB, byTenant bool) (*Metrics, error) {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Requests handled, by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of the requests, by method, route and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Duration of the queries, by operation: create, query, update, delete, row or raw.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"operation"}),
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	for _, collector := range []prometheus.Collector{
+		m.requests,
+		m.requestDuration,
+		m.queryDuration,
+		collectors.NewDBStatsCollector(sqlDB, "contacts"),
+		newDomainCollector(db, byTenant),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		if err := m.registry.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// instrument counts the requests and measures their duration. The requests
+// that match no route are counted together, a scan of random paths does not
+// create new series.
+func instrument(m *Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		m.requests.WithLabelValues(c.Request.Method, route, status).Inc()
+		m.requestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// serveMetrics returns the metrics in the format of Prometheus. When the
+// token is set the scraper must send it as a bearer token.
+func serveMetrics(m *Metrics, token string) gin.HandlerFunc {
+	handler := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return func(c *gin.Context) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid metrics token is required"})
+			return
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+const metricsStartKey = "metrics:start"
+
+// Name and Initialize make Metrics the GORM plugin that measures the
+// queries, from before the first callback to after the last one.
+func (m *Metrics) Name() string {
+	return "metrics"
+}
+
+func (m *Metrics) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("*").Register("metrics:start_create", startQuery); err != nil {
+		return err
+	}
+	if err := callbacks.Create().After("*").Register("metrics:observe_create", m.observeQuery("create")); err != nil {
+		return err
+	}
+	if err := callbacks.Query().Before("*").Register("metrics:start_query", startQuery); err != nil {
+		return err
+	}
+	if err := callbacks.Query().After("*").Register("metrics:observe_query", m.observeQuery("query")); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("*").Register("metrics:start_update", startQuery); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("*").Register("metrics:observe_update", m.observeQuery("update")); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("*").Register("metrics:start_delete", startQuery); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().After("*").Register("metrics:observe_delete", m.observeQuery("delete")); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("*").Register("metrics:start_row", startQuery); err != nil {
+		return err
+	}
+	if err := callbacks.Row().After("*").Register("metrics:observe_row", m.observeQuery("row")); err != nil {
+		return err
+	}
+	if err := callbacks.Raw().Before("*").Register("metrics:start_raw", startQuery); err != nil {
+		return err
+	}
+	return callbacks.Raw().After("*").Register("metrics:observe_raw", m.observeQuery("raw"))
+}
+
+func startQuery(tx *gorm.DB) {
+	tx.InstanceSet(metricsStartKey, time.Now())
+}
+
+func (m *Metrics) observeQuery(operation string) func(tx *gorm.DB) {
+	return func(tx *gorm.DB) {
+		if start, ok := tx.InstanceGet(metricsStartKey); ok {
+			m.queryDuration.WithLabelValues(operation).Observe(time.Since(start.(time.Time)).Seconds())
+		}
+	}
+}
+
+// domainCollector computes the numbers of the application when Prometheus
+// scrapes them, for all the tenants.
+type domainCollector struct {
+	db           *gorm.DB
+	byTenant     bool
+	contacts     *prometheus.Desc
+	openTasks    *prometheus.Desc
+	overdueTasks *prometheus.Desc
+	imports      *prometheus.Desc
+}
+
+func newDomainCollector(db *gorm.DB, byTenant bool) *domainCollector {
+	var labels []string
+	by, byStatus := "", ", by status"
+	if byTenant {
+		labels, by, byStatus = []string{"tenant"}, ", by tenant", ", by tenant and status"
+	}
+	return &domainCollector{
+		db:       db,
+		byTenant: byTenant,
+		contacts: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "contacts"),
+			"Contacts"+by+".", labels, nil),
+		openTasks: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "tasks_open"),
+			"Open tasks"+by+".", labels, nil),
+		overdueTasks: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "tasks_overdue"),
+			"Open tasks past their due time"+by+".", labels, nil),
+		imports: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "imports"),
+			"Imports waiting or running"+byStatus+".", append(labels, "status"), nil),
+	}
+}
+
+func (d *domainCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.contacts
+	ch <- d.openTasks
+	ch <- d.overdueTasks
+	ch <- d.imports
+}
+
+// tenantCount is a number of rows of a tenant.
+type tenantCount struct {
+	TenantID string
+	Status   string
+	Count    int64
+}
+
+func (d *domainCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the counts of all the tenants are read on a single connection
+	err := forAllTenants(d.db.WithContext(ctx), func(db *gorm.DB) error {
+		d.collect(db, ch)
+		return nil
+	})
+	if err != nil {
+		for _, desc := range []*prometheus.Desc{d.contacts, d.openTasks, d.overdueTasks, d.imports} {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+		}
+	}
+}
+
+func (d *domainCollector) collect(db *gorm.DB, ch chan<- prometheus.Metric) {
+	now := time.Now()
+	gauges := []struct {
+		desc  *prometheus.Desc
+		query *gorm.DB
+	}{
+		{d.contacts, db.Model(Contact{}).Select("tenant_id, COUNT(*) AS count").Group("tenant_id")},
+		{d.openTasks, db.Model(Task{}).Select("tenant_id, COUNT(*) AS count").
+			Where("status = ?", TaskOpen).Group("tenant_id")},
+		{d.overdueTasks, db.Model(Task{}).Select("tenant_id, COUNT(*) AS count").
+			Where("status = ? AND due_at < ?", TaskOpen, now).Group("tenant_id")},
+		{d.imports, db.Model(ImportJob{}).Select("tenant_id, status, COUNT(*) AS count").
+			Where("status IN ?", []string{ImportQueued, ImportRunning}).Group("tenant_id, status")},
+	}
+	for _, gauge := range gauges {
+		var counts []tenantCount
+		if result := gauge.query.Scan(&counts); result.Error != nil {
+			ch <- prometheus.NewInvalidMetric(gauge.desc, wrapDBError(result.Error, "cannot count the rows"))
+			continue
+		}
+		// without the tenants the counts of the same status are summed
+		totals := make(map[tenantCount]int64)
+		for _, count := range counts {
+			key := tenantCount{TenantID: count.TenantID, Status: count.Status}
+			if !d.byTenant {
+				key.TenantID = ""
+			}
+			totals[key] += count.Count
+		}
+		for key, total := range totals {
+			var labels []string
+			if d.byTenant {
+				labels = append(labels, key.TenantID)
+			}
+			if gauge.desc == d.imports {
+				labels = append(labels, key.Status)
+			}
+			ch <- prometheus.MustNewConstMetric(gauge.desc, prometheus.GaugeValue, float64(total), labels...)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestMetrics returns the metrics of the test database, that measure its
+// queries.
+func newTestMetrics(t *testing.T) *Metrics {
+	t.Helper()
+	setupTestDB(t)
+	m, err := newMetrics(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// gatherFamily returns the metrics of the registry with the name.
+func gatherFamily(t *testing.T, m *Metrics, name string) *dto.MetricFamily {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+	t.Fatalf("no metric %s", name)
+	return nil
+}
+
+func labelValue(metric *dto.Metric, name string) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestRequestMetrics(t *testing.T) {
+	m := newTestMetrics(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(instrument(m))
+	r.GET("/contacts/:id", func(c *gin.Context) {
+		if c.Param("id") == "0" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	for _, path := range []string{"/contacts/1", "/contacts/2", "/contacts/0", "/random/1", "/random/2"} {
+		testRequest(t, r, "", "GET", path, nil)
+	}
+
+	// the requests are counted by route, not by path
+	for _, expected := range []struct {
+		route, status string
+		count         float64
+	}{
+		{"/contacts/:id", "200", 2},
+		{"/contacts/:id", "404", 1},
+		{"unmatched", "404", 2},
+	} {
+		if count := testutil.ToFloat64(m.requests.WithLabelValues("GET", expected.route, expected.status)); count != expected.count {
+			t.Errorf("%s %s: %v requests counted, expected %v", expected.route, expected.status, count, expected.count)
+		}
+	}
+	if series := testutil.CollectAndCount(m.requests); series != 3 {
+		t.Errorf("%d series of requests, expected 3", series)
+	}
+	for _, metric := range gatherFamily(t, m, "contact_manager_http_request_duration_seconds").GetMetric() {
+		route, status := labelValue(metric, "route"), labelValue(metric, "status")
+		expected := uint64(1)
+		if route == "unmatched" || status == "200" {
+			expected = 2
+		}
+		if count := metric.GetHistogram().GetSampleCount(); count != expected {
+			t.Errorf("%s %s: %d durations, expected %d", route, status, count, expected)
+		}
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	m := newTestMetrics(t)
+	scoped := db.WithContext(withTenant(context.Background(), "alpha"))
+	contact := Contact{Name: "measured"}
+	if result := scoped.Create(&contact); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result := scoped.First(&Contact{}, contact.ID); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result := scoped.Model(&contact).Update("name", "measured again"); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result := scoped.Delete(&contact); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	counts := map[string]uint64{}
+	for _, metric := range gatherFamily(t, m, "contact_manager_db_query_duration_seconds").GetMetric() {
+		counts[labelValue(metric, "operation")] = metric.GetHistogram().GetSampleCount()
+	}
+	for _, operation := range []string{"create", "query", "update", "delete"} {
+		if counts[operation] == 0 {
+			t.Errorf("no duration of the %s queries: %v", operation, counts)
+		}
+	}
+}
+
+func TestDBStatsMetrics(t *testing.T) {
+	m := newTestMetrics(t)
+	for _, name := range []string{"go_sql_max_open_connections", "go_sql_open_connections", "go_sql_wait_count_total"} {
+		family := gatherFamily(t, m, name)
+		if len(family.GetMetric()) != 1 || labelValue(family.GetMetric()[0], "db_name") != "contacts" {
+			t.Errorf("unexpected metric %s: %v", name, family)
+		}
+	}
+}
+
+func TestDomainGauges(t *testing.T) {
+	newTestMetrics(t)
+	now := time.Now()
+	for tenant, rows := range map[string][]interface{}{
+		"alpha": {
+			&Contact{Name: "alpha"},
+			&Contact{Name: "alpha"},
+			&Task{Title: "call", Status: TaskOpen, DueAt: now.Add(-time.Hour)},
+			&Task{Title: "write", Status: TaskOpen, DueAt: now.Add(time.Hour)},
+			&Task{Title: "meet", Status: TaskDone, DueAt: now.Add(-time.Hour)},
+			&ImportJob{Format: "csv", Status: ImportQueued},
+			&ImportJob{Format: "csv", Status: ImportCompleted},
+		},
+		"beta": {
+			&Contact{Name: "beta"},
+			&Task{Title: "call", Status: TaskOpen, DueAt: now.Add(-time.Hour)},
+			&ImportJob{Format: "csv", Status: ImportQueued},
+			&ImportJob{Format: "json", Status: ImportRunning},
+		},
+	} {
+		scoped := db.WithContext(withTenant(context.Background(), tenant))
+		for _, row := range rows {
+			if result := scoped.Create(row); result.Error != nil {
+				t.Fatal(result.Error)
+			}
+		}
+	}
+	names := []string{"contact_manager_contacts", "contact_manager_tasks_open", "contact_manager_tasks_overdue", "contact_manager_imports"}
+
+	byTenant := `
+		# HELP contact_manager_contacts Contacts, by tenant.
+		# TYPE contact_manager_contacts gauge
+		contact_manager_contacts{tenant="alpha"} 2
+		contact_manager_contacts{tenant="beta"} 1
+		# HELP contact_manager_tasks_open Open tasks, by tenant.
+		# TYPE contact_manager_tasks_open gauge
+		contact_manager_tasks_open{tenant="alpha"} 2
+		contact_manager_tasks_open{tenant="beta"} 1
+		# HELP contact_manager_tasks_overdue Open tasks past their due time, by tenant.
+		# TYPE contact_manager_tasks_overdue gauge
+		contact_manager_tasks_overdue{tenant="alpha"} 1
+		contact_manager_tasks_overdue{tenant="beta"} 1
+		# HELP contact_manager_imports Imports waiting or running, by tenant and status.
+		# TYPE contact_manager_imports gauge
+		contact_manager_imports{status="queued",tenant="alpha"} 1
+		contact_manager_imports{status="queued",tenant="beta"} 1
+		contact_manager_imports{status="running",tenant="beta"} 1
+	`
+	if err := testutil.CollectAndCompare(newDomainCollector(db, true), strings.NewReader(byTenant), names...); err != nil {
+		t.Error(err)
+	}
+
+	// the metrics served without a token don't list the tenants
+	totals := `
+		# HELP contact_manager_contacts Contacts.
+		# TYPE contact_manager_contacts gauge
+		contact_manager_contacts 3
+		# HELP contact_manager_tasks_open Open tasks.
+		# TYPE contact_manager_tasks_open gauge
+		contact_manager_tasks_open 3
+		# HELP contact_manager_tasks_overdue Open tasks past their due time.
+		# TYPE contact_manager_tasks_overdue gauge
+		contact_manager_tasks_overdue 2
+		# HELP contact_manager_imports Imports waiting or running, by status.
+		# TYPE contact_manager_imports gauge
+		contact_manager_imports{status="queued"} 2
+		contact_manager_imports{status="running"} 1
+	`
+	if err := testutil.CollectAndCompare(newDomainCollector(db, false), strings.NewReader(totals), names...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	m := newTestMetrics(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/metrics", serveMetrics(m, "scraper"))
+	if response := testRequest(t, r, "", "GET", "/metrics", nil); response.Code != http.StatusUnauthorized {
+		t.Errorf("the metrics answer %d without the token", response.Code)
+	}
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.Header.Set("Authorization", "Bearer scraper")
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "go_sql_max_open_connections") {
+		t.Errorf("the metrics answer %d with the token: %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mockIdP is a minimal OpenID provider that runs inside the application, so
+// the login can be developed and tested without a real identity provider.
+// It signs in every user without asking anything: the subject is the
+// login_hint of the authorization request, "dev" by default. Never enable it
+// in production.
+type mockIdP struct {
+	issuer string
+	roles  []string
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockCode
+}
+
+// mockCode is an authorization code given and not used yet.
+type mockCode struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	subject     string
+	expiresAt   time.Time
+}
+
+const mockKeyId = "mock"
+
+func newMockIdP(issuer string, roles []string) (*mockIdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &mockIdP{issuer: issuer, roles: roles, key: key, codes: make(map[string]mockCode)}, nil
+}
+
+// register adds the endpoints of the provider to the router, that must be
+// mounted on the path of the issuer.
+func (m *mockIdP) register(r gin.IRouter) {
+	r.GET("/.well-known/openid-configuration", m.discovery)
+	r.GET("/authorize", m.authorize)
+	r.POST("/token", m.token)
+	r.GET("/jwks", m.jwks)
+}
+
+func (m *mockIdP) discovery(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                m.issuer,
+		"authorization_endpoint":                m.issuer + "/authorize",
+		"token_endpoint":                        m.issuer + "/token",
+		"jwks_uri":                              m.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockIdP) authorize(c *gin.Context) {
+	redirectURI := c.Query("redirect_uri")
+	target, err := url.Parse(redirectURI)
+	if err != nil || redirectURI == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid redirect_uri"})
+		return
+	}
+	query := target.Query()
+	query.Set("state", c.Query("state"))
+	if c.Query("response_type") != "code" || c.Query("code_challenge_method") != "S256" || c.Query("code_challenge") == "" {
+		query.Set("error", "invalid_request")
+		target.RawQuery = query.Encode()
+		c.Redirect(http.StatusFound, target.String())
+		return
+	}
+
+	subject := c.DefaultQuery("login_hint", "dev")
+	code, err := randomString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	m.mu.Lock()
+	m.codes[code] = mockCode{
+		clientID:    c.Query("client_id"),
+		redirectURI: redirectURI,
+		challenge:   c.Query("code_challenge"),
+		nonce:       c.Query("nonce"),
+		subject:     subject,
+		expiresAt:   time.Now().Add(time.Minute),
+	}
+	m.mu.Unlock()
+
+	query.Set("code", code)
+	target.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, target.String())
+}
+
+func (m *mockIdP) token(c *gin.Context) {
+	code := c.PostForm("code")
+	m.mu.Lock()
+	grant, ok := m.codes[code]
+	delete(m.codes, code)
+	m.mu.Unlock()
+
+	challenge := pkceChallenge(c.PostForm("code_verifier"))
+	if c.PostForm("grant_type") != "authorization_code" || !ok || time.Now().After(grant.expiresAt) ||
+		grant.clientID != c.PostForm("client_id") || grant.redirectURI != c.PostForm("redirect_uri") ||
+		subtle.ConstantTimeCompare([]byte(challenge), []byte(grant.challenge)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken, err := m.sign(map[string]interface{}{
+		"iss":   m.issuer,
+		"sub":   grant.subject,
+		"aud":   grant.clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": grant.nonce,
+		"roles": m.roles,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+		"access_token": idToken,
+		"expires_in":   300,
+	})
+}
+
+func (m *mockIdP) jwks(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": []gin.H{{
+		"kty": "RSA",
+		"kid": mockKeyId,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+	}}})
+}
+
+// sign returns a JWT with the claims, signed with RS256.
+func (m *mockIdP) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": mockKeyId})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
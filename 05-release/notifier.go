@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notifier delivers the reminder of a task that is due. Different
+// implementations send the reminder using different channels, the one to use
+// is chosen with the NOTIFIER configuration variable.
+type Notifier interface {
+	Notify(task Task, contact Contact) error
+}
+
+func newNotifier(cfg Config) (Notifier, error) {
+	switch cfg.Notifier {
+	case "", "log":
+		return logNotifier{}, nil
+	case "smtp":
+		if cfg.SMTPTo == "" {
+			return nil, fmt.Errorf("the smtp notifier requires SMTP_TO")
+		}
+		return smtpNotifier{
+			addr:     cfg.SMTPAddr,
+			user:     cfg.SMTPUser,
+			password: cfg.SMTPPassword,
+			from:     cfg.SMTPFrom,
+			to:       strings.Split(cfg.SMTPTo, ","),
+		}, nil
+	case "webhook":
+		if cfg.WebhookURL == "" {
+			return nil, fmt.Errorf("the webhook notifier requires WEBHOOK_URL")
+		}
+		return webhookNotifier{
+			url:    cfg.WebhookURL,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier '%s'", cfg.Notifier)
+}
+
+// reminderText is the human readable message shared by all the notifiers.
+func reminderText(task Task, contact Contact) string {
+	return fmt.Sprintf("Task '%s' for contact '%s' is due on %s (assignee: %s)",
+		task.Title, contact.Name, task.DueAt.Format(time.RFC1123), task.Assignee)
+}
+
+// logNotifier writes the reminders on the application log.
+type logNotifier struct{}
+
+func (logNotifier) Notify(task Task, contact Contact) error {
+	slog.Info(reminderText(task, contact), "task", task.ID, "contact", contact.ID)
+	return nil
+}
+
+// smtpNotifier sends the reminders by email.
+type smtpNotifier struct {
+	addr     string
+	user     string
+	password string
+	from     string
+	to       []string
+}
+
+func (n smtpNotifier) Notify(task Task, contact Contact) error {
+	var auth smtp.Auth
+	if n.user != "" {
+		host := strings.Split(n.addr, ":")[0]
+		auth = smtp.PlainAuth("", n.user, n.password, host)
+	}
+	// the title is encoded, a line break in it cannot add headers
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		n.from, strings.Join(n.to, ", "), mime.QEncoding.Encode("utf-8", "Reminder: "+task.Title), reminderText(task, contact))
+	if err := smtp.SendMail(n.addr, auth, n.from, n.to, []byte(msg)); err != nil {
+		return fmt.Errorf("cannot send reminder for task '%d': %w", task.ID, err)
+	}
+	return nil
+}
+
+// webhookNotifier posts the task and the contact as JSON to an URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n webhookNotifier) Notify(task Task, contact Contact) error {
+	body, err := json.Marshal(gin.H{
+		"event":   "task.due",
+		"message": reminderText(task, contact),
+		"task":    task,
+		"contact": contact,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("cannot send reminder for task '%d': %w", task.ID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered '%s' for task '%d'", resp.Status, task.ID)
+	}
+	return nil
+}
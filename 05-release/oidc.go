@@ -0,0 +1,527 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The browsers sign in with the OpenID Connect authorization code flow with
+// PKCE: /auth/login sends the user to the identity provider, that sends it
+// back to /auth/callback with a code. The code is exchanged for an ID token
+// and the user gets a session cookie. The requests authenticated by the
+// cookie that change something need the X-CSRF-Token header with the token
+// returned by /auth/session.
+
+const (
+	sessionCookie    = "cm_session"
+	loginStateCookie = "cm_login"
+	csrfHeader       = "X-CSRF-Token"
+	loginTTL         = 10 * time.Minute
+)
+
+var errCSRF = &accessError{http.StatusForbidden, "missing or invalid CSRF token"}
+
+// Session is a user signed in with the browser. Only the hash of the cookie
+// is stored.
+type Session struct {
+	ID        string `gorm:"primaryKey"`
+	Subject   string
+	Roles     string
+	Teams     string
+	Tenant    string
+	CSRFToken string
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// OIDCLogin is a login started and not finished yet.
+type OIDCLogin struct {
+	State     string `gorm:"primaryKey"`
+	Nonce     string
+	Verifier  string
+	ReturnTo  string
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// SessionInfo describes the session of the caller.
+type SessionInfo struct {
+	Subject   string
+	Roles     []string
+	Teams     []string
+	Tenant    string
+	CSRFToken string
+	ExpiresAt time.Time
+}
+
+// oidcProvider is the identity provider, its endpoints and keys are read
+// from its discovery document at the first login and again when they are
+// older than oidcKeysTTL.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       string
+	client       *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	verifier    *jwtVerifier
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+const (
+	// oidcKeysTTL is how long the discovery document and the keys of the
+	// provider are used before reading them again.
+	oidcKeysTTL = time.Hour
+	// oidcRefreshInterval is the shortest time between two reads, also when
+	// the tokens are signed by a key we don't know yet.
+	oidcRefreshInterval = time.Minute
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// newOIDCProvider returns nil when the login is not configured.
+func newOIDCProvider(cfg Config) *oidcProvider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		redirectURL:  cfg.OIDCRedirectURL,
+		scopes:       cfg.OIDCScopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// discover returns the discovery document and the keys of the provider.
+// They are read again when they are older than oidcKeysTTL or, with refresh,
+// when the provider may have rotated its keys, but at most once every
+// oidcRefreshInterval. When the provider cannot be reached the keys read
+// before are kept.
+func (p *oidcProvider) discover(now time.Time, refresh bool) (*oidcDiscovery, *jwtVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		stale := refresh || now.Sub(p.fetchedAt) >= oidcKeysTTL
+		if !stale || now.Sub(p.attemptedAt) < oidcRefreshInterval {
+			return p.discovery, p.verifier, nil
+		}
+	}
+	p.attemptedAt = now
+
+	var discovery oidcDiscovery
+	err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &discovery)
+	if err == nil && discovery.Issuer != p.issuer {
+		err = fmt.Errorf("the identity provider declares the issuer '%s'", discovery.Issuer)
+	}
+	var keys map[string]interface{}
+	if err == nil {
+		keys, err = p.readKeys(discovery.JWKSURI)
+	}
+	if err != nil {
+		if p.discovery != nil {
+			return p.discovery, p.verifier, nil
+		}
+		return nil, nil, err
+	}
+	p.discovery = &discovery
+	p.verifier = &jwtVerifier{keys: keys, issuer: p.issuer, audience: p.clientID, leeway: config.JWTLeeway}
+	p.fetchedAt = now
+	return p.discovery, p.verifier, nil
+}
+
+func (p *oidcProvider) readKeys(url string) (map[string]interface{}, error) {
+	response, err := p.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the keys of the identity provider: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the identity provider answered %d to %s", response.StatusCode, url)
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the keys of the identity provider: %w", err)
+	}
+	return parseJWKS(data)
+}
+
+func (p *oidcProvider) getJSON(url string, value interface{}) error {
+	response, err := p.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("cannot reach the identity provider: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the identity provider answered %d to %s", response.StatusCode, url)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+// exchange trades the authorization code for the claims of the ID token.
+func (p *oidcProvider) exchange(code string, verifier string, nonce string) (jwtClaims, error) {
+	now := time.Now()
+	discovery, tokenVerifier, err := p.discover(now, false)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the identity provider: %w", err)
+	}
+	defer response.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid answer of the identity provider: %w", err)
+	}
+	if response.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("the identity provider refused the code: %s", tokens.Error)
+	}
+	claims, err := tokenVerifier.verify(tokens.IDToken, now)
+	if errors.Is(err, errUnknownKey) {
+		// the provider may have rotated its keys
+		if _, tokenVerifier, err = p.discover(now, true); err == nil {
+			claims, err = tokenVerifier.verify(tokens.IDToken, now)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.stringValue("nonce") != nonce {
+		return nil, fmt.Errorf("the ID token has a wrong nonce")
+	}
+	return claims, nil
+}
+
+// randomString returns a random URL safe string.
+func randomString(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// pkceChallenge is the S256 code challenge of the verifier.
+func pkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func hashSessionToken(token string) string {
+	return hashAPIKey(token)
+}
+
+func setCookie(c *gin.Context, name string, value string, maxAge time.Duration) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   config.SessionCookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearCookie(c *gin.Context, name string) {
+	setCookie(c, name, "", -time.Second)
+}
+
+// unsafeMethod reports if the request can change something, the requests
+// authenticated by the session cookie need a CSRF token for them.
+func unsafeMethod(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+// authenticateSession returns the principal of the session cookie. The
+// requests that change something must send the CSRF token of the session.
+func authenticateSession(db *gorm.DB, c *gin.Context, token string, now time.Time) (*Principal, error) {
+	session, err := readSession(db, token, now)
+	if err != nil {
+		return nil, err
+	}
+	if unsafeMethod(c.Request.Method) &&
+		subtle.ConstantTimeCompare([]byte(c.GetHeader(csrfHeader)), []byte(session.CSRFToken)) != 1 {
+		return nil, errCSRF
+	}
+	return &Principal{
+		Subject: session.Subject,
+		Method:  "session",
+		Roles:   splitRoles(session.Roles),
+		Teams:   splitRoles(session.Teams),
+		Tenant:  session.Tenant,
+	}, nil
+}
+
+// safeReturnTo accepts only the paths of this server as the page to show
+// after the login.
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, `\`) {
+		return "/"
+	}
+	return returnTo
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// Login godoc.
+// @Summary      Sign in with the identity provider.
+// @Description  Redirects the browser to the identity provider with an authorization
+// @Description  code request protected by PKCE.
+// @tags         Auth
+// @Param        return_to  query  string  false  "Path to open after the login, / by default"
+// @Success      302
+// @Router       /auth/login [get]
+func login(provider *oidcProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		discovery, _, err := provider.discover(time.Now(), false)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		var values [3]string
+		for i := range values {
+			if values[i], err = randomString(32); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		state := OIDCLogin{
+			State:     values[0],
+			Nonce:     values[1],
+			Verifier:  values[2],
+			ReturnTo:  safeReturnTo(c.Query("return_to")),
+			ExpiresAt: time.Now().Add(loginTTL),
+		}
+		if err := saveLogin(db, &state); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {provider.clientID},
+			"redirect_uri":          {provider.redirectURL},
+			"scope":                 {provider.scopes},
+			"state":                 {state.State},
+			"nonce":                 {state.Nonce},
+			"code_challenge":        {pkceChallenge(state.Verifier)},
+			"code_challenge_method": {"S256"},
+		}
+		if hint := c.Query("login_hint"); hint != "" {
+			query.Set("login_hint", hint)
+		}
+		// the state is bound to this browser, a login started by somebody
+		// else cannot be completed here
+		setCookie(c, loginStateCookie, state.State, loginTTL)
+		c.Redirect(http.StatusFound, discovery.AuthorizationEndpoint+"?"+query.Encode())
+	}
+}
+
+// LoginCallback godoc.
+// @Summary      Complete the login.
+// @Description  Exchanges the code sent by the identity provider for an ID token, opens a
+// @Description  session and redirects to the page asked at the login.
+// @tags         Auth
+// @Param        code   query  string  true  "Authorization code"
+// @Param        state  query  string  true  "State of the login"
+// @Success      302
+// @Router       /auth/callback [get]
+func loginCallback(provider *oidcProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stateCookie, _ := c.Cookie(loginStateCookie)
+		clearCookie(c, loginStateCookie)
+		if stateCookie == "" || subtle.ConstantTimeCompare([]byte(stateCookie), []byte(c.Query("state"))) != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the login has not been started by this browser"})
+			return
+		}
+		state, err := takeLogin(db, c.Query("state"), time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if reason := c.Query("error"); reason != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "the identity provider refused the login: " + reason})
+			return
+		}
+		claims, err := provider.exchange(c.Query("code"), state.Verifier, state.Nonce)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		principal := principalFromClaims(claims, "session")
+		token, err := randomString(32)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		csrf, err := randomString(32)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		now := time.Now()
+		session := Session{
+			ID:        hashSessionToken(token),
+			Subject:   principal.Subject,
+			Roles:     strings.Join(principal.Roles, ","),
+			Teams:     strings.Join(principal.Teams, ","),
+			Tenant:    principal.Tenant,
+			CSRFToken: csrf,
+			CreatedAt: now,
+			ExpiresAt: now.Add(config.SessionTTL),
+		}
+		if err := saveSession(db, &session); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		setCookie(c, sessionCookie, token, config.SessionTTL)
+		c.Redirect(http.StatusFound, state.ReturnTo)
+	}
+}
+
+// GetSession godoc.
+// @Summary      Get the session of the browser.
+// @Description  Returns the user of the session and the CSRF token to send with the
+// @Description  X-CSRF-Token header.
+// @tags         Auth
+// @Produce      json
+// @Success      200  {object}  SessionInfo
+// @Router       /auth/session [get]
+func getSession(c *gin.Context) {
+	token, _ := c.Cookie(sessionCookie)
+	session, err := readSession(db, token, time.Now())
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, SessionInfo{
+		Subject:   session.Subject,
+		Roles:     splitRoles(session.Roles),
+		Teams:     splitRoles(session.Teams),
+		Tenant:    session.Tenant,
+		CSRFToken: session.CSRFToken,
+		ExpiresAt: session.ExpiresAt,
+	})
+}
+
+// Logout godoc.
+// @Summary      Sign out.
+// @Description  Closes the session of the browser, the X-CSRF-Token header is required.
+// @tags         Auth
+// @Param        X-CSRF-Token  header  string  true  "CSRF token of the session"
+// @Success      204
+// @Router       /auth/logout [post]
+func logout(c *gin.Context) {
+	token, _ := c.Cookie(sessionCookie)
+	if _, err := authenticateSession(db, c, token, time.Now()); err != nil {
+		c.JSON(errorStatus(err, http.StatusUnauthorized), gin.H{"error": err.Error()})
+		return
+	}
+	if err := deleteSession(db, token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	clearCookie(c, sessionCookie)
+	c.Status(http.StatusNoContent)
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// saveLogin stores a new login and forgets the ones never completed.
+func saveLogin(db *gorm.DB, login *OIDCLogin) error {
+	db.Where("expires_at < ?", time.Now()).Delete(OIDCLogin{})
+	if result := db.Create(login); result.Error != nil {
+		return wrapDBError(result.Error, "cannot save the login")
+	}
+	return nil
+}
+
+// takeLogin reads and deletes a login, so it can be completed only once.
+func takeLogin(db *gorm.DB, state string, now time.Time) (*OIDCLogin, error) {
+	var login OIDCLogin
+	result := db.Where("state = ?", state).Limit(1).Find(&login)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the login")
+	}
+	if result.RowsAffected != 1 || db.Delete(&login).RowsAffected != 1 || now.After(login.ExpiresAt) {
+		return nil, fmt.Errorf("the login is expired, start it again")
+	}
+	return &login, nil
+}
+
+// saveSession stores a new session and deletes the expired ones.
+func saveSession(db *gorm.DB, session *Session) error {
+	db.Where("expires_at < ?", session.CreatedAt).Delete(Session{})
+	if result := db.Create(session); result.Error != nil {
+		return wrapDBError(result.Error, "cannot save the session")
+	}
+	return nil
+}
+
+func readSession(db *gorm.DB, token string, now time.Time) (*Session, error) {
+	if token == "" {
+		return nil, fmt.Errorf("no session")
+	}
+	var session Session
+	result := db.Where("id = ? AND expires_at > ?", hashSessionToken(token), now).Limit(1).Find(&session)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the session")
+	}
+	if result.RowsAffected != 1 {
+		return nil, fmt.Errorf("the session is expired")
+	}
+	return &session, nil
+}
+
+func deleteSession(db *gorm.DB, token string) error {
+	if result := db.Where("id = ?", hashSessionToken(token)).Delete(Session{}); result.Error != nil {
+		return wrapDBError(result.Error, "cannot delete the session")
+	}
+	return nil
+}
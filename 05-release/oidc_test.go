@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLoginServer runs the API and the login with the mock identity provider
+// on a test server.
+func newLoginServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	setupTestDB(t)
+	r := newTestAPI(t)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	config.OIDCMock = true
+	config.OIDCIssuer = server.URL + "/mock-idp"
+	config.OIDCClientID = "contact-manager"
+	config.OIDCRedirectURL = server.URL + "/auth/callback"
+	config.SessionCookieSecure = false
+	limiter, err := newLimiter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registerLogin(r, config, limiter); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// newBrowser returns a client that keeps the cookies and does not follow the
+// redirects, so every step of the login can be checked.
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func browse(t *testing.T, client *http.Client, method string, target string, csrf string, body interface{}) *http.Response {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request, err := http.NewRequest(method, target, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if csrf != "" {
+		request.Header.Set(csrfHeader, csrf)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+// follow expects a redirect and returns its target.
+func follow(t *testing.T, response *http.Response) string {
+	t.Helper()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", response.StatusCode)
+	}
+	location, err := response.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.String()
+}
+
+func TestLogin(t *testing.T) {
+	server := newLoginServer(t)
+	browser := newBrowser(t)
+
+	// the login goes to the provider with a PKCE challenge, the provider
+	// comes back to the callback with the code and the state
+	authorize := follow(t, browse(t, browser, "GET", server.URL+"/auth/login?login_hint=alice&return_to=/contacts/", "", nil))
+	if !strings.HasPrefix(authorize, config.OIDCIssuer+"/authorize?") {
+		t.Fatalf("the login redirects to %s", authorize)
+	}
+	query := parseURL(t, authorize).Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" || query.Get("state") == "" {
+		t.Fatalf("the authorization request is not protected: %s", authorize)
+	}
+	callback := follow(t, browse(t, browser, "GET", authorize, "", nil))
+	if !strings.HasPrefix(callback, config.OIDCRedirectURL+"?") {
+		t.Fatalf("the provider redirects to %s", callback)
+	}
+	if returnTo := follow(t, browse(t, browser, "GET", callback, "", nil)); returnTo != server.URL+"/contacts/" {
+		t.Fatalf("the callback redirects to %s", returnTo)
+	}
+
+	// the session cookie authenticates the browser, the changes require the
+	// CSRF token
+	var session SessionInfo
+	response := browse(t, browser, "GET", server.URL+"/auth/session", "", nil)
+	if err := json.NewDecoder(response.Body).Decode(&session); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("cannot read the session: %d %v", response.StatusCode, err)
+	}
+	if session.Subject != "alice" || session.CSRFToken == "" {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	if response := browse(t, browser, "GET", server.URL+"/contacts/", "", nil); response.StatusCode != http.StatusOK {
+		t.Errorf("the session cannot read the contacts: %d", response.StatusCode)
+	}
+	if response := browse(t, browser, "POST", server.URL+"/contacts/", "", Contact{Name: "no csrf"}); response.StatusCode != http.StatusForbidden {
+		t.Errorf("a change without the CSRF token answers %d", response.StatusCode)
+	}
+	if response := browse(t, browser, "POST", server.URL+"/contacts/", "wrong", Contact{Name: "wrong csrf"}); response.StatusCode != http.StatusForbidden {
+		t.Errorf("a change with a wrong CSRF token answers %d", response.StatusCode)
+	}
+	if response := browse(t, browser, "POST", server.URL+"/contacts/", session.CSRFToken, Contact{Name: "csrf"}); response.StatusCode != http.StatusCreated {
+		t.Errorf("a change with the CSRF token answers %d", response.StatusCode)
+	}
+
+	// the logout requires the CSRF token too and closes the session
+	if response := browse(t, browser, "POST", server.URL+"/auth/logout", "", nil); response.StatusCode != http.StatusForbidden {
+		t.Errorf("a logout without the CSRF token answers %d", response.StatusCode)
+	}
+	if response := browse(t, browser, "POST", server.URL+"/auth/logout", session.CSRFToken, nil); response.StatusCode != http.StatusNoContent {
+		t.Fatalf("the logout answers %d", response.StatusCode)
+	}
+	if response := browse(t, browser, "GET", server.URL+"/auth/session", "", nil); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("the session is still open after the logout: %d", response.StatusCode)
+	}
+	if response := browse(t, browser, "GET", server.URL+"/contacts/", "", nil); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("the contacts are readable after the logout: %d", response.StatusCode)
+	}
+}
+
+func TestLoginRejectsBadState(t *testing.T) {
+	server := newLoginServer(t)
+
+	// a callback with a state that is not the one of the login
+	browser := newBrowser(t)
+	authorize := follow(t, browse(t, browser, "GET", server.URL+"/auth/login", "", nil))
+	callback := parseURL(t, follow(t, browse(t, browser, "GET", authorize, "", nil)))
+	query := callback.Query()
+	query.Set("state", "forged")
+	callback.RawQuery = query.Encode()
+	if response := browse(t, browser, "GET", callback.String(), "", nil); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("a callback with a forged state answers %d", response.StatusCode)
+	}
+
+	// a callback completed by another browser, that did not start the login
+	authorize = follow(t, browse(t, browser, "GET", server.URL+"/auth/login", "", nil))
+	stolen := follow(t, browse(t, browser, "GET", authorize, "", nil))
+	if response := browse(t, newBrowser(t), "GET", stolen, "", nil); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("a callback from another browser answers %d", response.StatusCode)
+	}
+
+	// a state used once cannot be used again
+	if follow(t, browse(t, browser, "GET", stolen, "", nil)) != server.URL+"/" {
+		t.Fatal("the login of the browser fails")
+	}
+	if response := browse(t, browser, "GET", stolen, "", nil); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("a replayed callback answers %d", response.StatusCode)
+	}
+	if response := browse(t, browser, "GET", server.URL+"/auth/session", "", nil); response.StatusCode != http.StatusOK {
+		t.Errorf("the session of the first callback is lost: %d", response.StatusCode)
+	}
+}
+
+func parseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// TestDiscoverKeys checks that the keys of the provider are read again when
+// they expire or are rotated, and that a failure keeps the last keys.
+func TestDiscoverKeys(t *testing.T) {
+	var kid string
+	status, reads := http.StatusOK, 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{Issuer: server.URL, JWKSURI: server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		reads++
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"keys": [{"kty": "RSA", "kid": %q, "n": "AQAB", "e": "AQAB"}]}`, kid)
+	})
+	provider := newOIDCProvider(Config{OIDCIssuer: server.URL})
+
+	now := time.Now()
+	for _, step := range []struct {
+		name    string
+		after   time.Duration
+		refresh bool
+		kid     string
+		status  int
+		reads   int
+		known   string
+	}{
+		{"first login", 0, false, "one", http.StatusOK, 1, "one"},
+		{"cached", 30 * time.Minute, false, "two", http.StatusOK, 1, "one"},
+		{"rotated", 30 * time.Minute, true, "two", http.StatusOK, 2, "two"},
+		{"rotated again too soon", 30*time.Minute + 30*time.Second, true, "three", http.StatusOK, 2, "two"},
+		{"expired", 2 * time.Hour, false, "three", http.StatusOK, 3, "three"},
+		{"provider failing", 4 * time.Hour, false, "four", http.StatusInternalServerError, 4, "three"},
+	} {
+		kid, status = step.kid, step.status
+		_, verifier, err := provider.discover(now.Add(step.after), step.refresh)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if _, ok := verifier.keys[step.known]; !ok || reads != step.reads {
+			t.Errorf("%s: %d reads of the keys %v", step.name, reads, verifier.keys)
+		}
+	}
+
+	// without the keys read before the failure is an error
+	if _, _, err := newOIDCProvider(Config{OIDCIssuer: server.URL}).discover(now, false); err == nil {
+		t.Error("the keys of the failing provider are accepted")
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The privacy requests of the data subjects, the people in the contacts: the
+// export of everything we hold about a person and the erasure. Both are for
+// the admins, the erasure leaves a certificate in the audit log.
+
+// SubjectExport is everything held about a contact.
+type SubjectExport struct {
+	ExportedAt         time.Time
+	Contact            Contact
+	AddressBook        string
+	Tasks              []Task
+	Timeline           []Activity
+	ExternalReferences []ExternalReference
+	Tags               []string
+	// Consents are all the consent records, the withdrawn ones too.
+	Consents []Consent
+	// AccessHistory is the audit log of the contact: who read, exported
+	// or changed it.
+	AccessHistory []AuditEntry
+}
+
+const (
+	// EraseDelete removes the contact and all its data.
+	EraseDelete = "delete"
+	// ErasePseudonymize keeps the records without the personal data, the
+	// contact gets a random name that cannot be linked to the person.
+	ErasePseudonymize = "pseudonymize"
+)
+
+// ErasureRequest is the body of an erasure.
+type ErasureRequest struct {
+	// Mode is "delete", the default, or "pseudonymize".
+	Mode   string
+	Reason string
+}
+
+// ErasureCertificate proves that the data of a contact has been erased, it
+// is written in the audit log.
+type ErasureCertificate struct {
+	ContactID uint
+	Mode      string
+	Reason    string
+	ErasedAt  time.Time
+	ErasedBy  string
+	// Records are the records erased or pseudonymized for every kind.
+	Records map[string]int64
+	// AuditSeq and AuditHash identify the entry of the certificate in the
+	// audit log.
+	AuditSeq  uint64
+	AuditHash string
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// ExportSubject godoc.
+// @Summary      Export the data of a person.
+// @Description  Returns everything held about a contact, for a request of access or of
+// @Description  portability: the contact, its tasks, its timeline, its external ids and
+// @Description  the history of the accesses.
+// @tags         Privacy
+// @Produce      json
+// @Param 		 id  path int true "Contact ID"
+// @Success      200  {object}  SubjectExport
+// @Router       /privacy/subjects/{id}/export [get]
+func exportSubject(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auditContacts(c, uint(contactId))
+	export, err := readSubjectExport(db, uint(contactId))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="subject-%d.json"`, contactId))
+	c.JSON(http.StatusOK, export)
+}
+
+// EraseSubject godoc.
+// @Summary      Erase the data of a person.
+// @Description  Deletes a contact with all its data, or pseudonymizes it keeping the records
+// @Description  without the personal data. The data is removed from every table, the
+// @Description  returned certificate of erasure is written in the audit log.
+// @tags         Privacy
+// @Accept       json
+// @Produce      json
+// @Param 		 id    path  int             true   "Contact ID"
+// @Param        Body  body  ErasureRequest  false  "The mode and the reason of the erasure"
+// @Success      200  {object}  ErasureCertificate
+// @Router       /privacy/subjects/{id}/erase [post]
+func eraseSubject(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auditContacts(c, uint(contactId))
+	request := ErasureRequest{Mode: EraseDelete}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Mode == "" {
+		request.Mode = EraseDelete
+	}
+	if request.Mode != EraseDelete && request.Mode != ErasePseudonymize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown mode '%s', use %s or %s", request.Mode, EraseDelete, ErasePseudonymize)})
+		return
+	}
+
+	records, err := eraseContact(db, uint(contactId), request.Mode)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	certificate := ErasureCertificate{
+		ContactID: uint(contactId),
+		Mode:      request.Mode,
+		Reason:    request.Reason,
+		ErasedAt:  time.Now().UTC(),
+		ErasedBy:  currentPrincipal(c).Subject,
+		Records:   records,
+	}
+	auditDB := db.WithContext(withTenant(context.Background(), currentTenant(c)))
+	if err := saveErasureCertificate(auditDB, currentPrincipal(c), c.ClientIP(), currentTenant(c), &certificate); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, certificate)
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+func readSubjectExport(db *gorm.DB, contactId uint) (*SubjectExport, error) {
+	contact, err := readContactById(db, contactId)
+	if err != nil {
+		return nil, &accessError{status: http.StatusNotFound, message: err.Error()}
+	}
+	export := SubjectExport{
+		ExportedAt:         time.Now().UTC(),
+		Contact:            *contact,
+		Tasks:              []Task{},
+		Timeline:           []Activity{},
+		ExternalReferences: []ExternalReference{},
+	}
+	var book AddressBook
+	if result := db.Limit(1).Find(&book, AddressBook{ID: contact.AddressBookID}); result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the address book of contact with id '%d'", contactId)
+	}
+	export.AddressBook = book.Name
+	if result := db.Where("contact_id = ?", contactId).Order("due_at").Find(&export.Tasks); result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the tasks of contact with id '%d'", contactId)
+	}
+	if result := db.Where("contact_id = ?", contactId).Order("occurred_at").Find(&export.Timeline); result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the timeline of contact with id '%d'", contactId)
+	}
+	if export.ExternalReferences, err = readExternalReferences(db, contactId); err != nil {
+		return nil, err
+	}
+	if export.Tags, err = readContactTags(db, contactId); err != nil {
+		return nil, err
+	}
+	if export.Consents, err = readConsents(db, ConsentFilter{ContactID: contactId, History: true}); err != nil {
+		return nil, err
+	}
+	err = readAuditEntriesInBatches(db, AuditFilter{ContactID: contactId}, func(entries []AuditEntry) error {
+		export.AccessHistory = append(export.AccessHistory, entries...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// eraseContact deletes or pseudonymizes a contact and removes its personal
+// data from the other tables: the cached responses of the idempotency keys
+// and the files of the finished imports. It returns the number of records
+// erased for every kind. The audit log keeps only the id of the contact and
+// is not changed.
+func eraseContact(db *gorm.DB, contactId uint, mode string) (map[string]int64, error) {
+	records := map[string]int64{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		contact, err := readContactById(tx, contactId)
+		if err != nil {
+			return &accessError{status: http.StatusNotFound, message: err.Error()}
+		}
+		var counts [5]int64
+		for i, model := range []interface{}{Task{}, Activity{}, ExternalReference{}, ContactTag{}, Consent{}} {
+			if result := tx.Model(model).Where("contact_id = ?", contactId).Count(&counts[i]); result.Error != nil {
+				return wrapDBError(result.Error, "cannot count the data of contact with id '%d'", contactId)
+			}
+		}
+		if mode == ErasePseudonymize {
+			if err := anonymizeContact(tx, contactId); err != nil {
+				return err
+			}
+		} else if err := deleteContact(tx, contactId); err != nil {
+			return err
+		}
+		records["contacts"] = 1
+		records["tasks"], records["activities"], records["externalReferences"] = counts[0], counts[1], counts[2]
+		records["tags"] = counts[3]
+		if mode == EraseDelete {
+			records["consents"] = counts[4]
+		}
+
+		if records["idempotencyRecords"], err = eraseIdempotencyRecords(tx, contact); err != nil {
+			return err
+		}
+		if records["importFiles"], err = eraseImportPayloads(tx, contact); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// anonymizeContact replaces the personal data of the contact with a random
+// name, and removes the texts of its tasks and timeline, that can name the
+// person, its tags, and its external ids, that link it to the other systems.
+// The consents keep their purpose, status and dates, without the source and
+// the user that recorded them. The records are kept with their dates and
+// states.
+func anonymizeContact(db *gorm.DB, contactId uint) error {
+	pseudonym, err := randomString(9)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(Contact{}).Where("id = ?", contactId).Updates(map[string]interface{}{
+			"name":          "Anonymous " + pseudonym,
+			"phone":         "",
+			"address":       "",
+			"email":         "",
+			"website":       "",
+			"notes":         "",
+			"anonymized_at": time.Now(),
+		})
+		if result.Error != nil {
+			return wrapDBError(result.Error, "cannot anonymize contact with id '%d'", contactId)
+		}
+		if result.RowsAffected != 1 {
+			return fmt.Errorf("cannot anonymize contact with id '%d'", contactId)
+		}
+		if result := tx.Model(Task{}).Where("contact_id = ?", contactId).Updates(map[string]interface{}{
+			"title": "Anonymized", "description": "",
+		}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot anonymize the tasks of contact with id '%d'", contactId)
+		}
+		if result := tx.Model(Activity{}).Where("contact_id = ?", contactId).Update("body", ""); result.Error != nil {
+			return wrapDBError(result.Error, "cannot anonymize the timeline of contact with id '%d'", contactId)
+		}
+		if result := tx.Where("contact_id = ?", contactId).Delete(ExternalReference{}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete the external ids of contact with id '%d'", contactId)
+		}
+		if result := tx.Where("contact_id = ?", contactId).Delete(ContactTag{}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot delete the tags of contact with id '%d'", contactId)
+		}
+		if result := tx.Model(Consent{}).Where("contact_id = ?", contactId).Updates(map[string]interface{}{
+			"source": "", "recorded_by": "",
+		}); result.Error != nil {
+			return wrapDBError(result.Error, "cannot anonymize the consents of contact with id '%d'", contactId)
+		}
+		return nil
+	})
+}
+
+// personalValues are the values that identify the contact in a text.
+func personalValues(contact *Contact) [][]byte {
+	var values [][]byte
+	for _, value := range []string{contact.Name, contact.Email, contact.Phone} {
+		if len(value) >= 3 {
+			values = append(values, []byte(value))
+		}
+	}
+	return values
+}
+
+// containsValues restricts a query to the rows where the column contains one
+// of the values, the database searches the payloads without sending them.
+func containsValues(column string, values [][]byte) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if len(values) == 0 {
+			return db.Where("1 = 0")
+		}
+		match := "instr(%s, ?) > 0"
+		if db.Dialector.Name() == "postgres" {
+			match = "position(? in %s) > 0"
+		}
+		conditions := make([]string, len(values))
+		args := make([]interface{}, len(values))
+		for i, value := range values {
+			conditions[i] = fmt.Sprintf(match, column)
+			args[i] = value
+		}
+		return db.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+}
+
+// containsAny tells whether the data contains one of the values.
+func containsAny(data []byte, values [][]byte) bool {
+	for _, value := range values {
+		if bytes.Contains(data, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// eraseIdempotencyRecords deletes the cached responses that contain the
+// data of the contact, a retry of those requests is executed again. Only the
+// responses of the tenant of the contact, that had not expired when it was
+// created, can contain it.
+func eraseIdempotencyRecords(db *gorm.DB, contact *Contact) (int64, error) {
+	values := personalValues(contact)
+	query := db.Model(IdempotencyRecord{}).
+		Where("tenant_id = ? AND status <> 0 AND expires_at > ?", contact.TenantID, contact.CreatedAt)
+	var keys []string
+	if encryption == nil {
+		if result := query.Scopes(containsValues("body", values)).Pluck("key", &keys); result.Error != nil {
+			return 0, wrapDBError(result.Error, "cannot read the idempotency records")
+		}
+	} else {
+		// the encrypted responses are searched once decrypted
+		var records []IdempotencyRecord
+		result := query.FindInBatches(&records, contactsBatchSize, func(tx *gorm.DB, batch int) error {
+			for _, record := range records {
+				if containsAny(record.Body, values) {
+					keys = append(keys, record.Key)
+				}
+			}
+			return nil
+		})
+		if result.Error != nil {
+			return 0, wrapDBError(result.Error, "cannot read the idempotency records")
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if result := db.Where("key IN ?", keys).Delete(IdempotencyRecord{}); result.Error != nil {
+		return 0, wrapDBError(result.Error, "cannot delete the idempotency records")
+	}
+	return int64(len(keys)), nil
+}
+
+// eraseImportPayloads removes the files of the finished imports of the
+// tenant of the contact that contain its data, the reports of the imports
+// are kept.
+func eraseImportPayloads(db *gorm.DB, contact *Contact) (int64, error) {
+	values := personalValues(contact)
+	query := db.Model(ImportJob{}).
+		Where("tenant_id = ? AND status IN ? AND payload IS NOT NULL", contact.TenantID, []string{ImportCompleted, ImportFailed, ImportCancelled})
+	var ids []uint
+	if encryption == nil {
+		if result := query.Scopes(containsValues("payload", values)).Pluck("id", &ids); result.Error != nil {
+			return 0, wrapDBError(result.Error, "cannot read the import jobs")
+		}
+	} else {
+		// the encrypted files are searched once decrypted
+		var jobs []ImportJob
+		result := query.FindInBatches(&jobs, 10, func(tx *gorm.DB, batch int) error {
+			for _, job := range jobs {
+				if containsAny(job.Payload, values) {
+					ids = append(ids, job.ID)
+				}
+			}
+			return nil
+		})
+		if result.Error != nil {
+			return 0, wrapDBError(result.Error, "cannot read the import jobs")
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if result := db.Model(ImportJob{}).Where("id IN ?", ids).Update("payload", nil); result.Error != nil {
+		return 0, wrapDBError(result.Error, "cannot erase the files of the import jobs")
+	}
+	return int64(len(ids)), nil
+}
+
+// saveErasureCertificate writes the certificate in the audit log and sets its
+// position in the chain.
+func saveErasureCertificate(db *gorm.DB, principal *Principal, ip string, tenant string, certificate *ErasureCertificate) error {
+	detail, err := json.Marshal(certificate)
+	if err != nil {
+		return err
+	}
+	entry := AuditEntry{
+		TenantID:   tenant,
+		CreatedAt:  certificate.ErasedAt,
+		Actor:      certificate.ErasedBy,
+		AuthMethod: principal.Method,
+		IP:         ip,
+		Action:     "erase",
+		Route:      "POST /privacy/subjects/:id/erase",
+		Path:       fmt.Sprintf("/privacy/subjects/%d/erase", certificate.ContactID),
+		ContactIDs: []uint{certificate.ContactID},
+		Status:     http.StatusOK,
+		Result:     AuditSuccess,
+		Detail:     "certificate of erasure: " + string(detail),
+	}
+	if err := appendAuditEntry(db, &entry); err != nil {
+		return err
+	}
+	certificate.AuditSeq = entry.Seq
+	certificate.AuditHash = entry.Hash
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestEraseSubject checks that a pseudonymized contact keeps no personal
+// data, and that the erasure removes the copies of the data of the tenant
+// of the contact only.
+func TestEraseSubject(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	key := createTestAPIKey(t, "alpha", "admin", RoleAdmin)
+
+	var contact Contact
+	decodeResponse(t, testRequest(t, r, key, "POST", "/contacts/",
+		Contact{Name: "Jane Roe", Email: "jane@example.com"}), http.StatusCreated, &contact)
+	decodeResponse(t, testRequest(t, r, key, "PUT", fmt.Sprintf("/contacts/%d/tags/vip", contact.ID), nil), http.StatusNoContent, nil)
+	decodeResponse(t, testRequest(t, r, key, "POST", fmt.Sprintf("/contacts/%d/consents", contact.ID),
+		Consent{Purpose: "newsletter", Status: ConsentGranted, Source: "call with Jane"}), http.StatusCreated, nil)
+
+	// the same data is cached in both tenants
+	now := time.Now()
+	body := []byte(`{"Name": "Jane Roe", "Email": "jane@example.com"}`)
+	for _, tenant := range []string{"alpha", "beta"} {
+		scoped := db.WithContext(withTenant(context.Background(), tenant))
+		record := IdempotencyRecord{Key: tenant + "-key", Status: http.StatusCreated, Body: body, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+		if result := scoped.Create(&record); result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		job := ImportJob{Format: "json", Status: ImportCompleted, Payload: body}
+		if result := scoped.Create(&job); result.Error != nil {
+			t.Fatal(result.Error)
+		}
+	}
+
+	var certificate ErasureCertificate
+	decodeResponse(t, testRequest(t, r, key, "POST", fmt.Sprintf("/privacy/subjects/%d/erase", contact.ID),
+		ErasureRequest{Mode: ErasePseudonymize}), http.StatusOK, &certificate)
+	if certificate.Records["tags"] != 1 || certificate.Records["idempotencyRecords"] != 1 || certificate.Records["importFiles"] != 1 {
+		t.Errorf("unexpected records in the certificate: %v", certificate.Records)
+	}
+
+	var tags []string
+	decodeResponse(t, testRequest(t, r, key, "GET", fmt.Sprintf("/contacts/%d/tags", contact.ID), nil), http.StatusOK, &tags)
+	if len(tags) != 0 {
+		t.Errorf("the pseudonymized contact keeps its tags: %v", tags)
+	}
+	var consents []Consent
+	decodeResponse(t, testRequest(t, r, key, "GET", fmt.Sprintf("/contacts/%d/consents", contact.ID), nil), http.StatusOK, &consents)
+	if len(consents) != 1 || consents[0].Status != ConsentGranted || consents[0].Source != "" || consents[0].RecordedBy != "" {
+		t.Errorf("the consents of the pseudonymized contact are not anonymized: %+v", consents)
+	}
+
+	for tenant, kept := range map[string]bool{"alpha": false, "beta": true} {
+		scoped := db.WithContext(withTenant(context.Background(), tenant))
+		var records, payloads int64
+		scoped.Model(IdempotencyRecord{}).Count(&records)
+		scoped.Model(ImportJob{}).Where("payload IS NOT NULL").Count(&payloads)
+		if (records == 1) != kept || (payloads == 1) != kept {
+			t.Errorf("tenant %s: %d idempotency records and %d import files left", tenant, records, payloads)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every client has a token bucket for each budget: a request takes a token
+// and the bucket is refilled at a constant rate up to its size. The client is
+// the API key, the user or, for the anonymous callers, the IP address. The
+// reads, the writes and the exports have separate budgets, so a script that
+// exports all the contacts does not stop the users from working. The client
+// is only known after the authentication, the requests are first counted by
+// IP address, so a flood of wrong credentials or of logins is limited too.
+const (
+	budgetRead   = "read"
+	budgetWrite  = "write"
+	budgetExport = "export"
+	budgetIP     = "ip"
+)
+
+// budgetRoutes are the routes that do not use the budget of their method.
+var budgetRoutes = map[string]string{
+	"GET /contacts/export.csv":         budgetExport,
+	"GET /audit/export.jsonl":          budgetExport,
+	"GET /privacy/subjects/:id/export": budgetExport,
+}
+
+// RateLimit is the size of a bucket and the time it takes to fill it.
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+}
+
+// parseRateLimit reads a limit like "600/1m", 600 requests per minute. An
+// empty limit or "0" means unlimited and returns nil.
+func parseRateLimit(value string) (*RateLimit, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return nil, nil
+	}
+	count, period, ok := strings.Cut(value, "/")
+	limit, err := strconv.Atoi(count)
+	if !ok || err != nil || limit < 0 {
+		return nil, fmt.Errorf("invalid rate limit '%s', use e.g. 600/1m", value)
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("invalid rate limit '%s', use e.g. 600/1m", value)
+	}
+	// the buckets are refilled every millisecond
+	if duration < time.Millisecond {
+		return nil, fmt.Errorf("invalid rate limit '%s', the period is shorter than 1ms", value)
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	return &RateLimit{Limit: limit, Period: duration}, nil
+}
+
+// rate is the number of tokens added to the bucket every millisecond.
+func (l RateLimit) rate() float64 {
+	return float64(l.Limit) / float64(l.Period.Milliseconds())
+}
+
+// RateLimitResult is the state of a bucket after a request.
+type RateLimitResult struct {
+	Allowed bool
+	// Tokens left in the bucket.
+	Tokens float64
+}
+
+// RateLimitStore keeps the buckets. The memory store is enough for a single
+// instance, the instances behind a load balancer share a redis store.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+func newRateLimitStore(cfg Config) (RateLimitStore, error) {
+	switch cfg.RateLimitStore {
+	case "", "memory":
+		return &memoryRateLimitStore{buckets: make(map[string]*bucket)}, nil
+	case "redis":
+		if cfg.RedisAddr == "" {
+			return nil, fmt.Errorf("the redis rate limit store requires REDIS_ADDR")
+		}
+		return &redisRateLimitStore{
+			client: &redisClient{addr: cfg.RedisAddr, password: cfg.RedisPassword, db: cfg.RedisDB, idle: make(chan *redisConn, 8)},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown rate limit store '%s'", cfg.RateLimitStore)
+}
+
+// Limiter applies the budgets to the requests.
+type Limiter struct {
+	store   RateLimitStore
+	budgets map[string]*RateLimit
+}
+
+func newLimiter(cfg Config) (*Limiter, error) {
+	store, err := newRateLimitStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	limiter := &Limiter{store: store, budgets: make(map[string]*RateLimit)}
+	for budget, value := range map[string]string{
+		budgetRead:   cfg.RateLimitRead,
+		budgetWrite:  cfg.RateLimitWrite,
+		budgetExport: cfg.RateLimitExport,
+		budgetIP:     cfg.RateLimitIP,
+	} {
+		if limiter.budgets[budget], err = parseRateLimit(value); err != nil {
+			return nil, err
+		}
+	}
+	return limiter, nil
+}
+
+// routeBudget returns the budget used by a route.
+func routeBudget(method string, path string) string {
+	if budget, ok := budgetRoutes[method+" "+path]; ok {
+		return budget
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return budgetRead
+	}
+	return budgetWrite
+}
+
+// rateLimitClient returns the key of the caller, the API key or the user
+// within its tenant or the IP address of the anonymous callers.
+func rateLimitClient(c *gin.Context) string {
+	principal := currentPrincipal(c)
+	switch principal.Method {
+	case "none":
+		return "ip:" + c.ClientIP()
+	case "apikey":
+		return principal.Tenant + "/" + principal.Subject
+	}
+	return principal.Tenant + "/user:" + principal.Subject
+}
+
+// rateLimit refuses with 429 the requests of the clients that have used
+// their budget. The responses carry the RateLimit headers, the client can
+// slow down before being refused.
+func rateLimit(limiter *Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		budget := routeBudget(c.Request.Method, c.FullPath())
+		if limiter.take(c, budget, rateLimitClient(c), true) {
+			c.Next()
+		}
+	}
+}
+
+// rateLimitIP refuses with 429 the requests of the IP addresses that have
+// used their budget, before the authentication. Only the refused responses
+// carry the RateLimit headers, the others have the ones of the client.
+func rateLimitIP(limiter *Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiter.take(c, budgetIP, "ip:"+c.ClientIP(), false) {
+			c.Next()
+		}
+	}
+}
+
+// take takes a token of the budget of the client, it aborts the request and
+// returns false when the budget is used. When the store fails the requests
+// are allowed, a broken store must not stop the API.
+func (limiter *Limiter) take(c *gin.Context, budget string, client string, headers bool) bool {
+	limit := limiter.budgets[budget]
+	if limit == nil {
+		return true
+	}
+	key := "ratelimit:" + budget + ":" + client
+	result, err := limiter.store.Take(c.Request.Context(), key, *limit, time.Now())
+	if err != nil {
+		slog.WarnContext(c.Request.Context(), "cannot check the rate limit", "key", key, "error", err)
+		return true
+	}
+
+	rate := limit.rate()
+	if headers || !result.Allowed {
+		reset := math.Ceil((float64(limit.Limit) - result.Tokens) / rate / 1000)
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d;name=%q", limit.Limit, int(limit.Period.Seconds()), budget))
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(int(result.Tokens)))
+		c.Header("RateLimit-Reset", strconv.Itoa(int(reset)))
+	}
+	if !result.Allowed {
+		retry := int(math.Ceil((1 - result.Tokens) / rate / 1000))
+		c.Header("Retry-After", strconv.Itoa(retry))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error": fmt.Sprintf("too many %s requests, retry in %d seconds", budget, retry),
+		})
+		return false
+	}
+	return true
+}
+
+// bucket is a token bucket of the memory store.
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// memoryRateLimitStore keeps the buckets in the memory of the process, the
+// full ones are removed from time to time.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.sweep(now)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Limit), at: now}
+		s.buckets[key] = b
+	}
+	elapsed := float64(now.Sub(b.at).Milliseconds())
+	b.tokens = math.Min(float64(limit.Limit), b.tokens+math.Max(0, elapsed)*limit.rate())
+	b.at = now
+	if b.tokens < 1 {
+		return RateLimitResult{Allowed: false, Tokens: b.tokens}, nil
+	}
+	b.tokens--
+	return RateLimitResult{Allowed: true, Tokens: b.tokens}, nil
+}
+
+// sweep removes the buckets not used for an hour, they are full for any
+// reasonable limit and are the same as a missing bucket.
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.at) > time.Hour {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// redisRateLimitStore keeps the buckets in Redis, or in a server that speaks
+// its protocol like Valkey or KeyDB. A Lua script updates the bucket
+// atomically, the key expires when the bucket would be full again.
+type redisRateLimitStore struct {
+	client *redisClient
+}
+
+const takeTokenScript = `
+local limit = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(bucket[1]) or limit
+local at = tonumber(bucket[2]) or now
+tokens = math.min(limit, tokens + math.max(0, now - at) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(limit / rate))
+return {allowed, tostring(tokens)}
+`
+
+func (s *redisRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	reply, err := s.client.do(ctx, "EVAL", takeTokenScript, "1", key,
+		strconv.Itoa(limit.Limit), strconv.FormatFloat(limit.rate(), 'g', -1, 64), strconv.FormatInt(now.UnixMilli(), 10))
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return RateLimitResult{}, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	text, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+	return RateLimitResult{Allowed: allowed == 1, Tokens: tokens}, nil
+}
+
+// redisClient is a minimal client of the Redis protocol (RESP), enough for
+// the commands of the rate limiter. The connections are reused.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (r *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := r.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ctx, args...)
+	var replyError redisError
+	if err != nil && !errors.As(err, &replyError) {
+		conn.conn.Close()
+		return nil, err
+	}
+	r.put(conn)
+	return reply, err
+}
+
+func (r *redisClient) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-r.idle:
+		return conn, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	netConn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to redis: %w", err)
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if r.password != "" {
+		if _, err := conn.do(ctx, "AUTH", r.password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(r.db)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (r *redisClient) put(conn *redisConn) {
+	select {
+	case r.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+func (c *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	c.conn.SetDeadline(deadline)
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read parses a reply: the integers are int64, the strings string, the
+// arrays []interface{} and the nil replies nil.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("invalid reply from redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, size)
+		for i := range values {
+			if values[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("invalid reply from redis: %q", line)
+}
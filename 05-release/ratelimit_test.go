@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		limit *RateLimit
+		err   bool
+	}{
+		{value: ""},
+		{value: "0"},
+		{value: "0/1m"},
+		{value: "600/1m", limit: &RateLimit{Limit: 600, Period: time.Minute}},
+		{value: " 10/1h ", limit: &RateLimit{Limit: 10, Period: time.Hour}},
+		{value: "5/1ms", limit: &RateLimit{Limit: 5, Period: time.Millisecond}},
+		{value: "5/500us", err: true},
+		{value: "5/1ns", err: true},
+		{value: "5/0s", err: true},
+		{value: "5/-1m", err: true},
+		{value: "-5/1m", err: true},
+		{value: "five/1m", err: true},
+		{value: "600", err: true},
+	} {
+		limit, err := parseRateLimit(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("parseRateLimit(%q) returns the error %v", test.value, err)
+			continue
+		}
+		if (limit == nil) != (test.limit == nil) || limit != nil && *limit != *test.limit {
+			t.Errorf("parseRateLimit(%q) = %+v, expected %+v", test.value, limit, test.limit)
+		}
+	}
+}
+
+func TestMemoryBucket(t *testing.T) {
+	store := &memoryRateLimitStore{buckets: make(map[string]*bucket)}
+	limit := RateLimit{Limit: 3, Period: 3 * time.Second}
+	now := time.Now()
+	take := func(key string, at time.Time) RateLimitResult {
+		t.Helper()
+		result, err := store.Take(context.Background(), key, limit, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// a new bucket is full
+	for i := 2; i >= 0; i-- {
+		if result := take("a", now); !result.Allowed || result.Tokens != float64(i) {
+			t.Fatalf("expected %d tokens left, got %+v", i, result)
+		}
+	}
+	if result := take("a", now); result.Allowed {
+		t.Fatalf("the empty bucket allows a request: %+v", result)
+	}
+	// the buckets are separate
+	if result := take("b", now); !result.Allowed {
+		t.Fatalf("the bucket of another client is empty: %+v", result)
+	}
+	// a token every second
+	if result := take("a", now.Add(500*time.Millisecond)); result.Allowed {
+		t.Fatalf("the bucket is refilled too fast: %+v", result)
+	}
+	if result := take("a", now.Add(time.Second)); !result.Allowed || result.Tokens != 0 {
+		t.Fatalf("the bucket is not refilled: %+v", result)
+	}
+	// never above the limit
+	if result := take("a", now.Add(time.Hour)); !result.Allowed || result.Tokens != 2 {
+		t.Fatalf("the bucket is filled over the limit: %+v", result)
+	}
+	// a clock that goes back does not take tokens
+	if result := take("a", now.Add(time.Hour-time.Minute)); !result.Allowed || result.Tokens != 1 {
+		t.Fatalf("a clock going back changes the bucket: %+v", result)
+	}
+}
+
+func TestMemoryBucketSweep(t *testing.T) {
+	store := &memoryRateLimitStore{buckets: make(map[string]*bucket)}
+	limit := RateLimit{Limit: 1, Period: time.Minute}
+	now := time.Now()
+	store.Take(context.Background(), "old", limit, now)
+	store.Take(context.Background(), "new", limit, now.Add(2*time.Hour))
+	if _, ok := store.buckets["old"]; ok {
+		t.Error("the unused bucket has not been removed")
+	}
+	if _, ok := store.buckets["new"]; !ok {
+		t.Error("the bucket in use has been removed")
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := &Limiter{
+		store:   &memoryRateLimitStore{buckets: make(map[string]*bucket)},
+		budgets: map[string]*RateLimit{budgetRead: {Limit: 2, Period: time.Minute}, budgetIP: {Limit: 3, Period: time.Minute}},
+	}
+	r := gin.New()
+	r.GET("/contacts/", rateLimitIP(limiter), func(c *gin.Context) {
+		c.Set(principalKey, &Principal{Subject: "alice", Method: "jwt", Tenant: "t"})
+	}, rateLimit(limiter), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for i, expected := range []struct {
+		status    int
+		remaining string
+		budget    string
+	}{
+		{http.StatusOK, "1", "read"},
+		{http.StatusOK, "0", "read"},
+		{http.StatusTooManyRequests, "0", "read"},
+		{http.StatusTooManyRequests, "0", "ip"},
+	} {
+		response := testRequest(t, r, "", "GET", "/contacts/", nil)
+		if response.Code != expected.status {
+			t.Fatalf("request %d: expected %d, got %d", i, expected.status, response.Code)
+		}
+		if remaining := response.Header().Get("RateLimit-Remaining"); remaining != expected.remaining {
+			t.Errorf("request %d: %s tokens left, expected %s", i, remaining, expected.remaining)
+		}
+		if policy := response.Header().Get("RateLimit-Policy"); !strings.Contains(policy, `name="`+expected.budget+`"`) {
+			t.Errorf("request %d: the policy %s is not the one of the %s budget", i, policy, expected.budget)
+		}
+		if expected.status == http.StatusTooManyRequests && response.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d: the refused request has no Retry-After", i)
+		}
+	}
+}
+
+// TestRateLimitBeforeAuthentication checks that the requests with wrong
+// credentials are limited too.
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	setupTestDB(t)
+	config.RateLimitIP = "2/1m"
+	r := newTestAPI(t)
+	for i, status := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if response := testRequest(t, r, "cm_wrong_key", "GET", "/contacts/", nil); response.Code != status {
+			t.Errorf("request %d: expected %d, got %d", i, status, response.Code)
+		}
+	}
+}
+
+// fakeRedis answers the commands it receives with the replies, in order, and
+// sends the commands on the channel.
+func fakeRedis(t *testing.T, replies ...string) (string, <-chan []string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	commands := make(chan []string, len(replies))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					var count int
+					if _, err := fmt.Fscanf(reader, "*%d\r\n", &count); err != nil {
+						return
+					}
+					command := make([]string, count)
+					for i := range command {
+						var size int
+						if _, err := fmt.Fscanf(reader, "$%d\r\n", &size); err != nil {
+							return
+						}
+						data := make([]byte, size+2)
+						if _, err := io.ReadFull(reader, data); err != nil {
+							return
+						}
+						command[i] = string(data[:size])
+					}
+					commands <- command
+					if len(replies) == 0 {
+						return
+					}
+					conn.Write([]byte(replies[0]))
+					replies = replies[1:]
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), commands
+}
+
+func TestRedisReply(t *testing.T) {
+	for _, test := range []struct {
+		reply    string
+		expected interface{}
+		err      string
+	}{
+		{reply: "+OK\r\n", expected: "OK"},
+		{reply: ":42\r\n", expected: int64(42)},
+		{reply: "$5\r\nhello\r\n", expected: "hello"},
+		{reply: "$0\r\n\r\n", expected: ""},
+		{reply: "$-1\r\n", expected: nil},
+		{reply: "*2\r\n:1\r\n$3\r\n2.5\r\n", expected: []interface{}{int64(1), "2.5"}},
+		{reply: "*-1\r\n", expected: nil},
+		{reply: "-ERR wrong\r\n", err: "redis: ERR wrong"},
+		{reply: "?\r\n", err: "invalid reply"},
+		{reply: "$5\r\nhel", err: "EOF"},
+	} {
+		conn := &redisConn{reader: bufio.NewReader(strings.NewReader(test.reply))}
+		reply, err := conn.read()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected the error %q, got %v", test.reply, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.reply, err)
+			continue
+		}
+		if fmt.Sprint(reply) != fmt.Sprint(test.expected) {
+			t.Errorf("%q: expected %#v, got %#v", test.reply, test.expected, reply)
+		}
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	addr, commands := fakeRedis(t, "+OK\r\n", "+OK\r\n", "*2\r\n:1\r\n$3\r\n2.5\r\n", "-NOSCRIPT no script\r\n", "*2\r\n:0\r\n$3\r\n0.5\r\n")
+	client := &redisClient{addr: addr, password: "secret", db: 2, idle: make(chan *redisConn, 8)}
+	store := &redisRateLimitStore{client: client}
+	limit := RateLimit{Limit: 3, Period: 3 * time.Second}
+	now := time.UnixMilli(1700000000000)
+
+	result, err := store.Take(context.Background(), "ratelimit:read:t/alice", limit, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed || result.Tokens != 2.5 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	// the connection is authenticated and selects the database, once
+	for _, expected := range [][]string{
+		{"AUTH", "secret"},
+		{"SELECT", "2"},
+		{"EVAL", takeTokenScript, "1", "ratelimit:read:t/alice", "3", "0.001", "1700000000000"},
+	} {
+		if command := <-commands; fmt.Sprint(command) != fmt.Sprint(expected) {
+			t.Errorf("expected the command %q, got %q", expected, command)
+		}
+	}
+
+	// an error reply keeps the connection
+	if _, err := store.Take(context.Background(), "key", limit, now); err == nil || !strings.Contains(err.Error(), "NOSCRIPT") {
+		t.Errorf("expected the error of the server, got %v", err)
+	}
+	<-commands
+	result, err = store.Take(context.Background(), "key", limit, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.Tokens != 0.5 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if command := <-commands; command[0] != "EVAL" {
+		t.Errorf("the connection is opened again: %q", command)
+	}
+}
+
+func TestRedisClientUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	client := &redisClient{addr: addr, idle: make(chan *redisConn, 8)}
+	if _, err := client.do(context.Background(), "PING"); err == nil {
+		t.Error("expected an error for an unreachable server")
+	}
+}
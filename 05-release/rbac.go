@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The roles of the callers, every role can do what the previous ones can do.
+// A caller without any of these roles cannot call the API.
+const (
+	RoleReader = "reader"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var roleRanks = map[string]int{RoleReader: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// Policy gives the lowest role allowed to call a route. The keys are either a
+// route, the method and the path as registered on the router, e.g.
+// "DELETE /contacts/:id", or only a method, used for the routes that are not
+// listed. A route that matches nothing requires an admin.
+type Policy map[string]string
+
+const policyKey = "policy"
+
+// defaultPolicy lets the readers read and the editors write, deleting a
+// contact, reading the audit log, the privacy requests and the retention
+// report are reserved to the admins.
+var defaultPolicy = Policy{
+	"GET":                              RoleReader,
+	"HEAD":                             RoleReader,
+	"POST":                             RoleEditor,
+	"PUT":                              RoleEditor,
+	"PATCH":                            RoleEditor,
+	"DELETE":                           RoleEditor,
+	"DELETE /contacts/:id":             RoleAdmin,
+	"GET /audit/":                      RoleAdmin,
+	"GET /audit/export.jsonl":          RoleAdmin,
+	"GET /audit/verify":                RoleAdmin,
+	"GET /privacy/subjects/:id/export": RoleAdmin,
+	"POST /privacy/subjects/:id/erase": RoleAdmin,
+	"GET /retention/report":            RoleAdmin,
+}
+
+// loadPolicy reads the policy file, its rules are added to the default policy
+// and replace the ones with the same key.
+func loadPolicy(file string) (Policy, error) {
+	policy := Policy{}
+	for key, role := range defaultPolicy {
+		policy[key] = role
+	}
+	if file == "" {
+		return policy, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the policy file: %w", err)
+	}
+	var rules Policy
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid policy file: %w", err)
+	}
+	for key, role := range rules {
+		if _, ok := roleRanks[role]; !ok {
+			return nil, fmt.Errorf("unknown role '%s' for '%s' in the policy file", role, key)
+		}
+		policy[key] = role
+	}
+	return policy, nil
+}
+
+// requiredRole returns the lowest role allowed to call the route.
+func (p Policy) requiredRole(method string, path string) string {
+	if role, ok := p[method+" "+path]; ok {
+		return role
+	}
+	if role, ok := p[method]; ok {
+		return role
+	}
+	return RoleAdmin
+}
+
+// hasRole reports if the principal has the role or a higher one.
+func (p *Principal) hasRole(role string) bool {
+	for _, own := range p.Roles {
+		if roleRanks[own] >= roleRanks[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize refuses the requests of the callers without the role required
+// by the policy for the route.
+func authorize(policy Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(policyKey, policy)
+		if !allowed(c, c.Request.Method, c.FullPath()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "permission denied"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// allowed checks if the caller can call a route, the handlers use it for
+// the operations that are the same of another route, like the deletes of a
+// batch. The denials are written in the audit log.
+func allowed(c *gin.Context, method string, path string) bool {
+	policy, _ := c.MustGet(policyKey).(Policy)
+	principal := currentPrincipal(c)
+	role := policy.requiredRole(method, path)
+	if principal.hasRole(role) {
+		return true
+	}
+	auditDetail(c, fmt.Sprintf("permission denied: %s (%s) cannot call %s %s, it requires the %s role",
+		principal.Subject, principal.Method, method, path, role))
+	return false
+}
+
+// validateRoles checks the roles given to an API key.
+func validateRoles(roles []string) error {
+	for _, role := range roles {
+		if _, ok := roleRanks[role]; !ok {
+			return fmt.Errorf("unknown role '%s', use %s, %s or %s", role, RoleReader, RoleEditor, RoleAdmin)
+		}
+	}
+	return nil
+}
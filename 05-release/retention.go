@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RetentionRule deletes or anonymizes the contacts that nobody has touched
+// for a period: not changed, without activities in the timeline and without
+// tasks due, or still open, in the period.
+type RetentionRule struct {
+	Name string
+	// Untouched is the period, e.g. "3y", "90d", "2w" or "720h".
+	Untouched string
+	// ExceptTags keeps the contacts with one of the tags, e.g. "keep".
+	ExceptTags []string
+	// Tenant limits the rule to the contacts of a tenant, by default it
+	// applies to all the tenants.
+	Tenant string
+	// Action is "delete" or "anonymize".
+	Action string
+
+	untouched time.Duration
+}
+
+const (
+	RetentionDelete    = "delete"
+	RetentionAnonymize = "anonymize"
+)
+
+// RetentionReport tells what the rules have done, or what they would do in
+// a dry run.
+type RetentionReport struct {
+	RanAt  time.Time
+	DryRun bool
+	Rules  []RetentionRuleReport
+}
+
+type RetentionRuleReport struct {
+	Rule   string
+	Action string
+	// Cutoff is the time since when the matched contacts are untouched.
+	Cutoff   time.Time
+	Contacts []RetentionMatch
+	// Applied is the number of contacts deleted or anonymized, always 0
+	// in a dry run.
+	Applied int
+	Errors  []string `json:",omitempty"`
+}
+
+// RetentionMatch is a contact matched by a rule.
+type RetentionMatch struct {
+	ContactID uint
+	TenantID  string
+	Name      string
+	UpdatedAt time.Time
+}
+
+// loadRetentionRules reads the JSON file with the list of the rules.
+func loadRetentionRules(file string) ([]RetentionRule, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the retention rules: %w", err)
+	}
+	var rules []RetentionRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid retention rules file: %w", err)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.untouched, err = parseRetentionPeriod(rule.Untouched); err != nil {
+			return nil, fmt.Errorf("retention rule '%s': %w", rule.Name, err)
+		}
+		if rule.Action != RetentionDelete && rule.Action != RetentionAnonymize {
+			return nil, fmt.Errorf("retention rule '%s': the action must be %s or %s", rule.Name, RetentionDelete, RetentionAnonymize)
+		}
+		for j, tag := range rule.ExceptTags {
+			if rule.ExceptTags[j], err = normalizeTag(tag); err != nil {
+				return nil, fmt.Errorf("retention rule '%s': %w", rule.Name, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// parseRetentionPeriod reads a number of years, weeks or days, like "3y",
+// or a Go duration like "720h".
+func parseRetentionPeriod(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"y": 365 * 24 * time.Hour, "w": 7 * 24 * time.Hour, "d": 24 * time.Hour}
+	for suffix, unit := range units {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid period '%s'", s)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	period, err := time.ParseDuration(s)
+	if err != nil || period <= 0 {
+		return 0, fmt.Errorf("invalid period '%s', use e.g. 3y, 90d or 720h", s)
+	}
+	return period, nil
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// GetRetentionReport godoc.
+// @Summary      Preview the retention rules.
+// @Description  Returns the contacts of the tenant that the retention rules would delete or
+// @Description  anonymize now, without changing them.
+// @tags         Privacy
+// @Produce      json
+// @Success      200  {object}  RetentionReport
+// @Router       /retention/report [get]
+func getRetentionReport(rules []RetentionRule) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := applyRetentionRules(tenantDB(c), rules, true, time.Now())
+		matched := 0
+		for _, rule := range report.Rules {
+			matched += len(rule.Contacts)
+		}
+		auditBulkRead(c, matched)
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// WORKER
+////////////////////////////////////////////////////////////////////////////////
+
+// runRetention applies the rules to the contacts of all the tenants every
+// interval, until the context is cancelled. In a dry run it only logs what
+// it would do.
+func runRetention(ctx context.Context, db *gorm.DB, rules []RetentionRule, dryRun bool, interval time.Duration) {
+	if len(rules) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := forAllTenants(db, func(db *gorm.DB) error {
+			logRetentionReport(applyRetentionRules(db, rules, dryRun, time.Now()))
+			return nil
+		})
+		if err != nil {
+			slog.Error("retention failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func logRetentionReport(report RetentionReport) {
+	for _, rule := range report.Rules {
+		contacts := make([]string, len(rule.Contacts))
+		for i, match := range rule.Contacts {
+			contacts[i] = fmt.Sprintf("%s/%d", match.TenantID, match.ContactID)
+		}
+		if report.DryRun {
+			slog.Info("retention dry run", "rule", rule.Rule, "action", rule.Action, "cutoff", rule.Cutoff,
+				"matched", len(rule.Contacts), "contacts", strings.Join(contacts, ", "))
+			continue
+		}
+		if len(rule.Contacts) > 0 {
+			slog.Info("retention", "rule", rule.Rule, "action", rule.Action, "cutoff", rule.Cutoff,
+				"matched", len(rule.Contacts), "applied", rule.Applied, "contacts", strings.Join(contacts, ", "))
+		}
+		for _, err := range rule.Errors {
+			slog.Error("retention failed", "rule", rule.Rule, "error", err)
+		}
+	}
+}
+
+// applyRetentionRules finds the contacts matched by every rule and, unless
+// it is a dry run, deletes or anonymizes them.
+func applyRetentionRules(db *gorm.DB, rules []RetentionRule, dryRun bool, now time.Time) RetentionReport {
+	report := RetentionReport{RanAt: now.UTC(), DryRun: dryRun, Rules: []RetentionRuleReport{}}
+	for _, rule := range rules {
+		ruleReport := RetentionRuleReport{
+			Rule:     rule.Name,
+			Action:   rule.Action,
+			Cutoff:   now.Add(-rule.untouched).UTC(),
+			Contacts: []RetentionMatch{},
+		}
+		contacts, err := readRetentionCandidates(db, rule, ruleReport.Cutoff)
+		if err != nil {
+			ruleReport.Errors = append(ruleReport.Errors, err.Error())
+		}
+		for _, contact := range contacts {
+			ruleReport.Contacts = append(ruleReport.Contacts, RetentionMatch{
+				ContactID: contact.ID,
+				TenantID:  contact.TenantID,
+				Name:      contact.Name,
+				UpdatedAt: contact.UpdatedAt,
+			})
+			if dryRun {
+				continue
+			}
+			if err := retainContact(db, rule, contact, now); err != nil {
+				ruleReport.Errors = append(ruleReport.Errors, err.Error())
+				continue
+			}
+			ruleReport.Applied++
+		}
+		report.Rules = append(report.Rules, ruleReport)
+	}
+	return report
+}
+
+// retainContact deletes or anonymizes a contact like a privacy request, and
+// writes the certificate of erasure in the audit log of its tenant.
+func retainContact(db *gorm.DB, rule RetentionRule, contact Contact, now time.Time) error {
+	scoped := db.WithContext(withTenant(context.Background(), contact.TenantID))
+	mode := EraseDelete
+	if rule.Action == RetentionAnonymize {
+		mode = ErasePseudonymize
+	}
+	entry := AuditEntry{
+		TenantID:   contact.TenantID,
+		CreatedAt:  now,
+		Actor:      "retention",
+		Action:     "retention",
+		Route:      "job:retention",
+		Path:       "job:retention",
+		ContactIDs: []uint{contact.ID},
+		Result:     AuditSuccess,
+	}
+	records, err := eraseContact(scoped, contact.ID, mode)
+	if err != nil {
+		entry.Result = AuditError
+		entry.Detail = fmt.Sprintf("retention rule '%s' failed: %s", rule.Name, err)
+	} else {
+		certificate := ErasureCertificate{
+			ContactID: contact.ID,
+			Mode:      mode,
+			Reason:    fmt.Sprintf("retention rule '%s', untouched since %s", rule.Name, contact.UpdatedAt.UTC().Format(time.RFC3339)),
+			ErasedAt:  now.UTC(),
+			ErasedBy:  "retention",
+			Records:   records,
+		}
+		detail, err := json.Marshal(certificate)
+		if err != nil {
+			return err
+		}
+		entry.Detail = "certificate of erasure: " + string(detail)
+	}
+	if auditErr := appendAuditEntry(scoped, &entry); auditErr != nil {
+		slog.Error("cannot write the audit entry of the retention", "contact", contact.ID, "error", auditErr)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot %s contact with id '%d': %w", rule.Action, contact.ID, err)
+	}
+	return nil
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// readRetentionCandidates returns the contacts matched by the rule: not
+// changed since the cutoff, without activities since the cutoff, without
+// open tasks or tasks due after the cutoff, and without the tags excepted.
+// The contacts already anonymized are not anonymized again.
+func readRetentionCandidates(db *gorm.DB, rule RetentionRule, cutoff time.Time) ([]Contact, error) {
+	var contacts []Contact
+	query := db.Model(Contact{}).Select("id", "tenant_id", "name", "updated_at").
+		Where("contacts.updated_at < ?", cutoff).
+		Where("NOT EXISTS (SELECT 1 FROM activities WHERE activities.tenant_id = contacts.tenant_id AND activities.contact_id = contacts.id AND activities.occurred_at >= ?)", cutoff).
+		Where("NOT EXISTS (SELECT 1 FROM tasks WHERE tasks.tenant_id = contacts.tenant_id AND tasks.contact_id = contacts.id AND (tasks.status = ? OR tasks.due_at >= ?))", TaskOpen, cutoff)
+	if len(rule.ExceptTags) > 0 {
+		query = query.Where("NOT EXISTS (SELECT 1 FROM contact_tags WHERE contact_tags.tenant_id = contacts.tenant_id AND contact_tags.contact_id = contacts.id AND contact_tags.name IN ?)", rule.ExceptTags)
+	}
+	if rule.Action == RetentionAnonymize {
+		query = query.Where("contacts.anonymized_at IS NULL")
+	}
+	if rule.Tenant != "" {
+		query = query.Where("contacts.tenant_id = ?", rule.Tenant)
+	}
+	if result := query.Order("id").Find(&contacts); result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the contacts of the retention rule '%s'", rule.Name)
+	}
+	return contacts, nil
+}
+
+// backfillContactTimes gives the time of the migration to the contacts
+// created before the contacts had the times, the retention rules count from
+// there.
+func backfillContactTimes(db *gorm.DB) error {
+	now := time.Now()
+	if result := db.Model(Contact{}).Where("created_at IS NULL").UpdateColumn("created_at", now); result.Error != nil {
+		return wrapDBError(result.Error, "cannot set the creation time of the contacts")
+	}
+	if result := db.Model(Contact{}).Where("updated_at IS NULL").UpdateColumn("updated_at", now); result.Error != nil {
+		return wrapDBError(result.Error, "cannot set the update time of the contacts")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestRetentionAnonymize checks that the retention anonymizes an untouched
+// contact once, with an audit entry of the job.
+func TestRetentionAnonymize(t *testing.T) {
+	setupTestDB(t)
+	scoped := db.WithContext(withTenant(context.Background(), "alpha"))
+	contact := Contact{Name: "Jane Roe", Email: "jane@example.com"}
+	if result := scoped.Create(&contact); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	now := time.Now()
+	if result := scoped.Model(&contact).UpdateColumn("updated_at", now.Add(-72*time.Hour)); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	rules := []RetentionRule{{Name: "stale", Action: RetentionAnonymize, untouched: 24 * time.Hour}}
+
+	report := applyRetentionRules(db, rules, false, now)
+	if rule := report.Rules[0]; rule.Applied != 1 || len(rule.Errors) != 0 {
+		t.Fatalf("the untouched contact is not anonymized: %+v", rule)
+	}
+	var anonymized Contact
+	if result := scoped.First(&anonymized, contact.ID); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if anonymized.AnonymizedAt == nil || anonymized.Email != "" || anonymized.Name == contact.Name {
+		t.Errorf("the contact is not anonymized: %+v", anonymized)
+	}
+	var entry AuditEntry
+	if result := scoped.Where("action = ?", "retention").First(&entry); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if entry.Route != "job:retention" || entry.Path != "job:retention" || entry.Actor != "retention" {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+
+	// untouched again after a period, it is not anonymized again
+	report = applyRetentionRules(db, rules, false, now.Add(72*time.Hour))
+	if rule := report.Rules[0]; len(rule.Contacts) != 0 {
+		t.Errorf("the anonymized contact is anonymized again: %+v", rule)
+	}
+	// but a rule can still delete it
+	rules[0].Action = RetentionDelete
+	report = applyRetentionRules(db, rules, true, now.Add(72*time.Hour))
+	if rule := report.Rules[0]; len(rule.Contacts) != 1 {
+		t.Errorf("the anonymized contact is not matched by the delete rule: %+v", rule)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The application stops on SIGINT and SIGTERM: the server stops accepting
+// connections and waits for the requests in flight, the workers finish the
+// job they are doing, the spans are exported and the connections to the
+// database are closed, all within the shutdown timeout.
+
+// newServer creates the HTTP server of the handler, with the timeouts of the
+// configuration. The write timeout limits the exports too, that are written
+// while they are read from the database.
+func newServer(cfg Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.ServerAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serve runs the server until the context is cancelled, then waits for the
+// requests in flight until the timeout.
+func serve(ctx context.Context, server *http.Server, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", server.Addr)
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down, waiting for the requests in flight", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// WORKER
+////////////////////////////////////////////////////////////////////////////////
+
+// workers runs the background jobs, the scheduler and the workers, that
+// stop when their context is cancelled.
+type workers struct {
+	wg sync.WaitGroup
+}
+
+func (w *workers) run(job func()) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		job()
+	}()
+}
+
+// wait waits for the jobs to stop, it returns false when they are still
+// running at the timeout.
+func (w *workers) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
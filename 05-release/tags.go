@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ContactTag is a label of a contact, e.g. "customer" or "keep". The tags
+// are free, a tag exists as long as a contact has it.
+type ContactTag struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"index" json:"-"`
+	ContactID uint   `gorm:"uniqueIndex:idx_contact_tag"`
+	Name      string `gorm:"uniqueIndex:idx_contact_tag;index"`
+}
+
+// validTag is a lower case name of letters, digits, dashes and underscores.
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+func normalizeTag(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !validTag.MatchString(name) {
+		return "", fmt.Errorf("invalid tag '%s', it must be made of letters, digits, dashes and underscores", name)
+	}
+	return name, nil
+}
+
+// taggedWith restricts a query of the contacts to the ones with the tag.
+func taggedWith(name string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(`EXISTS (SELECT 1 FROM contact_tags WHERE contact_tags.tenant_id = contacts.tenant_id
+			AND contact_tags.contact_id = contacts.id AND contact_tags.name = ?)`,
+			strings.ToLower(strings.TrimSpace(name)))
+	}
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// ListContactTags godoc.
+// @Summary      Get the tags of a contact.
+// @Description  Returns the tags of the contact in alphabetical order.
+// @tags         Contact
+// @Produce      json
+// @Param 		 id  path  int  true  "Contact ID"
+// @Success      200  {object}  []string
+// @Router       /contacts/{id}/tags [get]
+func listContactTags(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareRead); err != nil {
+		respondError(c, errorStatus(err, http.StatusInternalServerError), err)
+		return
+	}
+	tags, err := readContactTags(db, uint(contactId))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tags)
+}
+
+// TagContact godoc.
+// @Summary      Tag a contact.
+// @Description  Adds the tag to the contact, nothing changes when the contact has it already.
+// @tags         Contact
+// @Param 		 id   path  int     true  "Contact ID"
+// @Param 		 tag  path  string  true  "Tag"
+// @Success      204
+// @Router       /contacts/{id}/tags/{tag} [put]
+func tagContact(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tag, err := normalizeTag(c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareWrite); err != nil {
+		respondError(c, errorStatus(err, http.StatusInternalServerError), err)
+		return
+	}
+	if err := saveContactTag(db, uint(contactId), tag); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// UntagContact godoc.
+// @Summary      Remove a tag from a contact.
+// @Description  Removes the tag from the contact.
+// @tags         Contact
+// @Param 		 id   path  int     true  "Contact ID"
+// @Param 		 tag  path  string  true  "Tag"
+// @Success      204
+// @Router       /contacts/{id}/tags/{tag} [delete]
+func untagContact(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tag, err := normalizeTag(c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareWrite); err != nil {
+		respondError(c, errorStatus(err, http.StatusInternalServerError), err)
+		return
+	}
+	if err := deleteContactTag(db, uint(contactId), tag); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+func readContactTags(db *gorm.DB, contactId uint) ([]string, error) {
+	tags := []string{}
+	result := db.Model(ContactTag{}).Where("contact_id = ?", contactId).Order("name").Pluck("name", &tags)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the tags of contact with id '%d'", contactId)
+	}
+	return tags, nil
+}
+
+func saveContactTag(db *gorm.DB, contactId uint, name string) error {
+	tag := ContactTag{ContactID: contactId, Name: name}
+	result := db.Where(tag).FirstOrCreate(&tag)
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot tag contact with id '%d'", contactId)
+	}
+	return nil
+}
+
+func deleteContactTag(db *gorm.DB, contactId uint, name string) error {
+	result := db.Where("contact_id = ? AND name = ?", contactId, name).Delete(ContactTag{})
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot remove the tag '%s' of contact with id '%d'", name, contactId)
+	}
+	if result.RowsAffected == 0 {
+		return &accessError{http.StatusNotFound, fmt.Sprintf("contact with id '%d' has no tag '%s'", contactId, name)}
+	}
+	return nil
+}
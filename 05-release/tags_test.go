@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestContactTags(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	key := createTestAPIKey(t, "alpha", "admin", RoleAdmin)
+	var contact Contact
+	decodeResponse(t, testRequest(t, r, key, "POST", "/contacts/", Contact{Name: "tagged"}), http.StatusCreated, &contact)
+	tags := fmt.Sprintf("/contacts/%d/tags", contact.ID)
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{"PUT", tags + "/VIP", http.StatusNoContent},
+		{"PUT", tags + "/vip", http.StatusNoContent},
+		{"PUT", tags + "/not%20valid", http.StatusBadRequest},
+		{"DELETE", tags + "/not%20valid", http.StatusBadRequest},
+		{"DELETE", tags + "/%20Vip%20", http.StatusNoContent},
+		{"DELETE", tags + "/vip", http.StatusNotFound},
+		{"GET", "/contacts/999/tags", http.StatusNotFound},
+		{"PUT", "/contacts/999/tags/vip", http.StatusNotFound},
+		{"DELETE", "/contacts/999/tags/vip", http.StatusNotFound},
+		{"POST", "/contacts/999/consents", http.StatusNotFound},
+	} {
+		if response := testRequest(t, r, key, test.method, test.path, nil); response.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d %s", test.method, test.path, test.status, response.Code, response.Body.String())
+		}
+	}
+	var names []string
+	decodeResponse(t, testRequest(t, r, key, "GET", tags, nil), http.StatusOK, &names)
+	if len(names) != 0 {
+		t.Errorf("the tag has not been removed: %v", names)
+	}
+}
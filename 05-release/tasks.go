@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Task is a reminder or a follow-up that has to be done for a contact.
+type Task struct {
+	ID          uint   `gorm:"primaryKey"`
+	TenantID    string `gorm:"index" json:"-"`
+	ContactID   uint   `gorm:"index"`
+	Title       string
+	Description string
+	DueAt       time.Time `gorm:"index"`
+	// Status is one of "open", "done" or "cancelled".
+	Status   string `gorm:"index"`
+	Assignee string
+	// Recurrence is empty for a one-off task, otherwise one of "daily",
+	// "weekly", "monthly" or "yearly". When a recurring task is done the next
+	// occurrence is created automatically.
+	Recurrence string
+	// NotifiedAt is set by the scheduler once the reminder has been sent.
+	NotifiedAt *time.Time
+	// ReminderAttempts counts the reminders that could not be sent, the next
+	// one is tried at ReminderRetryAt. After maxReminderAttempts the
+	// reminder is given up and ReminderFailedAt is set.
+	ReminderAttempts int
+	ReminderRetryAt  *time.Time
+	ReminderFailedAt *time.Time
+}
+
+const (
+	TaskOpen      = "open"
+	TaskDone      = "done"
+	TaskCancelled = "cancelled"
+)
+
+// nextOccurrence returns the due date of the next task of a recurrence.
+func nextOccurrence(due time.Time, recurrence string) (time.Time, error) {
+	switch recurrence {
+	case "daily":
+		return due.AddDate(0, 0, 1), nil
+	case "weekly":
+		return due.AddDate(0, 0, 7), nil
+	case "monthly":
+		return due.AddDate(0, 1, 0), nil
+	case "yearly":
+		return due.AddDate(1, 0, 0), nil
+	}
+	return due, fmt.Errorf("unknown recurrence '%s'", recurrence)
+}
+
+// maxReminderAttempts is the number of times a reminder is tried before it
+// is given up.
+const maxReminderAttempts = 10
+
+// reminderBackoff is the wait after the failed attempt, it doubles at every
+// attempt up to an hour.
+func reminderBackoff(attempt int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < attempt && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	return backoff
+}
+
+func validateTask(task *Task) error {
+	if task.Title == "" {
+		return fmt.Errorf("the task title is required")
+	}
+	if task.DueAt.IsZero() {
+		return fmt.Errorf("the task due date is required")
+	}
+	switch task.Status {
+	case "":
+		task.Status = TaskOpen
+	case TaskOpen, TaskDone, TaskCancelled:
+	default:
+		return fmt.Errorf("unknown task status '%s'", task.Status)
+	}
+	if task.Recurrence != "" {
+		if _, err := nextOccurrence(task.DueAt, task.Recurrence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// CreateTask godoc.
+// @Summary      Create a new task.
+// @Description  Creates a reminder or a follow-up task for a contact.
+// @tags         Task
+// @Accept       json
+// @Param        Body  body      Task  true  "The task, ContactID, Title and DueAt are required"
+// @Success      201   {object}  Task
+// @Router       /tasks [post]
+func createTask(c *gin.Context) {
+	db := tenantDB(c)
+	var task Task
+	if err := c.ShouldBindJSON(&task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	task.ID = 0
+	task.NotifiedAt = nil
+	task.ReminderAttempts, task.ReminderRetryAt, task.ReminderFailedAt = 0, nil, nil
+	if err := validateTask(&task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), task.ContactID, ShareWrite); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := saveTask(db, &task); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, task)
+}
+
+// UpdateTask godoc.
+// @Summary      Update task.
+// @Description  Updates a task. Marking as done a recurring task creates the next occurrence.
+// @tags         Task
+// @Accept       json
+// @Param        Body  body  Task  true  "All the property of the task"
+// @Param 		 id    path int true "Task ID"
+// @Success      200   {object}  Task
+// @Router       /tasks/{id} [put]
+func updateTaskById(c *gin.Context) {
+	db := tenantDB(c)
+	var task Task
+	if err := c.ShouldBindJSON(&task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	taskId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateTask(&task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkTaskAccess(db, currentPrincipal(c), uint(taskId), ShareWrite); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	updatedTask, err := updateTask(db, uint(taskId), task)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, updatedTask)
+}
+
+// DeleteTask godoc.
+// @Summary      Delete task.
+// @Description  Allows the deletion of a task.
+// @Param 		 id  path int true "Task ID"
+// @tags         Task
+// @Success      204
+// @Router       /tasks/{id} [delete]
+func deleteTaskById(c *gin.Context) {
+	db := tenantDB(c)
+	taskId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkTaskAccess(db, currentPrincipal(c), uint(taskId), ShareWrite); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := deleteTask(db, uint(taskId)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusNoContent, "")
+}
+
+// GetTask godoc.
+// @Summary      Get task details.
+// @Param 		 id  path int true "Task ID"
+// @tags         Task
+// @Produce      json
+// @Success      200  {object}  Task
+// @Router       /tasks/{id} [get]
+func getTaskById(c *gin.Context) {
+	db := tenantDB(c)
+	taskId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkTaskAccess(db, currentPrincipal(c), uint(taskId), ShareRead); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	task, err := readTaskById(db, uint(taskId))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+// ListTasks godoc.
+// @Summary      Get the tasks.
+// @Description  Returns the tasks of the contacts that the caller can see. The view parameter
+// @Description  restricts the result to the open tasks that are overdue, due today or upcoming.
+// @tags         Task
+// @Produce      json
+// @Param        view      query  string  false  "overdue, today or upcoming"
+// @Param        assignee  query  string  false  "Only the tasks of this assignee"
+// @Param        status    query  string  false  "Only the tasks with this status"
+// @Success      200  {object}  []Task
+// @Router       /tasks [get]
+func listTasks(c *gin.Context) {
+	db := tenantDB(c)
+	filter := TaskFilter{
+		View:     c.Query("view"),
+		Assignee: c.Query("assignee"),
+		Status:   c.Query("status"),
+		Viewer:   currentPrincipal(c),
+	}
+	tasks, err := readTasks(db, filter, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tasks)
+}
+
+// ListContactTasks godoc.
+// @Summary      Get the tasks of a contact.
+// @tags         Task
+// @Produce      json
+// @Param 		 id    path   int     true   "Contact ID"
+// @Param        view  query  string  false  "overdue, today or upcoming"
+// @Success      200  {object}  []Task
+// @Router       /contacts/{id}/tasks [get]
+func listContactTasks(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareRead); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	filter := TaskFilter{
+		ContactID: uint(contactId),
+		View:      c.Query("view"),
+		Assignee:  c.Query("assignee"),
+		Status:    c.Query("status"),
+	}
+	tasks, err := readTasks(db, filter, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tasks)
+}
+
+// SCHEDULER
+////////////////////////////////////////////////////////////////////////////////
+
+// runTaskScheduler checks periodically for the tasks that are due and sends a
+// reminder for each one of them. It returns when the context is cancelled.
+func runTaskScheduler(ctx context.Context, db *gorm.DB, notifier Notifier, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := forAllTenants(db, func(db *gorm.DB) error {
+			notifyDueTasks(db, notifier, time.Now())
+			return nil
+		})
+		if err != nil {
+			slog.Error("cannot read the due tasks", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func notifyDueTasks(db *gorm.DB, notifier Notifier, now time.Time) {
+	tasks, err := readDueTasks(db, now)
+	if err != nil {
+		slog.Error("cannot read the due tasks", "error", err)
+		return
+	}
+	for _, task := range tasks {
+		// the task and its contact are read in the tenant of the task
+		db := db.WithContext(withTenant(context.Background(), task.TenantID))
+		// The task is claimed before sending the reminder, so two instances
+		// of the application never notify the same task twice, and released
+		// when the reminder cannot be sent, so it is tried again later.
+		claimed, err := markTaskNotified(db, task.ID, now)
+		if err != nil {
+			slog.Error("cannot claim the reminder", "task", task.ID, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		contact, err := readContactById(db, task.ContactID)
+		if err != nil {
+			releaseTaskNotified(db, task, now, fmt.Errorf("cannot read the contact of the reminder: %w", err))
+			continue
+		}
+		if err := notifier.Notify(task, *contact); err != nil {
+			releaseTaskNotified(db, task, now, err)
+		}
+	}
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+// TaskFilter restricts the tasks returned by readTasks. Empty fields are
+// ignored.
+type TaskFilter struct {
+	ContactID uint
+	View      string
+	Assignee  string
+	Status    string
+	// Viewer restricts the tasks to the contacts that it can see.
+	Viewer *Principal
+}
+
+func readTasks(db *gorm.DB, filter TaskFilter, now time.Time) ([]Task, error) {
+	query := db.Model(Task{})
+	if filter.ContactID != 0 {
+		query = query.Where("contact_id = ?", filter.ContactID)
+	}
+	if filter.Viewer != nil {
+		visible := db.Model(Contact{}).Select("id").Scopes(visibleContacts(filter.Viewer, ShareRead))
+		query = query.Where("contact_id IN (?)", visible)
+	}
+	if filter.Assignee != "" {
+		query = query.Where("assignee = ?", filter.Assignee)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	tomorrow := today.AddDate(0, 0, 1)
+	switch filter.View {
+	case "":
+	case "overdue":
+		query = query.Where("status = ? AND due_at < ?", TaskOpen, today)
+	case "today":
+		query = query.Where("status = ? AND due_at >= ? AND due_at < ?", TaskOpen, today, tomorrow)
+	case "upcoming":
+		query = query.Where("status = ? AND due_at >= ?", TaskOpen, tomorrow)
+	default:
+		return nil, fmt.Errorf("unknown view '%s'", filter.View)
+	}
+
+	var tasks []Task
+	result := query.Order("due_at").Find(&tasks)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot list tasks")
+	}
+	return tasks, nil
+}
+
+func readDueTasks(db *gorm.DB, now time.Time) ([]Task, error) {
+	var tasks []Task
+	result := db.Where("status = ? AND due_at <= ? AND notified_at IS NULL", TaskOpen, now).
+		Where("reminder_failed_at IS NULL AND (reminder_retry_at IS NULL OR reminder_retry_at <= ?)", now).
+		Order("due_at").
+		Find(&tasks)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot list due tasks")
+	}
+	return tasks, nil
+}
+
+// markTaskNotified records that the reminder of a task has been sent. It
+// returns false when the task was already notified.
+func markTaskNotified(db *gorm.DB, taskId uint, now time.Time) (bool, error) {
+	result := db.Model(Task{}).
+		Where("id = ? AND notified_at IS NULL", taskId).
+		Update("notified_at", now)
+	if result.Error != nil {
+		return false, wrapDBError(result.Error, "cannot mark task with id '%d' as notified", taskId)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// releaseTaskNotified gives back the claim of markTaskNotified after the
+// reminder failed with the error. The reminder is tried again after the
+// backoff, or given up after maxReminderAttempts.
+func releaseTaskNotified(db *gorm.DB, task Task, now time.Time, reason error) {
+	attempts := task.ReminderAttempts + 1
+	updates := map[string]interface{}{"notified_at": nil, "reminder_attempts": attempts}
+	if attempts >= maxReminderAttempts {
+		updates["reminder_failed_at"] = now
+		slog.Error("the reminder is given up", "task", task.ID, "attempts", attempts, "error", reason)
+	} else {
+		retry := now.Add(reminderBackoff(attempts))
+		updates["reminder_retry_at"] = retry
+		slog.Warn("cannot send the reminder", "task", task.ID, "attempts", attempts, "retry", retry, "error", reason)
+	}
+	result := db.Model(Task{}).Where("id = ?", task.ID).Updates(updates)
+	if result.Error != nil {
+		slog.Error("cannot release the reminder", "task", task.ID, "error", result.Error)
+	}
+}
+
+// checkTaskAccess checks the access to the contact of the task. The tasks of
+// the contacts that the principal cannot see are reported as missing.
+func checkTaskAccess(db *gorm.DB, principal *Principal, taskId uint, level string) error {
+	task, err := readTaskById(db, taskId)
+	if err != nil {
+		return &accessError{http.StatusNotFound, err.Error()}
+	}
+	err = checkContactAccess(db, principal, task.ContactID, level)
+	if access, ok := err.(*accessError); ok && access.status == http.StatusNotFound {
+		return &accessError{http.StatusNotFound, fmt.Sprintf("no task found with id '%d'", taskId)}
+	}
+	return err
+}
+
+func readTaskById(db *gorm.DB, taskId uint) (task *Task, err error) {
+	result := db.Model(Task{}).First(&task, Task{ID: taskId})
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, wrapDBError(result.Error, `cannot read task with id '%d'`, taskId)
+	}
+	if result.RowsAffected != 1 {
+		return nil, fmt.Errorf(`no task found with id '%d'`, taskId)
+	}
+	return
+}
+
+func saveTask(db *gorm.DB, task *Task) error {
+	result := db.Create(&task)
+	if result.Error != nil {
+		return wrapDBError(result.Error, `error saving task`)
+	}
+	return nil
+}
+
+func updateTask(db *gorm.DB, taskId uint, task Task) (t *Task, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(Task{}).First(&t, Task{ID: taskId})
+		if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return wrapDBError(result.Error, "cannot retrieve task with id '%d'", taskId)
+		}
+		if result.RowsAffected != 1 {
+			return fmt.Errorf("cannot retrieve task with id '%d'", taskId)
+		}
+		completed := t.Status != TaskDone && task.Status == TaskDone
+
+		// A new due date needs a new reminder.
+		if !t.DueAt.Equal(task.DueAt) {
+			t.NotifiedAt = nil
+			t.ReminderAttempts, t.ReminderRetryAt, t.ReminderFailedAt = 0, nil, nil
+		}
+		t.Title = task.Title
+		t.Description = task.Description
+		t.DueAt = task.DueAt
+		t.Status = task.Status
+		t.Assignee = task.Assignee
+		t.Recurrence = task.Recurrence
+
+		if result := tx.Save(&t); result.Error != nil {
+			return wrapDBError(result.Error, "cannot update task with id '%d'", taskId)
+		}
+
+		if completed && t.Recurrence != "" {
+			due, err := nextOccurrence(t.DueAt, t.Recurrence)
+			if err != nil {
+				return err
+			}
+			next := Task{
+				ContactID:   t.ContactID,
+				Title:       t.Title,
+				Description: t.Description,
+				DueAt:       due,
+				Status:      TaskOpen,
+				Assignee:    t.Assignee,
+				Recurrence:  t.Recurrence,
+			}
+			return saveTask(tx, &next)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func deleteTask(db *gorm.DB, taskId uint) error {
+	result := db.Delete(Task{}, Task{ID: taskId})
+	if result.Error != nil {
+		return wrapDBError(result.Error, "cannot delete task with id '%d'", taskId)
+	}
+	if result.RowsAffected != 1 {
+		return fmt.Errorf("cannot delete task with id '%d'", taskId)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingNotifier fails to send the reminders while fail is set.
+type failingNotifier struct {
+	fail  bool
+	calls int
+}
+
+func (n *failingNotifier) Notify(task Task, contact Contact) error {
+	n.calls++
+	if n.fail {
+		return errors.New("the server of the reminders is down")
+	}
+	return nil
+}
+
+func TestReminderRetries(t *testing.T) {
+	setupTestDB(t)
+	scoped := db.WithContext(withTenant(context.Background(), "alpha"))
+	contact := Contact{Name: "reminded"}
+	if result := scoped.Create(&contact); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	now := time.Now()
+	createTask := func(task Task) Task {
+		task.ContactID, task.DueAt, task.Status = contact.ID, now.Add(-time.Minute), TaskOpen
+		if result := scoped.Create(&task); result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		return task
+	}
+	readTask := func(id uint) Task {
+		var task Task
+		if result := scoped.First(&task, id); result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		return task
+	}
+
+	// the reminder is tried again after the backoff, not at every run
+	retried := createTask(Task{Title: "retried"})
+	notifier := &failingNotifier{fail: true}
+	notifyDueTasks(scoped, notifier, now)
+	notifyDueTasks(scoped, notifier, now.Add(30*time.Second))
+	task := readTask(retried.ID)
+	if notifier.calls != 1 || task.ReminderAttempts != 1 || task.NotifiedAt != nil ||
+		task.ReminderRetryAt == nil || !task.ReminderRetryAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("unexpected reminder after the first failure: %d calls, %+v", notifier.calls, task)
+	}
+	notifyDueTasks(scoped, notifier, now.Add(time.Minute))
+	if task := readTask(retried.ID); notifier.calls != 2 || task.ReminderAttempts != 2 || !task.ReminderRetryAt.Equal(now.Add(3*time.Minute)) {
+		t.Fatalf("unexpected reminder after the second failure: %d calls, %+v", notifier.calls, task)
+	}
+	// it is sent when the notifier works again
+	notifier.fail = false
+	notifyDueTasks(scoped, notifier, now.Add(3*time.Minute))
+	if task := readTask(retried.ID); notifier.calls != 3 || task.NotifiedAt == nil {
+		t.Fatalf("the reminder is not sent when the notifier works again: %+v", task)
+	}
+
+	// after the last attempt the reminder is given up
+	givenUp := createTask(Task{Title: "given up", ReminderAttempts: maxReminderAttempts - 1})
+	notifier.fail, notifier.calls = true, 0
+	notifyDueTasks(scoped, notifier, now)
+	task = readTask(givenUp.ID)
+	if notifier.calls != 1 || task.ReminderAttempts != maxReminderAttempts || task.ReminderFailedAt == nil || task.NotifiedAt != nil {
+		t.Errorf("the reminder is not given up: %+v", task)
+	}
+	notifier.fail = false
+	notifyDueTasks(scoped, notifier, now.Add(24*time.Hour))
+	if notifier.calls != 1 {
+		t.Errorf("the reminder given up is tried again")
+	}
+}
+
+func TestReminderBackoff(t *testing.T) {
+	for attempt, backoff := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		6:  32 * time.Minute,
+		7:  time.Hour,
+		20: time.Hour,
+	} {
+		if got := reminderBackoff(attempt); got != backoff {
+			t.Errorf("attempt %d: expected %s, got %s", attempt, backoff, got)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// One deployment serves several tenants, e.g. the departments of a company.
+// Every table has a TenantID column and the tenantScope plugin adds it to the
+// queries: a query made with a context that carries a tenant reads, changes
+// and deletes only the rows of that tenant, and the rows it creates belong to
+// it. The handlers get such a database from tenantDB, the background jobs
+// work on all the tenants with the plain database.
+
+// models are the tables with the data of the tenants.
+var models = []interface{}{
+	&Contact{}, &Task{}, &Activity{}, &ImportJob{}, &ImportJobError{}, &IdempotencyRecord{},
+	&ExternalReference{}, &APIKey{}, &AddressBook{}, &Share{}, &AuditEntry{}, &AuditContact{},
+	&Consent{}, &ContactTag{},
+}
+
+const (
+	tenantKey = "tenant"
+	dbKey     = "db"
+)
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+type tenantContextKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+func tenantFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	tenant, ok := ctx.Value(tenantContextKey{}).(string)
+	return tenant, ok
+}
+
+// tenantScope is the GORM plugin that scopes the queries to the tenant of
+// their context.
+type tenantScope struct{}
+
+func (tenantScope) Name() string {
+	return "tenant"
+}
+
+func (tenantScope) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("gorm:create").Register("tenant:create", setTenant); err != nil {
+		return err
+	}
+	if err := callbacks.Query().Before("gorm:query").Register("tenant:query", whereTenant); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("tenant:update", whereTenant); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("tenant:delete", whereTenant); err != nil {
+		return err
+	}
+	return callbacks.Row().Before("gorm:row").Register("tenant:row", whereTenant)
+}
+
+func tenantField(tx *gorm.DB) (string, string, bool) {
+	tenant, ok := tenantFromContext(tx.Statement.Context)
+	if !ok || tx.Statement.Schema == nil {
+		return "", "", false
+	}
+	field := tx.Statement.Schema.LookUpField("TenantID")
+	if field == nil {
+		return "", "", false
+	}
+	return tenant, field.DBName, true
+}
+
+// whereTenant restricts a query to the rows of the tenant.
+func whereTenant(tx *gorm.DB) {
+	tenant, column, ok := tenantField(tx)
+	if !ok {
+		return
+	}
+	tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: tx.Statement.Table, Name: column}, Value: tenant},
+	}})
+}
+
+// setTenant gives the new rows to the tenant, whatever the caller has sent.
+func setTenant(tx *gorm.DB) {
+	tenant, _, ok := tenantField(tx)
+	if !ok {
+		return
+	}
+	field := tx.Statement.Schema.LookUpField("TenantID")
+	value := tx.Statement.ReflectValue
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := field.Set(tx.Statement.Context, value.Index(i), tenant); err != nil {
+				tx.AddError(err)
+			}
+		}
+	case reflect.Struct:
+		if err := field.Set(tx.Statement.Context, value, tenant); err != nil {
+			tx.AddError(err)
+		}
+	}
+}
+
+// subdomainTenant returns the tenant named by the host of the request, e.g.
+// "sales" for sales.contacts.example.com when the tenant domain is
+// contacts.example.com.
+func subdomainTenant(host string) string {
+	if config.TenantDomain == "" {
+		return ""
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	tenant := strings.TrimSuffix(strings.ToLower(host), "."+strings.ToLower(config.TenantDomain))
+	if tenant == host || strings.Contains(tenant, ".") {
+		return ""
+	}
+	return tenant
+}
+
+// resolveTenant finds the tenant of the request and gives the handlers a
+// database scoped to it. The tenant comes from the token or the API key of
+// the caller; the subdomain is used when the caller has no tenant, and must
+// match the one of the caller otherwise.
+func resolveTenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant := currentPrincipal(c).Tenant
+		if subdomain := subdomainTenant(c.Request.Host); subdomain != "" {
+			if tenant != "" && tenant != subdomain {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the credentials belong to another tenant"})
+				return
+			}
+			tenant = subdomain
+		}
+		if tenant == "" {
+			tenant = config.DefaultTenant
+		}
+		if !tenantPattern.MatchString(tenant) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("invalid tenant '%s'", tenant)})
+			return
+		}
+
+		ctx := withTenant(c.Request.Context(), tenant)
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(tenantKey, tenant)
+		scoped := db.WithContext(ctx)
+		if !config.TenantRLS {
+			c.Set(dbKey, scoped)
+			c.Next()
+			return
+		}
+
+		// with the row level security the tenant is a setting of the
+		// connection, the whole request runs on the same connection.
+		err := scoped.Connection(func(conn *gorm.DB) error {
+			if result := conn.Exec("SELECT set_config('app.tenant', ?, false)", tenant); result.Error != nil {
+				return result.Error
+			}
+			defer conn.Exec("RESET app.tenant")
+			c.Set(dbKey, conn.Session(&gorm.Session{NewDB: true}))
+			c.Next()
+			return nil
+		})
+		if err != nil && !c.IsAborted() {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "cannot connect to the database"})
+		}
+	}
+}
+
+// tenantDB returns the database scoped to the tenant of the request.
+func tenantDB(c *gin.Context) *gorm.DB {
+	if scoped, ok := c.Get(dbKey); ok {
+		return scoped.(*gorm.DB)
+	}
+	return db.WithContext(withTenant(c.Request.Context(), config.DefaultTenant))
+}
+
+// currentTenant returns the tenant of the request.
+func currentTenant(c *gin.Context) string {
+	if tenant, ok := c.Get(tenantKey); ok {
+		return tenant.(string)
+	}
+	return config.DefaultTenant
+}
+
+// migrateTenants gives the rows created before the tenants to the default
+// tenant and replaces the unique indexes that did not include the tenant.
+func migrateTenants(db *gorm.DB, tenant string) error {
+	for _, model := range models {
+		result := db.Model(model).Where("tenant_id IS NULL OR tenant_id = ''").Update("tenant_id", tenant)
+		if result.Error != nil {
+			return fmt.Errorf("cannot set the tenant of the existing rows: %w", result.Error)
+		}
+	}
+	migrator := db.Migrator()
+	for model, index := range map[interface{}]string{
+		&ExternalReference{}: "idx_external_reference",
+		&AddressBook{}:       "idx_address_book",
+	} {
+		if migrator.HasIndex(model, index) {
+			if err := migrator.DropIndex(model, index); err != nil {
+				return fmt.Errorf("cannot drop the index %s: %w", index, err)
+			}
+		}
+	}
+	return nil
+}
+
+// allTenants is the setting of the connections that work on the rows of all
+// the tenants: the background jobs, the migrations and the lookup of the API
+// keys, that gives the tenant of the request.
+const allTenants = "*"
+
+// forAllTenants runs fn with a database that can read and write the rows of
+// all the tenants. With the row level security it runs on a connection with
+// the setting for all the tenants, the other connections see no row until
+// the tenant of the request is set.
+func forAllTenants(db *gorm.DB, fn func(db *gorm.DB) error) error {
+	if !config.TenantRLS {
+		return fn(db)
+	}
+	return db.Connection(func(conn *gorm.DB) error {
+		if result := conn.Exec("SELECT set_config('app.tenant', ?, false)", allTenants); result.Error != nil {
+			return wrapDBError(result.Error, "cannot connect to the database")
+		}
+		defer conn.Exec("RESET app.tenant")
+		return fn(conn.Session(&gorm.Session{NewDB: true}))
+	})
+}
+
+// enableRowLevelSecurity adds a Postgres policy to every table, so even a
+// query that forgets the tenant cannot read the rows of another tenant. The
+// policy fails closed: a connection without a tenant sees no row, only the
+// ones set for all the tenants by forAllTenants see all of them.
+func enableRowLevelSecurity(db *gorm.DB) error {
+	check := fmt.Sprintf(`current_setting('app.tenant', true) = '%s' OR tenant_id = current_setting('app.tenant', true)`, allTenants)
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		table := stmt.Quote(stmt.Schema.Table)
+		for _, sql := range []string{
+			fmt.Sprintf("ALTER TABLE %s ENABLE ROW LEVEL SECURITY", table),
+			fmt.Sprintf("ALTER TABLE %s FORCE ROW LEVEL SECURITY", table),
+			fmt.Sprintf("DROP POLICY IF EXISTS tenant_isolation ON %s", table),
+			fmt.Sprintf("CREATE POLICY tenant_isolation ON %s USING (%s) WITH CHECK (%s)", table, check, check),
+		} {
+			if result := db.Exec(sql); result.Error != nil {
+				return fmt.Errorf("cannot enable the row level security on %s: %w", stmt.Schema.Table, result.Error)
+			}
+		}
+	}
+	return nil
+}
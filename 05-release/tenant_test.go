@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// alphaData are the rows of the tenant alpha that the tenant beta must not
+// see nor change. Every value written by alpha contains "alpha".
+type alphaData struct {
+	contact, book, task, share, importJob uint
+}
+
+func seedAlpha(t *testing.T, r http.Handler, key string) alphaData {
+	t.Helper()
+	var data alphaData
+
+	var book AddressBook
+	decodeResponse(t, testRequest(t, r, key, "POST", "/books/", AddressBook{Name: "alpha book"}), http.StatusCreated, &book)
+	data.book = book.ID
+
+	var share Share
+	decodeResponse(t, testRequest(t, r, key, "PUT", fmt.Sprintf("/books/%d/shares", book.ID),
+		Share{Grantee: "team:alpha-team", Level: ShareRead}), http.StatusOK, &share)
+	data.share = share.ID
+
+	var contact Contact
+	decodeResponse(t, testRequest(t, r, key, "POST", "/contacts/",
+		Contact{Name: "alpha contact", Email: "secret@example.com", AddressBookID: book.ID}), http.StatusCreated, &contact)
+	data.contact = contact.ID
+
+	decodeResponse(t, testRequest(t, r, key, "PUT", fmt.Sprintf("/contacts/%d/tags/vip", contact.ID), nil), http.StatusNoContent, nil)
+	decodeResponse(t, testRequest(t, r, key, "POST", fmt.Sprintf("/contacts/%d/consents", contact.ID),
+		Consent{Purpose: "alpha newsletter", Status: ConsentGranted, Source: "alpha form"}), http.StatusCreated, nil)
+	decodeResponse(t, testRequest(t, r, key, "POST", fmt.Sprintf("/contacts/%d/timeline", contact.ID),
+		Activity{Type: "note", Body: "alpha note"}), http.StatusCreated, nil)
+	decodeResponse(t, testRequest(t, r, key, "PUT", "/contacts/by-external/crm/x-1",
+		Contact{Name: "alpha external"}), http.StatusCreated, nil)
+
+	var task Task
+	decodeResponse(t, testRequest(t, r, key, "POST", "/tasks/",
+		Task{ContactID: contact.ID, Title: "alpha task", DueAt: time.Now().Add(time.Hour)}), http.StatusCreated, &task)
+	data.task = task.ID
+
+	var job ImportJob
+	request := testRequest(t, r, key, "POST", "/imports/?format=json", `[{"Name": "alpha import"}]`)
+	decodeResponse(t, request, http.StatusAccepted, &job)
+	data.importJob = job.ID
+	return data
+}
+
+// TestTenantIsolation checks that no endpoint gives the tenant beta the
+// rows of the tenant alpha, or lets it change them, both to an admin, that
+// sees every contact of its tenant, and to an editor, that sees the books
+// shared with it.
+func TestTenantIsolation(t *testing.T) {
+	setupTestDB(t)
+	r := newTestAPI(t)
+	alphaKey := createTestAPIKey(t, "alpha", "admin", RoleAdmin)
+	alpha := seedAlpha(t, r, alphaKey)
+
+	reads := []string{
+		"/contacts/",
+		"/contacts/?tag=vip",
+		"/contacts/?email=secret@example.com",
+		fmt.Sprintf("/contacts/%d", alpha.contact),
+		fmt.Sprintf("/contacts/%d/tasks", alpha.contact),
+		fmt.Sprintf("/contacts/%d/timeline", alpha.contact),
+		fmt.Sprintf("/contacts/%d/external-refs", alpha.contact),
+		fmt.Sprintf("/contacts/%d/consents", alpha.contact),
+		fmt.Sprintf("/contacts/%d/tags", alpha.contact),
+		"/contacts/by-external/crm/x-1",
+		"/contacts/export.csv",
+		"/tasks/",
+		"/tasks/?view=all",
+		fmt.Sprintf("/tasks/%d", alpha.task),
+		"/books/",
+		fmt.Sprintf("/books/%d/shares", alpha.book),
+		"/imports/",
+		fmt.Sprintf("/imports/%d", alpha.importJob),
+		"/consents",
+		"/consents?status=granted",
+		fmt.Sprintf("/privacy/subjects/%d/export", alpha.contact),
+		"/audit/",
+		"/audit/export.jsonl",
+		"/retention/report",
+	}
+	writes := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"PUT", fmt.Sprintf("/contacts/%d", alpha.contact), Contact{Name: "beta"}},
+		{"POST", fmt.Sprintf("/contacts/%d/timeline", alpha.contact), Activity{Type: "note", Body: "beta"}},
+		{"POST", fmt.Sprintf("/contacts/%d/consents", alpha.contact), Consent{Purpose: "beta", Status: ConsentWithdrawn}},
+		{"PUT", fmt.Sprintf("/contacts/%d/tags/beta", alpha.contact), nil},
+		{"DELETE", fmt.Sprintf("/contacts/%d/tags/vip", alpha.contact), nil},
+		{"POST", "/tasks/", Task{ContactID: alpha.contact, Title: "beta", DueAt: time.Now()}},
+		{"PUT", fmt.Sprintf("/tasks/%d", alpha.task), Task{ContactID: alpha.contact, Title: "beta", DueAt: time.Now()}},
+		{"DELETE", fmt.Sprintf("/tasks/%d", alpha.task), nil},
+		{"PUT", fmt.Sprintf("/books/%d/shares", alpha.book), Share{Grantee: "user:beta", Level: ShareWrite}},
+		{"DELETE", fmt.Sprintf("/books/%d/shares/%d", alpha.book, alpha.share), nil},
+		{"DELETE", fmt.Sprintf("/imports/%d", alpha.importJob), nil},
+		{"POST", "/contacts:batch", BatchRequest{Mode: BatchBestEffort, Operations: []BatchOperation{
+			{Op: "update", ID: alpha.contact, Contact: &Contact{Name: "beta"}},
+			{Op: "delete", ID: alpha.contact},
+		}}},
+		{"POST", "/contacts/", Contact{Name: "beta", AddressBookID: alpha.book}},
+		{"POST", fmt.Sprintf("/privacy/subjects/%d/erase", alpha.contact), nil},
+		{"DELETE", fmt.Sprintf("/contacts/%d", alpha.contact), nil},
+		{"DELETE", fmt.Sprintf("/books/%d", alpha.book), nil},
+	}
+
+	for _, role := range []string{RoleAdmin, RoleEditor} {
+		t.Run(role, func(t *testing.T) {
+			betaKey := createTestAPIKey(t, "beta", "beta-"+role, role)
+			for _, path := range reads {
+				response := testRequest(t, r, betaKey, "GET", path, nil)
+				if strings.Contains(response.Body.String(), "alpha") {
+					t.Errorf("GET %s returns the data of another tenant: %s", path, response.Body.String())
+				}
+			}
+			for _, write := range writes {
+				response := testRequest(t, r, betaKey, write.method, write.path, write.body)
+				if strings.Contains(response.Body.String(), "alpha") {
+					t.Errorf("%s %s returns the data of another tenant: %s", write.method, write.path, response.Body.String())
+				}
+				if response.Code < 300 && write.path != "/contacts:batch" {
+					t.Errorf("%s %s succeeds on the data of another tenant: %d %s", write.method, write.path, response.Code, response.Body.String())
+				}
+			}
+			var batch BatchResponse
+			decodeResponse(t, testRequest(t, r, betaKey, "POST", "/contacts:batch", BatchRequest{
+				Mode: BatchBestEffort, Operations: []BatchOperation{{Op: "update", ID: alpha.contact, Contact: &Contact{Name: "beta"}}},
+			}), http.StatusOK, &batch)
+			if batch.Succeeded != 0 {
+				t.Errorf("a batch of the tenant beta changes the contact of alpha: %+v", batch)
+			}
+		})
+	}
+
+	// the data of alpha is unchanged
+	var contact Contact
+	decodeResponse(t, testRequest(t, r, alphaKey, "GET", fmt.Sprintf("/contacts/%d", alpha.contact), nil), http.StatusOK, &contact)
+	if contact.Name != "alpha contact" {
+		t.Errorf("the contact of alpha has been changed: %+v", contact)
+	}
+	var tags []string
+	decodeResponse(t, testRequest(t, r, alphaKey, "GET", fmt.Sprintf("/contacts/%d/tags", alpha.contact), nil), http.StatusOK, &tags)
+	if len(tags) != 1 || tags[0] != "vip" {
+		t.Errorf("the tags of alpha have been changed: %+v", tags)
+	}
+	var task Task
+	decodeResponse(t, testRequest(t, r, alphaKey, "GET", fmt.Sprintf("/tasks/%d", alpha.task), nil), http.StatusOK, &task)
+	if task.Title != "alpha task" {
+		t.Errorf("the task of alpha has been changed: %+v", task)
+	}
+	var shares []Share
+	decodeResponse(t, testRequest(t, r, alphaKey, "GET", fmt.Sprintf("/books/%d/shares", alpha.book), nil), http.StatusOK, &shares)
+	if len(shares) != 1 || shares[0].Grantee != "team:alpha-team" {
+		t.Errorf("the shares of alpha have been changed: %+v", shares)
+	}
+	var consents []Consent
+	decodeResponse(t, testRequest(t, r, alphaKey, "GET", fmt.Sprintf("/contacts/%d/consents", alpha.contact), nil), http.StatusOK, &consents)
+	if len(consents) != 1 {
+		t.Errorf("the consents of alpha have been changed: %+v", consents)
+	}
+	var job ImportJob
+	decodeResponse(t, testRequest(t, r, alphaKey, "GET", fmt.Sprintf("/imports/%d", alpha.importJob), nil), http.StatusOK, &job)
+	if job.Status != ImportQueued {
+		t.Errorf("the import of alpha has been changed: %+v", job)
+	}
+}
+
+// TestTenantJobs checks that the background jobs, that read the rows of all
+// the tenants, write in the tenant of each row.
+func TestTenantJobs(t *testing.T) {
+	setupTestDB(t)
+	for _, tenant := range []string{"alpha", "beta"} {
+		scoped := db.WithContext(withTenant(context.Background(), tenant))
+		contact := Contact{Name: tenant + " contact", Owner: "user:" + tenant}
+		if result := scoped.Create(&contact); result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		task := Task{ContactID: contact.ID, Title: tenant + " task", DueAt: time.Now().Add(-time.Minute), Status: TaskOpen}
+		if result := scoped.Create(&task); result.Error != nil {
+			t.Fatal(result.Error)
+		}
+	}
+	notifier := &recordingNotifier{}
+	err := forAllTenants(db, func(db *gorm.DB) error {
+		notifyDueTasks(db, notifier, time.Now())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifier.sent) != 2 {
+		t.Fatalf("expected a reminder for each tenant, got %v", notifier.sent)
+	}
+	for _, sent := range notifier.sent {
+		tenant, _, _ := strings.Cut(sent, " ")
+		if !strings.Contains(sent, tenant+" contact") {
+			t.Errorf("the reminder of a task is sent with the contact of another tenant: %s", sent)
+		}
+	}
+}
+
+// recordingNotifier records the reminders instead of sending them.
+type recordingNotifier struct {
+	sent []string
+}
+
+func (n *recordingNotifier) Notify(task Task, contact Contact) error {
+	n.sent = append(n.sent, task.Title+": "+contact.Name)
+	return nil
+}
+
+// TestTenantOfToken checks that a token without the tenant claim gets the
+// tenant of the subdomain, or the default one, and that a token of another
+// tenant is refused on a subdomain.
+func TestTenantOfToken(t *testing.T) {
+	setupTestDB(t)
+	config.JWTSecret = "a secret of the tests"
+	config.TenantDomain = "contacts.example.com"
+	r := newTestAPI(t)
+	token := func(tenant string) string {
+		claims := map[string]interface{}{"sub": "alice", "roles": RoleAdmin, "exp": time.Now().Add(time.Hour).Unix()}
+		if tenant != "" {
+			claims["tenant"] = tenant
+		}
+		return signTestJWT(t, map[string]interface{}{"alg": "HS256"}, claims, signHS256([]byte(config.JWTSecret)))
+	}
+
+	for _, test := range []struct {
+		name, host, claim string
+		status            int
+		tenant            string
+	}{
+		{"no claim on a subdomain", "beta.contacts.example.com", "", http.StatusCreated, "beta"},
+		{"no claim on the domain", "contacts.example.com", "", http.StatusCreated, config.DefaultTenant},
+		{"the claim of the subdomain", "beta.contacts.example.com", "beta", http.StatusCreated, "beta"},
+		{"the claim on the domain", "contacts.example.com", "alpha", http.StatusCreated, "alpha"},
+		{"the claim of another subdomain", "beta.contacts.example.com", "alpha", http.StatusForbidden, ""},
+	} {
+		request := httptest.NewRequest("POST", "/contacts/", strings.NewReader(`{"Name": "`+test.name+`"}`))
+		request.Host = test.host
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+token(test.claim))
+		response := httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+		if response.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.status, response.Code, response.Body.String())
+			continue
+		}
+		if test.tenant == "" {
+			continue
+		}
+		var count int64
+		db.WithContext(withTenant(context.Background(), test.tenant)).Model(Contact{}).Where("name = ?", test.name).Count(&count)
+		if count != 1 {
+			t.Errorf("%s: the contact is not in the tenant %s", test.name, test.tenant)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Activity is an interaction with a contact. The activities are never
+// updated or deleted, together they make the timeline of the contact.
+type Activity struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"index" json:"-"`
+	ContactID uint   `gorm:"index"`
+	// Type is one of "call", "meeting", "email" or "note".
+	Type       string
+	OccurredAt time.Time `gorm:"index"`
+	// Author is the caller that logged the activity, it is set by the
+	// server.
+	Author    string
+	Body      string
+	CreatedAt time.Time
+}
+
+// TimelinePage is a page of the timeline of a contact, the most recent
+// activities come first.
+type TimelinePage struct {
+	Items    []Activity
+	Page     int
+	PageSize int
+	Total    int64
+}
+
+// contactedTypes are the activities that count as having contacted the
+// person, a note is only written for ourselves.
+var contactedTypes = []string{"call", "meeting", "email"}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	lastContactedChunk = 1000
+)
+
+func validateActivity(activity *Activity) error {
+	switch activity.Type {
+	case "call", "meeting", "email", "note":
+	default:
+		return fmt.Errorf("unknown activity type '%s'", activity.Type)
+	}
+	if activity.OccurredAt.IsZero() {
+		activity.OccurredAt = time.Now()
+	}
+	return nil
+}
+
+// pagination reads the page and page_size query parameters.
+func pagination(c *gin.Context) (page int, pageSize int, err error) {
+	page, err = strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, fmt.Errorf("invalid page '%s'", c.Query("page"))
+	}
+	pageSize, err = strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		return 0, 0, fmt.Errorf("page_size must be between 1 and %d", maxPageSize)
+	}
+	return page, pageSize, nil
+}
+
+// CONTROLLERS
+////////////////////////////////////////////////////////////////////////////////
+
+// CreateActivity godoc.
+// @Summary      Log an interaction.
+// @Description  Appends a call, a meeting, an email or a note to the timeline of a contact.
+// @tags         Timeline
+// @Accept       json
+// @Param 		 id    path      int       true  "Contact ID"
+// @Param        Body  body      Activity  true  "The interaction, Type is required, Author is the caller"
+// @Success      201   {object}  Activity
+// @Router       /contacts/{id}/timeline [post]
+func createActivity(c *gin.Context) {
+	db := tenantDB(c)
+	var activity Activity
+	if err := c.ShouldBindJSON(&activity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	activity.ID = 0
+	activity.ContactID = uint(contactId)
+	activity.Author = currentPrincipal(c).Subject
+	if err := validateActivity(&activity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), activity.ContactID, ShareWrite); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := saveActivity(db, &activity); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, activity)
+}
+
+// GetTimeline godoc.
+// @Summary      Get the timeline of a contact.
+// @Description  Returns the interactions with a contact, the most recent first.
+// @tags         Timeline
+// @Produce      json
+// @Param 		 id         path   int  true   "Contact ID"
+// @Param        page       query  int  false  "Page number, starting from 1"
+// @Param        page_size  query  int  false  "Number of activities in a page, 20 by default"
+// @Success      200  {object}  TimelinePage
+// @Router       /contacts/{id}/timeline [get]
+func getTimeline(c *gin.Context) {
+	db := tenantDB(c)
+	contactId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	page, pageSize, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkContactAccess(db, currentPrincipal(c), uint(contactId), ShareRead); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	timeline, err := readTimeline(db, uint(contactId), page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, timeline)
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+func saveActivity(db *gorm.DB, activity *Activity) error {
+	result := db.Create(&activity)
+	if result.Error != nil {
+		return wrapDBError(result.Error, `error saving activity`)
+	}
+	return nil
+}
+
+func readTimeline(db *gorm.DB, contactId uint, page int, pageSize int) (*TimelinePage, error) {
+	timeline := TimelinePage{Items: []Activity{}, Page: page, PageSize: pageSize}
+	result := db.Model(Activity{}).Where("contact_id = ?", contactId).Count(&timeline.Total)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the timeline of contact with id '%d'", contactId)
+	}
+	result = db.Where("contact_id = ?", contactId).
+		Order("occurred_at DESC, id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&timeline.Items)
+	if result.Error != nil {
+		return nil, wrapDBError(result.Error, "cannot read the timeline of contact with id '%d'", contactId)
+	}
+	return &timeline, nil
+}
+
+// fillLastContacted sets the LastContacted field of the contacts from their
+// timeline.
+func fillLastContacted(db *gorm.DB, contacts []Contact) error {
+	last := make(map[uint]time.Time)
+	// the ids are sent in chunks to stay below the limit of parameters of a
+	// single query.
+	for start := 0; start < len(contacts); start += lastContactedChunk {
+		end := start + lastContactedChunk
+		if end > len(contacts) {
+			end = len(contacts)
+		}
+		ids := make([]uint, 0, end-start)
+		for _, contact := range contacts[start:end] {
+			ids = append(ids, contact.ID)
+		}
+
+		var rows []struct {
+			ContactID     uint
+			LastContacted time.Time
+		}
+		result := db.Model(Activity{}).
+			Select("contact_id, MAX(occurred_at) AS last_contacted").
+			Where("contact_id IN ? AND type IN ?", ids, contactedTypes).
+			Group("contact_id").
+			Scan(&rows)
+		if result.Error != nil {
+			return wrapDBError(result.Error, "cannot read when the contacts were last contacted")
+		}
+		for _, row := range rows {
+			last[row.ContactID] = row.LastContacted
+		}
+	}
+
+	for i := range contacts {
+		if t, ok := last[contacts[i].ID]; ok {
+			contacts[i].LastContacted = &t
+		}
+	}
+	return nil
+}
+
+func fillContactLastContacted(db *gorm.DB, contact *Contact) error {
+	contacts := []Contact{*contact}
+	if err := fillLastContacted(db, contacts); err != nil {
+		return err
+	}
+	contact.LastContacted = contacts[0].LastContacted
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// The requests and the queries are traced with OpenTelemetry: every request
+// has a span, continuing the trace of the caller when it sends the W3C
+// traceparent header, and every query made for the request has a span in
+// it, so a slow request shows which queries made it slow, e.g. the ones of
+// readAllContacts. The spans are exported with OTLP, over gRPC or HTTP, or
+// written to the standard output.
+
+const tracerName = "example/contact-manager"
+
+// newTracerProvider creates the provider of the exporter of the
+// configuration, nil when the tracing is disabled. The OTLP exporters read
+// the endpoint and the headers from the standard OTEL_EXPORTER_OTLP_
+// variables.
+func newTracerProvider(ctx context.Context, cfg Config) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.TracesExporter {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		switch cfg.OTLPProtocol {
+		case "grpc":
+			exporter, err = otlptracegrpc.New(ctx)
+		case "http/protobuf":
+			exporter, err = otlptracehttp.New(ctx)
+		default:
+			return nil, fmt.Errorf("unknown OTLP protocol '%s', use grpc or http/protobuf", cfg.OTLPProtocol)
+		}
+	case "stdout", "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown traces exporter '%s', use otlp, stdout or none", cfg.TracesExporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the traces exporter: %w", err)
+	}
+	service, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(service),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	), nil
+}
+
+// setupTracing makes the provider the global one, with the W3C trace
+// context and baggage propagation.
+func setupTracing(provider *sdktrace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// traceRequests starts the span of the request, in the trace of the caller
+// when it sends one. It must run before gin.Recovery, so the span of a
+// request that panics has the status 500.
+func traceRequests() gin.HandlerFunc {
+	tracer := otel.Tracer(tracerName)
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		name := c.Request.Method + " " + route
+		if route == "" {
+			name = c.Request.Method
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+				semconv.UserAgentOriginal(c.Request.UserAgent()),
+				attribute.String("request.id", c.GetString(requestIDKey)),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if principal, ok := c.Get(principalKey); ok {
+			span.SetAttributes(attribute.String("enduser.id", principal.(*Principal).Subject))
+		}
+		if tenant, ok := tenantFromContext(c.Request.Context()); ok {
+			span.SetAttributes(attribute.String("tenant", tenant))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, c.Errors.String())
+		}
+	}
+}
+
+// DATABASE
+////////////////////////////////////////////////////////////////////////////////
+
+const tracingSpanKey = "tracing:span"
+
+// queryTracer is the GORM plugin that traces the queries, in the span of the
+// request of their context.
+type queryTracer struct {
+	tracer trace.Tracer
+	system string
+}
+
+func newQueryTracer(db *gorm.DB) *queryTracer {
+	return &queryTracer{tracer: otel.Tracer(tracerName), system: db.Dialector.Name()}
+}
+
+func (t *queryTracer) Name() string {
+	return "tracing"
+}
+
+func (t *queryTracer) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("*").Register("tracing:start_create", t.startSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Create().After("*").Register("tracing:end_create", t.endSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Query().Before("*").Register("tracing:start_query", t.startSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Query().After("*").Register("tracing:end_query", t.endSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("*").Register("tracing:start_update", t.startSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("*").Register("tracing:end_update", t.endSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("*").Register("tracing:start_delete", t.startSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().After("*").Register("tracing:end_delete", t.endSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("*").Register("tracing:start_row", t.startSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Row().After("*").Register("tracing:end_row", t.endSpan); err != nil {
+		return err
+	}
+	if err := callbacks.Raw().Before("*").Register("tracing:start_raw", t.startSpan); err != nil {
+		return err
+	}
+	return callbacks.Raw().After("*").Register("tracing:end_raw", t.endSpan)
+}
+
+// startSpan starts the span of the query, endSpan names it after the
+// statement and the table, e.g. "SELECT contacts". The queries outside of a
+// trace, the polling of the workers, are not traced.
+func (t *queryTracer) startSpan(tx *gorm.DB) {
+	ctx := tx.Statement.Context
+	if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	_, span := t.tracer.Start(ctx, "query", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemKey.String(t.system)))
+	tx.InstanceSet(tracingSpanKey, span)
+}
+
+// endSpan adds the statement, without the values, and the result to the
+// span of the query.
+func (t *queryTracer) endSpan(tx *gorm.DB) {
+	value, ok := tx.InstanceGet(tracingSpanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	defer span.End()
+	statement := tx.Statement.SQL.String()
+	operation, _, _ := strings.Cut(strings.TrimSpace(statement), " ")
+	name := strings.ToUpper(operation)
+	if tx.Statement.Table != "" {
+		name += " " + tx.Statement.Table
+		span.SetAttributes(semconv.DBSQLTable(tx.Statement.Table))
+	}
+	span.SetName(name)
+	span.SetAttributes(
+		semconv.DBOperation(strings.ToUpper(operation)),
+		semconv.DBStatement(statement),
+		attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+	)
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(tx.Error)
+		span.SetStatus(codes.Error, tx.Error.Error())
+	}
+}
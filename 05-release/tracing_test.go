@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestTraceRequests checks that the span of a request continues the trace of
+// the caller and contains the spans of its queries.
+func TestTraceRequests(t *testing.T) {
+	setupTestDB(t)
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	savedProvider, savedPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	setupTracing(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(savedProvider)
+		otel.SetTextMapPropagator(savedPropagator)
+	})
+	if err := db.Use(newQueryTracer(db)); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(traceRequests(), gin.Recovery())
+	r.GET("/contacts/:id", func(c *gin.Context) {
+		var contacts []Contact
+		db.WithContext(withTenant(c.Request.Context(), "alpha")).Where("id = ?", c.Param("id")).Find(&contacts)
+		c.JSON(http.StatusOK, contacts)
+	})
+	r.GET("/panic", func(c *gin.Context) {
+		panic("the handler failed")
+	})
+
+	// the queries outside of a request are not traced
+	db.WithContext(context.Background()).Find(&[]Contact{})
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Fatalf("the query outside of a request is traced: %v", spans)
+	}
+
+	request := httptest.NewRequest("GET", "/contacts/1", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), request)
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected the spans of the request and of the query, got %v", spans.Snapshots())
+	}
+	query, server := spans[0], spans[1]
+	if server.Name != "GET /contacts/:id" || server.SpanKind != trace.SpanKindServer ||
+		server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		server.Parent.SpanID().String() != "00f067aa0ba902b7" || !server.Parent.IsRemote() {
+		t.Errorf("the span of the request does not continue the trace of the caller: %+v", server)
+	}
+	if query.Name != "SELECT contacts" || query.SpanKind != trace.SpanKindClient ||
+		query.Parent.SpanID() != server.SpanContext.SpanID() || query.SpanContext.TraceID() != server.SpanContext.TraceID() {
+		t.Errorf("the span of the query is not a child of the request: %+v", query)
+	}
+	statement := ""
+	for _, attribute := range query.Attributes {
+		if attribute.Key == "db.statement" {
+			statement = attribute.Value.AsString()
+		}
+	}
+	if !strings.HasPrefix(statement, "SELECT") || !strings.Contains(statement, "id = ?") {
+		t.Errorf("unexpected statement of the query %q", statement)
+	}
+
+	// a panic recovered after the span is an error of the span
+	exporter.Reset()
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	spans = exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Status.Code != codes.Error || spans[0].Parent.IsValid() {
+		t.Errorf("unexpected span of the panic %v", spans.Snapshots())
+	}
+}
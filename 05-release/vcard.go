@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// vCardProperty is a line of a vCard, e.g. "TEL;TYPE=cell:+39 123".
+type vCardProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// unfoldVCard joins the lines that the vCard format splits: a line that
+// starts with a space or a tab continues the previous one. Lines[i] is the
+// line number of the file where the i-th unfolded line starts.
+func unfoldVCard(text string) (lines []string, numbers []int) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	for i, line := range strings.Split(text, "\n") {
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		// vCard 2.1 quoted-printable values end with "=" when they continue
+		// on the next line.
+		if n := len(lines); n > 0 && strings.HasSuffix(lines[n-1], "=") &&
+			strings.Contains(strings.ToUpper(lines[n-1]), "QUOTED-PRINTABLE") {
+			lines[n-1] += "\n" + line
+			continue
+		}
+		lines = append(lines, line)
+		numbers = append(numbers, i+1)
+	}
+	return lines, numbers
+}
+
+func parseVCardProperty(line string) (vCardProperty, error) {
+	// the name and the parameters end at the first colon that is not quoted
+	quoted := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return vCardProperty{}, fmt.Errorf("invalid line '%s'", line)
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	property := vCardProperty{
+		Params: make(map[string]string),
+		Value:  line[colon+1:],
+	}
+	property.Name = strings.ToUpper(parts[0])
+	// the group prefix, as in "item1.EMAIL", is not used
+	if i := strings.LastIndex(property.Name, "."); i >= 0 {
+		property.Name = property.Name[i+1:]
+	}
+	for _, param := range parts[1:] {
+		key, value, found := strings.Cut(param, "=")
+		if !found {
+			// vCard 2.1 allows parameters without name, e.g. "TEL;CELL"
+			key, value = "TYPE", param
+		}
+		property.Params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+
+	if strings.EqualFold(property.Params["ENCODING"], "QUOTED-PRINTABLE") ||
+		strings.EqualFold(property.Params["TYPE"], "QUOTED-PRINTABLE") {
+		reader := quotedprintable.NewReader(strings.NewReader(property.Value))
+		decoded, err := io.ReadAll(reader)
+		if err != nil {
+			return vCardProperty{}, fmt.Errorf("invalid quoted-printable value of %s", property.Name)
+		}
+		property.Value = string(decoded)
+	}
+	return property, nil
+}
+
+// vCardValues splits a structured value, like N or ADR, in its components.
+func vCardValues(value string) []string {
+	var values []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			switch r {
+			case 'n', 'N':
+				current.WriteRune('\n')
+			default:
+				current.WriteRune(r)
+			}
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ';':
+			values = append(values, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(values, current.String())
+}
+
+// vCardText removes the escaping from a text value.
+func vCardText(value string) string {
+	return strings.Join(vCardValues(value), ";")
+}
+
+func joinNotEmpty(values []string, separator string) string {
+	var parts []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			parts = append(parts, value)
+		}
+	}
+	return strings.Join(parts, separator)
+}
+
+// parseVCards reads the contacts from a file with one or more vCards, one
+// record for every card. Row is the line where the card begins.
+func parseVCards(text string) ([]ImportRecord, error) {
+	lines, numbers := unfoldVCard(text)
+
+	var records []ImportRecord
+	var current *ImportRecord
+	var structuredName string
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		property, err := parseVCardProperty(line)
+		if err != nil {
+			if current == nil {
+				return nil, fmt.Errorf("line %d: %w", numbers[i], err)
+			}
+			current.Errors = append(current.Errors, fmt.Sprintf("line %d: %s", numbers[i], err))
+			continue
+		}
+
+		switch property.Name {
+		case "BEGIN":
+			if current != nil {
+				return nil, fmt.Errorf("line %d: vCard not closed", numbers[i])
+			}
+			current = &ImportRecord{Row: numbers[i]}
+			structuredName = ""
+			continue
+		case "END":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: END without BEGIN", numbers[i])
+			}
+			if current.Contact.Name == "" {
+				current.Contact.Name = structuredName
+			}
+			current.Errors = append(current.Errors, validateContact(&current.Contact)...)
+			records = append(records, *current)
+			current = nil
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("line %d: property outside of a vCard", numbers[i])
+		}
+
+		contact := &current.Contact
+		switch property.Name {
+		case "FN":
+			contact.Name = vCardText(property.Value)
+		case "N":
+			// Family;Given;Additional;Prefix;Suffix
+			n := append(vCardValues(property.Value), "", "", "", "", "")
+			structuredName = joinNotEmpty([]string{n[3], n[1], n[2], n[0], n[4]}, " ")
+		case "TEL":
+			if contact.Phone == "" {
+				contact.Phone = strings.TrimPrefix(vCardText(property.Value), "tel:")
+			}
+		case "EMAIL":
+			if contact.Email == "" {
+				contact.Email = vCardText(property.Value)
+			}
+		case "ADR":
+			if contact.Address == "" {
+				// PO box;Extended;Street;City;Region;Postal code;Country
+				contact.Address = joinNotEmpty(vCardValues(property.Value), ", ")
+			}
+		case "URL":
+			if contact.Website == "" {
+				contact.Website = vCardText(property.Value)
+			}
+		case "NOTE":
+			contact.Notes = joinNotEmpty([]string{contact.Notes, vCardText(property.Value)}, "\n")
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("line %d: vCard not closed", current.Row)
+	}
+	return records, nil
+}
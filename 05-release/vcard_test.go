@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVCards(t *testing.T) {
+	text := "BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"N:Roe;Jane;;Dr.;\r\n" +
+		"TEL;TYPE=cell:+39 123\r\n" +
+		"TEL;TYPE=home:+39 456\r\n" +
+		"item1.EMAIL;TYPE=INTERNET:jane@example.com\r\n" +
+		"EMAIL:roe@example.com\r\n" +
+		"ADR;TYPE=home:;;1 Main St\\, Apt 2;Springfield;;12345;\r\n" +
+		"NOTE:met at the conference\\, lo\r\n" +
+		" ng ago\\nin Rome\r\n" +
+		"END:VCARD\r\n" +
+		"\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"VERSION:2.1\r\n" +
+		"FN;ENCODING=QUOTED-PRINTABLE:Ren=C3=A9e =\r\n" +
+		"Lee\r\n" +
+		"TEL;CELL:tel:+39 789\r\n" +
+		"URL:example.com\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"no colon\r\n" +
+		"END:VCARD\r\n"
+	records, err := parseVCards(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ImportRecord{
+		{Row: 1, Contact: Contact{
+			Name:    "Dr. Jane Roe",
+			Phone:   "+39 123",
+			Email:   "jane@example.com",
+			Address: "1 Main St, Apt 2, Springfield, 12345",
+			Notes:   "met at the conference, long ago\nin Rome",
+		}},
+		{Row: 13, Contact: Contact{Name: "Renée Lee", Phone: "+39 789", Website: "example.com"},
+			Errors: []string{"invalid website 'example.com'"}},
+		{Row: 20, Errors: []string{"line 21: invalid line 'no colon'", "the name is required"}},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("unexpected records\n%+v\nexpected\n%+v", records, expected)
+	}
+
+	for _, text := range []string{
+		"FN:Jane Roe\n",
+		"BEGIN:VCARD\nFN:Jane Roe\n",
+		"BEGIN:VCARD\nBEGIN:VCARD\nEND:VCARD\n",
+		"END:VCARD\n",
+	} {
+		if _, err := parseVCards(text); err == nil {
+			t.Errorf("the file %q is accepted", text)
+		}
+	}
+}